@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/sangketkit01/7-coding-test/internal/db"
+	"github.com/sangketkit01/7-coding-test/internal/token"
+	"github.com/sangketkit01/7-coding-test/internal/util"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	apiKeyPrefix       = "sk_"
+	apiKeyDisplayChars = 10
+	// apiKeyTouchInterval limits how often the last use of a key is written.
+	apiKeyTouchInterval = time.Minute
+)
+
+// authenticateAPIKey looks up an API key and builds a payload for its
+// owner. The owner's roles are read on every call so revoking a role takes
+// effect immediately.
+func (app *App) authenticateAPIKey(ctx context.Context, rawKey string) (*token.Payload, error) {
+	key, err := app.apiKeys.GetAPIKeyByHash(ctx, util.HashToken(rawKey))
+	if err != nil {
+		if errors.Is(err, db.ErrAPIKeyNotFound) {
+			return nil, errInvalidAPIKey
+		}
+
+		return nil, err
+	}
+
+	if !key.IsActive() {
+		return nil, errInvalidAPIKey
+	}
+
+	owner, err := app.model.FetchUserByID(ctx, key.UserID.Hex())
+	if err != nil {
+		log.Printf("cannot load owner of api key %s: %v\n", key.ID.Hex(), err)
+		if errors.Is(err, db.ErrUserNotFound) {
+			return nil, errInvalidAPIKey
+		}
+
+		return nil, err
+	}
+
+	now := time.Now()
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) > apiKeyTouchInterval {
+		// the request may be over before the write, so it gets its own context
+		go app.apiKeys.TouchAPIKey(context.Background(), key.ID, now)
+	}
+
+	return &token.Payload{
+		ID:        owner.ID,
+		TokenType: token.TokenTypeAPIKey,
+		Roles:     owner.Roles,
+		Scopes:    key.Scopes,
+		APIKeyID:  key.ID.Hex(),
+		IssuedAt:  key.CreatedAt,
+		ExpiredAt: key.ExpiresAt,
+	}, nil
+}
+
+type CreateAPIKeyRequest struct {
+	Name          string   `json:"name" validate:"required,max=100"`
+	Scopes        []string `json:"scopes" validate:"required,min=1"`
+	ExpiresInDays int      `json:"expires_in_days" validate:"omitempty,min=1"`
+}
+
+type CreateAPIKeyResponse struct {
+	APIKey *db.APIKey `json:"api_key"`
+	Key    string     `json:"key"`
+}
+
+// createAPIKey creates a key for owner. The plain key is only returned
+// here, it cannot be recovered later.
+func (app *App) createAPIKey(c *fiber.Ctx, owner *db.User) error {
+	var req CreateAPIKeyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid api key request")
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	for _, scope := range req.Scopes {
+		if !db.IsValidScope(scope) {
+			return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("unknown scope: %s", scope))
+		}
+
+		if scope == db.ScopeAdmin && !owner.HasRole(db.RoleAdmin) {
+			return fiber.NewError(fiber.StatusBadRequest, "the admin scope needs an owner with the admin role")
+		}
+
+		// only admins create service accounts, so this keeps introspection
+		// to trusted clients
+		if scope == db.ScopeIntrospect && !owner.ServiceAccount {
+			return fiber.NewError(fiber.StatusBadRequest, "the tokens:introspect scope is only for service accounts")
+		}
+	}
+
+	expiry := app.config.APIKeyDefaultExpiry
+	if req.ExpiresInDays > 0 {
+		expiry = time.Duration(req.ExpiresInDays) * 24 * time.Hour
+	}
+
+	if expiry > app.config.APIKeyMaxExpiry {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("api keys cannot live longer than %s", app.config.APIKeyMaxExpiry))
+	}
+
+	secret, err := util.RandomToken(32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "cannot create api key")
+	}
+	rawKey := apiKeyPrefix + secret
+
+	key, err := app.apiKeys.InsertAPIKey(c.UserContext(), db.APIKey{
+		UserID:    owner.ID,
+		Name:      req.Name,
+		Prefix:    rawKey[:apiKeyDisplayChars],
+		KeyHash:   util.HashToken(rawKey),
+		Scopes:    req.Scopes,
+		ExpiresAt: time.Now().Add(expiry),
+	})
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot create api key")
+	}
+
+	event := newAuditEvent(c, db.AuditAPIKeyCreate, owner.ID)
+	event.SetMetadata("key_id", key.ID.Hex())
+	event.SetMetadata("scopes", strings.Join(key.Scopes, " "))
+	app.audit.Record(event)
+
+	return c.Status(fiber.StatusCreated).JSON(CreateAPIKeyResponse{APIKey: key, Key: rawKey})
+}
+
+func (app *App) listAPIKeys(c *fiber.Ctx, ownerID primitive.ObjectID) error {
+	keys, err := app.apiKeys.ListAPIKeys(c.UserContext(), ownerID)
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot list api keys")
+	}
+
+	return c.JSON(fiber.Map{"api_keys": keys})
+}
+
+func (app *App) revokeAPIKey(c *fiber.Ctx, ownerID primitive.ObjectID) error {
+	keyID, err := primitive.ObjectIDFromHex(c.Params("keyId"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid api key id")
+	}
+
+	if err := app.apiKeys.RevokeAPIKey(c.UserContext(), ownerID, keyID); err != nil {
+		if errors.Is(err, db.ErrAPIKeyNotFound) {
+			return fiber.NewError(fiber.StatusNotFound, err.Error())
+		}
+
+		return storeError(err, fiber.StatusInternalServerError, "cannot revoke api key")
+	}
+
+	event := newAuditEvent(c, db.AuditAPIKeyRevoke, ownerID)
+	event.SetMetadata("key_id", keyID.Hex())
+	app.audit.Record(event)
+
+	return c.JSON(fiber.Map{"message": "Revoke api key successfully."})
+}
+
+func (app *App) CreateAPIKey(c *fiber.Ctx) error {
+	payload, ok := c.Locals(payloadHeader).(*token.Payload)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
+	}
+
+	owner, err := app.model.FetchUserByID(c.UserContext(), payload.ID.Hex())
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, err.Error())
+	}
+
+	return app.createAPIKey(c, owner)
+}
+
+func (app *App) ListAPIKeys(c *fiber.Ctx) error {
+	payload, ok := c.Locals(payloadHeader).(*token.Payload)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
+	}
+
+	return app.listAPIKeys(c, payload.ID)
+}
+
+func (app *App) RevokeAPIKey(c *fiber.Ctx) error {
+	payload, ok := c.Locals(payloadHeader).(*token.Payload)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
+	}
+
+	return app.revokeAPIKey(c, payload.ID)
+}
+
+func (app *App) CreateUserAPIKey(c *fiber.Ctx) error {
+	owner, err := app.model.FetchUserByID(c.UserContext(), c.Params("id"))
+	if err != nil {
+		return storeError(err, fiber.StatusNotFound, err.Error())
+	}
+
+	return app.createAPIKey(c, owner)
+}
+
+func (app *App) ListUserAPIKeys(c *fiber.Ctx) error {
+	ownerID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid user id")
+	}
+
+	return app.listAPIKeys(c, ownerID)
+}
+
+func (app *App) RevokeUserAPIKey(c *fiber.Ctx) error {
+	ownerID, err := primitive.ObjectIDFromHex(c.Params("id"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid user id")
+	}
+
+	return app.revokeAPIKey(c, ownerID)
+}
+
+type CreateServiceAccountRequest struct {
+	Name  string `json:"name" validate:"required"`
+	Email string `json:"email" validate:"required,email"`
+}
+
+// CreateServiceAccount creates a user that cannot log in with a password
+// and is meant to own API keys for batch jobs and other services.
+func (app *App) CreateServiceAccount(c *fiber.Ctx) error {
+	var req CreateServiceAccountRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid service account request")
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	password, err := util.RandomToken(32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "cannot create service account")
+	}
+
+	account, err := app.model.Insert(c.UserContext(), db.User{
+		Name:           req.Name,
+		Email:          req.Email,
+		Password:       password,
+		ServiceAccount: true,
+	})
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, err.Error())
+	}
+
+	event := newAuditEvent(c, db.AuditUserCreate, account.ID)
+	event.Changes = db.DiffUsers(nil, account)
+	app.audit.Record(event)
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"id":              account.ID,
+		"name":            account.Name,
+		"email":           account.Email,
+		"service_account": account.ServiceAccount,
+	})
+}
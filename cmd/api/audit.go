@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sangketkit01/7-coding-test/internal/db"
+	"github.com/sangketkit01/7-coding-test/internal/token"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	defaultAuditEventLimit = 50
+	maxAuditEventLimit     = 500
+)
+
+// auditLogger appends events to the audit log. It is shared by the HTTP
+// handlers, the gRPC service and the token issuer. A failed write is logged
+// and does not fail the request that caused it.
+type auditLogger struct {
+	store db.AuditEventStore
+	// mu keeps writers in this process from racing for the same sequence
+	// number, the store still retries races with other processes.
+	mu sync.Mutex
+}
+
+// Record writes the event even when the request that caused it was
+// cancelled, the store still bounds the write.
+func (audit *auditLogger) Record(event db.AuditEvent) {
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+
+	if _, err := audit.store.AppendAuditEvent(context.Background(), event); err != nil {
+		log.Printf("failed to write audit event %s: %v\n", event.Action, err)
+	}
+}
+
+// newAuditEvent starts an event for an HTTP request. The actor is the owner
+// of the request's token, if it has one.
+func newAuditEvent(c *fiber.Ctx, action string, targetID primitive.ObjectID) db.AuditEvent {
+	event := db.AuditEvent{
+		Action:    action,
+		TargetID:  targetID,
+		IP:        c.IP(),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+	}
+
+	if payload, ok := c.Locals(payloadHeader).(*token.Payload); ok {
+		setAuditActor(&event, payload)
+	}
+
+	return event
+}
+
+// newGRPCAuditEvent starts an event for a gRPC call.
+func newGRPCAuditEvent(ctx context.Context, action string, targetID primitive.ObjectID) db.AuditEvent {
+	ip, userAgent := grpcClientInfo(ctx)
+
+	event := db.AuditEvent{
+		Action:    action,
+		TargetID:  targetID,
+		IP:        ip,
+		UserAgent: userAgent,
+	}
+
+	if payload, ok := payloadFromContext(ctx); ok {
+		setAuditActor(&event, payload)
+	}
+
+	return event
+}
+
+// setAuditActor sets who made the request. With an impersonation token
+// that is the admin, the impersonated user is kept in the metadata.
+func setAuditActor(event *db.AuditEvent, payload *token.Payload) {
+	event.ActorID = payload.ID
+
+	if payload.APIKeyID != "" {
+		event.SetMetadata("api_key_id", payload.APIKeyID)
+	}
+
+	if payload.IsImpersonation() {
+		event.ActorID = *payload.ActorID
+		event.SetMetadata("impersonated_user_id", payload.ID.Hex())
+	}
+}
+
+// grpcClientInfo returns the address and user agent of the caller.
+func grpcClientInfo(ctx context.Context) (string, string) {
+	var ip, userAgent string
+
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		ip = p.Addr.String()
+		if host, _, err := net.SplitHostPort(ip); err == nil {
+			ip = host
+		}
+	}
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("user-agent"); len(values) > 0 {
+			userAgent = values[0]
+		}
+	}
+
+	return ip, userAgent
+}
+
+// recordUserChange records action against before.ID with the fields that
+// differ between before and the user as it is stored now.
+func (app *App) recordUserChange(c *fiber.Ctx, action string, before *db.User) {
+	app.audit.Record(app.userChangeEvent(c, action, before))
+}
+
+func (app *App) userChangeEvent(c *fiber.Ctx, action string, before *db.User) db.AuditEvent {
+	event := newAuditEvent(c, action, before.ID)
+
+	after, err := app.model.FetchUserByID(c.UserContext(), before.ID.Hex())
+	if err != nil {
+		log.Printf("cannot load user %s for audit event: %v\n", before.ID.Hex(), err)
+	} else {
+		event.Changes = db.DiffUsers(before, after)
+	}
+
+	return event
+}
+
+// recordLogin records a successful sign in. The request has no token yet,
+// so the user is also the actor.
+func (app *App) recordLogin(c *fiber.Ctx, user *db.User, method string) {
+	event := newAuditEvent(c, db.AuditUserLogin, user.ID)
+	event.ActorID = user.ID
+	event.SetMetadata("method", method)
+
+	app.audit.Record(event)
+}
+
+// recordLoginFailure records a refused login. The target is only known
+// when the email belongs to an account.
+func (app *App) recordLoginFailure(c *fiber.Ctx, email, reason string) {
+	var targetID primitive.ObjectID
+	if user, err := app.model.GetUserByEmail(c.UserContext(), email); err == nil {
+		targetID = user.ID
+	}
+
+	event := newAuditEvent(c, db.AuditUserLoginFail, targetID)
+	event.SetMetadata("email", email)
+	event.SetMetadata("reason", reason)
+
+	app.audit.Record(event)
+}
+
+// ListAuditEvents returns audit events, newest first. Results can be
+// filtered with the actor, target, action, from and to query parameters,
+// times are RFC 3339. Older pages are read with before=<seq>.
+func (app *App) ListAuditEvents(c *fiber.Ctx) error {
+	var filter db.AuditEventFilter
+	var err error
+
+	if actor := c.Query("actor"); actor != "" {
+		if filter.ActorID, err = primitive.ObjectIDFromHex(actor); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid actor id")
+		}
+	}
+
+	if target := c.Query("target"); target != "" {
+		if filter.TargetID, err = primitive.ObjectIDFromHex(target); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "invalid target id")
+		}
+	}
+
+	filter.Action = c.Query("action")
+
+	if from := c.Query("from"); from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "from must be an RFC 3339 time")
+		}
+	}
+
+	if to := c.Query("to"); to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "to must be an RFC 3339 time")
+		}
+	}
+
+	if before := c.Query("before"); before != "" {
+		if filter.BeforeSeq, err = strconv.ParseInt(before, 10, 64); err != nil || filter.BeforeSeq < 1 {
+			return fiber.NewError(fiber.StatusBadRequest, "before must be a positive sequence number")
+		}
+	}
+
+	filter.Limit = int64(c.QueryInt("limit", defaultAuditEventLimit))
+	if filter.Limit < 1 || filter.Limit > maxAuditEventLimit {
+		return fiber.NewError(fiber.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxAuditEventLimit))
+	}
+
+	events, err := app.audit.store.ListAuditEvents(c.UserContext(), filter)
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot list audit events")
+	}
+
+	return c.JSON(fiber.Map{"audit_events": events})
+}
+
+// VerifyAuditEvents checks the hash chain of the whole audit log.
+func (app *App) VerifyAuditEvents(c *fiber.Ctx) error {
+	report, err := app.audit.store.VerifyAuditChain(c.UserContext())
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot verify audit events")
+	}
+
+	return c.JSON(report)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sangketkit01/7-coding-test/internal/db"
+)
+
+// What happens to the email of a deleted user until it is purged.
+const (
+	deletedEmailReserve = "reserve"
+	deletedEmailRelease = "release"
+)
+
+func checkDeletedEmailPolicy(policy string) error {
+	switch policy {
+	case deletedEmailReserve, deletedEmailRelease:
+		return nil
+	default:
+		return fmt.Errorf("unknown deleted email policy: %s", policy)
+	}
+}
+
+type DeletedUserResponse struct {
+	UserProfile
+	DeletedAt time.Time `json:"deleted_at"`
+	// PurgeAt is left out when deleted users are kept forever.
+	PurgeAt *time.Time `json:"purge_at,omitempty"`
+}
+
+func (app *App) newDeletedUserResponse(user *db.User) DeletedUserResponse {
+	response := DeletedUserResponse{
+		UserProfile: newUserProfile(user),
+		DeletedAt:   *user.DeletedAt,
+	}
+
+	// show the address the user had, not the placeholder
+	if user.DeletedEmail != "" {
+		response.Email = user.DeletedEmail
+	}
+
+	if app.config.DeletedUserRetention > 0 {
+		purgeAt := user.DeletedAt.Add(app.config.DeletedUserRetention)
+		response.PurgeAt = &purgeAt
+	}
+
+	return response
+}
+
+func (app *App) ListDeletedUsers(c *fiber.Ctx) error {
+	users, err := app.model.ListDeletedUsers(c.UserContext())
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, err.Error())
+	}
+
+	response := make([]DeletedUserResponse, 0, len(users))
+	for _, user := range users {
+		response = append(response, app.newDeletedUserResponse(user))
+	}
+
+	return c.JSON(fiber.Map{"users": response})
+}
+
+// RestoreUser takes a user out of the trash. Its sessions were revoked on
+// deletion, the user has to log in again.
+func (app *App) RestoreUser(c *fiber.Ctx) error {
+	userId := c.Params("id", "")
+	if userId == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "user id is not provided.")
+	}
+
+	user, err := app.model.RestoreUser(c.UserContext(), userId)
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrDeletedUserNotFound):
+			return storeError(err, fiber.StatusNotFound, err.Error())
+		case errors.Is(err, db.ErrEmailTaken):
+			return fiber.NewError(fiber.StatusConflict, "the user's email was taken by another account after the deletion")
+		default:
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+	}
+
+	event := newAuditEvent(c, db.AuditUserRestore, user.ID)
+	event.Changes = db.DiffUsers(nil, user)
+	app.audit.Record(event)
+
+	return c.JSON(fiber.Map{"message": "Restore user successfully.", "user": newUserProfile(user)})
+}
+
+// PurgeDeletedUsers removes deleted users for good once their retention
+// has run out.
+func (app *App) PurgeDeletedUsers() {
+	for {
+		app.purgeDeletedUsers()
+		time.Sleep(app.config.DeletedUserPurgeInterval)
+	}
+}
+
+func (app *App) purgeDeletedUsers() {
+	users, err := app.model.PurgeDeletedUsers(context.Background(), time.Now().Add(-app.config.DeletedUserRetention))
+
+	// users purged before an error are still recorded
+	for _, user := range users {
+		app.audit.Record(db.AuditEvent{
+			Action:   db.AuditUserPurge,
+			TargetID: user.ID,
+			Metadata: map[string]string{"deleted_at": user.DeletedAt.Format(time.RFC3339)},
+		})
+	}
+
+	if err != nil {
+		log.Println("failed to purge deleted users:", err)
+	}
+}
@@ -8,38 +8,61 @@ import (
 	"net"
 	"strings"
 
+	"github.com/gofiber/fiber/v2"
 	"github.com/sangketkit01/7-coding-test/internal/db"
-	"github.com/sangketkit01/7-coding-test/internal/util"
+	"github.com/sangketkit01/7-coding-test/internal/policy"
+	"github.com/sangketkit01/7-coding-test/internal/token"
 	"github.com/sangketkit01/7-coding-test/pb"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type GRPCService struct {
 	pb.UnimplementedSevenCodingTestServer
-	model db.MongoClient
+	model          db.MongoClient
+	tokens         *tokenIssuer
+	verifier       *emailVerifier
+	passwordPolicy *policy.PasswordPolicy
+	passwords      *passwordChanger
+	audit          *auditLogger
+	introspector   *tokenIntrospector
+	profiles       *profileLoader
 }
 
 func (service *GRPCService) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
 
-	if strings.TrimSpace(req.GetName()) == "" || strings.TrimSpace(req.GetEmail()) == "" || len(strings.TrimSpace(req.GetPassword())) < 8 {
-		return nil, errors.New("Name and Email is required and password's length must be atleast 8 characters long.")
+	if strings.TrimSpace(req.GetName()) == "" || strings.TrimSpace(req.GetEmail()) == "" {
+		return nil, status.Error(codes.InvalidArgument, "name and email are required")
 	}
 
-	hashedPassword, err := util.HashPassword(req.GetPassword())
-	if err != nil {
-		return nil, errors.New("failed to hash password.")
+	if err := service.passwordPolicy.Validate(req.GetPassword()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	// Insert hashes the password.
 	newUser := db.User{
 		Name:     req.GetName(),
 		Email:    req.GetEmail(),
-		Password: hashedPassword,
+		Password: req.GetPassword(),
 	}
 
-	err = service.model.Insert(newUser)
+	user, err := service.model.Insert(ctx, newUser)
 	if err != nil {
-		return nil, err
+		if errors.Is(err, db.ErrEmailTaken) {
+			return nil, status.Error(codes.AlreadyExists, err.Error())
+		}
+
+		return nil, grpcStoreError(err, codes.Internal, "failed to create user.")
+	}
+
+	event := newGRPCAuditEvent(ctx, db.AuditUserCreate, user.ID)
+	event.Changes = db.DiffUsers(nil, user)
+	service.audit.Record(event)
+
+	if err := service.verifier.SendVerification(ctx, user); err != nil {
+		log.Printf("failed to send verification email: %v\n", err)
 	}
 
 	response := &pb.CreateUserResponse{
@@ -54,13 +77,30 @@ func (service *GRPCService) CreateUser(ctx context.Context, req *pb.CreateUserRe
 }
 
 func (service *GRPCService) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUserResponse, error) {
+	payload, ok := payloadFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "invalid payload")
+	}
+
 	if strings.TrimSpace(req.GetXId()) == "" {
-		return nil, errors.New("id is not provided.")
+		return nil, status.Error(codes.InvalidArgument, "id is not provided.")
 	}
 
-	user, err := service.model.FetchUserByID(req.GetXId())
+	if req.GetXId() != payload.ID.Hex() && !payload.HasRole(db.RoleAdmin) && !db.IsOrgAdminRole(payload.OrgRole) {
+		return nil, status.Error(codes.PermissionDenied, "you are not allowed to read this user")
+	}
+
+	user, err := service.model.FetchUserByID(ctx, req.GetXId())
 	if err != nil {
-		return nil, err
+		if errors.Is(err, db.ErrUserNotFound) {
+			return nil, status.Error(codes.NotFound, err.Error())
+		}
+
+		return nil, grpcStoreError(err, codes.Internal, "failed to get user.")
+	}
+
+	if !canReadUser(payload, user) {
+		return nil, status.Error(codes.PermissionDenied, "you are not allowed to read this user")
 	}
 
 	response := &pb.GetUserResponse{
@@ -68,7 +108,6 @@ func (service *GRPCService) GetUser(ctx context.Context, req *pb.GetUserRequest)
 			XId:       user.ID.Hex(),
 			Name:      user.Name,
 			Email:     user.Email,
-			Password:  user.Password,
 			CreatedAt: timestamppb.New(user.CreatedAt),
 		},
 	}
@@ -76,15 +115,313 @@ func (service *GRPCService) GetUser(ctx context.Context, req *pb.GetUserRequest)
 	return response, nil
 }
 
+func (service *GRPCService) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	payload, ok := payloadFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "invalid payload")
+	}
+
+	if !payload.HasRole(db.RoleAdmin) {
+		return nil, status.Error(codes.PermissionDenied, "you do not have permission to access this resource")
+	}
+
+	sortBy, descending, err := userListOrder(req.GetSortBy(), req.GetOrder())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	filter := db.UserFilter{
+		NamePrefix:  req.GetNamePrefix(),
+		EmailPrefix: req.GetEmailPrefix(),
+		// an admin working in an organization only sees its members
+		OrgID:      payload.OrgID,
+		SortBy:     sortBy,
+		Descending: descending,
+		Limit:      userPageSize(int(req.GetPageSize())),
+		PageToken:  req.GetPageToken(),
+	}
+
+	if req.CreatedFrom != nil {
+		filter.From = req.GetCreatedFrom().AsTime()
+	}
+
+	if req.CreatedTo != nil {
+		filter.To = req.GetCreatedTo().AsTime()
+	}
+
+	page, err := service.model.ListUsers(ctx, filter)
+	if err != nil {
+		if errors.Is(err, db.ErrInvalidPageToken) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		return nil, grpcStoreError(err, codes.Internal, "cannot list users")
+	}
+
+	response := &pb.ListUsersResponse{NextPageToken: page.NextPageToken}
+	for _, user := range page.Users {
+		response.Users = append(response.Users, &pb.User{
+			XId:       user.ID.Hex(),
+			Name:      user.Name,
+			Email:     user.Email,
+			CreatedAt: timestamppb.New(user.CreatedAt),
+		})
+	}
+
+	return response, nil
+}
+
+func (service *GRPCService) SearchUsers(ctx context.Context, req *pb.SearchUsersRequest) (*pb.SearchUsersResponse, error) {
+	payload, ok := payloadFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "invalid payload")
+	}
+
+	if !payload.HasRole(db.RoleAdmin) {
+		return nil, status.Error(codes.PermissionDenied, "you do not have permission to access this resource")
+	}
+
+	query := strings.TrimSpace(req.GetQuery())
+	if query == "" {
+		return nil, status.Error(codes.InvalidArgument, "query is not provided.")
+	}
+
+	page, err := service.model.SearchUsers(ctx, db.UserSearch{
+		Query: query,
+		// an admin working in an organization only finds its members
+		OrgID:     payload.OrgID,
+		Limit:     userPageSize(int(req.GetPageSize())),
+		PageToken: req.GetPageToken(),
+	})
+	if err != nil {
+		if errors.Is(err, db.ErrInvalidPageToken) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		return nil, grpcStoreError(err, codes.Internal, "cannot search users")
+	}
+
+	response := &pb.SearchUsersResponse{NextPageToken: page.NextPageToken}
+	for _, user := range page.Users {
+		response.Users = append(response.Users, newPBUserProfile(newUserProfile(user)))
+	}
+
+	return response, nil
+}
+
+func (service *GRPCService) RefreshToken(ctx context.Context, req *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error) {
+	if strings.TrimSpace(req.GetRefreshToken()) == "" {
+		return nil, status.Error(codes.InvalidArgument, "refresh token is not provided.")
+	}
+
+	ip, userAgent := grpcClientInfo(ctx)
+
+	pair, err := service.tokens.RotateRefreshToken(ctx, req.GetRefreshToken(), userAgent, ip)
+	if err != nil {
+		if errors.Is(err, errInvalidRefreshToken) || errors.Is(err, errRefreshTokenReused) {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+
+		return nil, grpcStoreError(err, codes.Internal, "failed to refresh token.")
+	}
+
+	response := &pb.RefreshTokenResponse{
+		AccessToken:           pair.AccessToken,
+		RefreshToken:          pair.RefreshToken,
+		SessionId:             pair.SessionID,
+		AccessTokenExpiredAt:  timestamppb.New(pair.AccessTokenExpiredAt),
+		RefreshTokenExpiredAt: timestamppb.New(pair.RefreshTokenExpiredAt),
+	}
+
+	return response, nil
+}
+
+func (service *GRPCService) ChangePassword(ctx context.Context, req *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+	payload, ok := payloadFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "invalid payload")
+	}
+
+	if req.GetCurrentPassword() == "" || req.GetNewPassword() == "" {
+		return nil, status.Error(codes.InvalidArgument, "current and new password are required")
+	}
+
+	revoked, err := service.passwords.Change(ctx, payload.ID, payload.SessionID.String(), req.GetCurrentPassword(), req.GetNewPassword())
+	if err != nil {
+		if isPasswordChangeRejected(err) {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		log.Printf("change password failed: %v\n", err)
+		return nil, grpcStoreError(err, codes.Internal, "cannot change password")
+	}
+
+	service.audit.Record(newGRPCAuditEvent(ctx, db.AuditPasswordChange, payload.ID))
+
+	return &pb.ChangePasswordResponse{RevokedSessions: revoked}, nil
+}
+
+// Introspect is for other services, so it only takes API keys with the
+// tokens:introspect scope.
+func (service *GRPCService) Introspect(ctx context.Context, req *pb.IntrospectRequest) (*pb.IntrospectResponse, error) {
+	payload, ok := payloadFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "invalid payload")
+	}
+
+	if payload.TokenType != token.TokenTypeAPIKey {
+		return nil, status.Error(codes.PermissionDenied, "this method can only be used with an api key")
+	}
+
+	if strings.TrimSpace(req.GetToken()) == "" {
+		return nil, status.Error(codes.InvalidArgument, "token is not provided.")
+	}
+
+	response, err := service.introspector.Introspect(ctx, req.GetToken(), req.GetTokenTypeHint())
+	if err != nil {
+		log.Printf("introspection failed: %v\n", err)
+		return nil, grpcStoreError(err, codes.Internal, "cannot introspect token")
+	}
+
+	return &pb.IntrospectResponse{
+		Active:    response.Active,
+		Scope:     response.Scope,
+		Username:  response.Username,
+		TokenType: response.TokenType,
+		Exp:       response.Exp,
+		Iat:       response.Iat,
+		Sub:       response.Sub,
+		SessionId: response.SessionID,
+		Roles:     response.Roles,
+		ApiKeyId:  response.APIKeyID,
+		ActorId:   response.ActorID,
+		OrgId:     response.OrgID,
+		OrgRole:   response.OrgRole,
+	}, nil
+}
+
+func newPBUserProfile(profile UserProfile) *pb.UserProfile {
+	user := &pb.UserProfile{
+		XId:            profile.ID.Hex(),
+		Name:           profile.Name,
+		Email:          profile.Email,
+		Roles:          profile.Roles,
+		EmailVerified:  profile.EmailVerified,
+		TotpEnabled:    profile.TOTPEnabled,
+		ServiceAccount: profile.ServiceAccount,
+		CreatedAt:      timestamppb.New(profile.CreatedAt),
+	}
+
+	if profile.TenantID != nil {
+		user.TenantId = profile.TenantID.Hex()
+	}
+
+	for _, membership := range profile.Memberships {
+		user.Memberships = append(user.Memberships, &pb.Membership{
+			OrgId:    membership.OrgID.Hex(),
+			Role:     membership.Role,
+			JoinedAt: timestamppb.New(membership.JoinedAt),
+		})
+	}
+
+	return user
+}
+
+func (service *GRPCService) GetMe(ctx context.Context, req *pb.GetMeRequest) (*pb.GetMeResponse, error) {
+	payload, ok := payloadFromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "invalid payload")
+	}
+
+	me, err := service.profiles.Me(ctx, payload)
+	if err != nil {
+		log.Printf("cannot load profile: %v\n", err)
+		return nil, grpcStoreError(err, codes.Internal, "cannot load profile")
+	}
+
+	response := &pb.GetMeResponse{
+		User: newPBUserProfile(me.User),
+	}
+
+	if me.ImpersonatedBy != nil {
+		response.ImpersonatedBy = me.ImpersonatedBy.Hex()
+	}
+
+	if me.OrgID != nil {
+		response.OrgId = me.OrgID.Hex()
+		response.OrgRole = me.OrgRole
+	}
+
+	if me.Session != nil {
+		response.Session = &pb.Session{
+			Id:        me.Session.ID,
+			UserAgent: me.Session.UserAgent,
+			ClientIp:  me.Session.ClientIP,
+			CreatedAt: timestamppb.New(me.Session.CreatedAt),
+			ExpiresAt: timestamppb.New(me.Session.ExpiresAt),
+		}
+	}
+
+	if me.APIKey != nil {
+		response.ApiKey = &pb.ApiKey{
+			Id:        me.APIKey.ID.Hex(),
+			Name:      me.APIKey.Name,
+			Prefix:    me.APIKey.Prefix,
+			Scopes:    me.APIKey.Scopes,
+			CreatedAt: timestamppb.New(me.APIKey.CreatedAt),
+			ExpiresAt: timestamppb.New(me.APIKey.ExpiresAt),
+		}
+	}
+
+	return response, nil
+}
+
+// grpcToFiberError keeps the meaning of a gRPC status when a handler proxies
+// a call to the gRPC service.
+func grpcToFiberError(err error) error {
+	st := status.Convert(err)
+
+	switch st.Code() {
+	case codes.Unauthenticated:
+		return fiber.NewError(fiber.StatusUnauthorized, st.Message())
+	case codes.PermissionDenied:
+		return fiber.NewError(fiber.StatusForbidden, st.Message())
+	case codes.InvalidArgument:
+		return fiber.NewError(fiber.StatusBadRequest, st.Message())
+	case codes.NotFound:
+		return fiber.NewError(fiber.StatusNotFound, st.Message())
+	case codes.AlreadyExists:
+		return fiber.NewError(fiber.StatusConflict, st.Message())
+	case codes.DeadlineExceeded:
+		return fiber.NewError(fiber.StatusGatewayTimeout, st.Message())
+	case codes.ResourceExhausted:
+		return fiber.NewError(fiber.StatusTooManyRequests, st.Message())
+	default:
+		return fiber.NewError(fiber.StatusInternalServerError, st.Message())
+	}
+}
+
 func (app *App) gRPCListen() {
 	listen, err := net.Listen("tcp", fmt.Sprintf(":%s", gRpcPort))
 	if err != nil {
 		log.Fatalln("Failed to listen grpc:", err)
 	}
 
-	server := grpc.NewServer()
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(app.UnaryTimeoutInterceptor, app.UnaryAuthInterceptor, app.UnaryImpersonationInterceptor, app.UnaryRateLimitInterceptor),
+		grpc.ChainStreamInterceptor(app.StreamTimeoutInterceptor, app.StreamAuthInterceptor, app.StreamImpersonationInterceptor, app.StreamRateLimitInterceptor),
+	)
 
-	pb.RegisterSevenCodingTestServer(server, &GRPCService{model: app.model})
+	pb.RegisterSevenCodingTestServer(server, &GRPCService{
+		model:          app.model,
+		tokens:         app.tokens,
+		verifier:       app.verifier,
+		passwordPolicy: app.passwordPolicy,
+		passwords:      app.passwords,
+		audit:          app.audit,
+		introspector:   app.introspector,
+		profiles:       app.profiles,
+	})
 
 	log.Printf("gRPC server started at port: %s\n", gRpcPort)
 
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"github.com/sangketkit01/7-coding-test/internal/db"
+	"github.com/sangketkit01/7-coding-test/internal/token"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type contextKey string
+
+const payloadContextKey contextKey = "payload"
+
+// publicMethods can be called without a bearer token.
+var publicMethods = map[string]bool{
+	"/pb.SevenCodingTest/CreateUser":   true,
+	"/pb.SevenCodingTest/RefreshToken": true,
+}
+
+// methodScopes is the scope an API key needs for each authenticated
+// method. API keys cannot call methods that are not listed.
+var methodScopes = map[string]string{
+	"/pb.SevenCodingTest/GetUser":     db.ScopeUsersRead,
+	"/pb.SevenCodingTest/ListUsers":   db.ScopeAdmin,
+	"/pb.SevenCodingTest/SearchUsers": db.ScopeAdmin,
+	"/pb.SevenCodingTest/GetMe":       db.ScopeUsersRead,
+	"/pb.SevenCodingTest/Introspect":  db.ScopeIntrospect,
+}
+
+func payloadFromContext(ctx context.Context) (*token.Payload, bool) {
+	payload, ok := ctx.Value(payloadContextKey).(*token.Payload)
+	return payload, ok
+}
+
+// authenticateContext verifies the bearer token or API key of the
+// "authorization" metadata and returns a context carrying its payload.
+func (app *App) authenticateContext(ctx context.Context, method string) (context.Context, error) {
+	var authorization string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(authorizationHeader); len(values) > 0 {
+			authorization = values[0]
+		}
+	}
+
+	payload, err := app.authenticate(ctx, authorization)
+	if err != nil {
+		if isUnauthenticated(err) {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+
+		log.Println("cannot verify session:", err)
+		return nil, grpcStoreError(err, codes.Internal, "cannot verify session")
+	}
+
+	if payload.TokenType == token.TokenTypeAPIKey {
+		scope, ok := methodScopes[method]
+		if !ok || !payload.HasScope(scope) {
+			return nil, status.Error(codes.PermissionDenied, "api key is not allowed to call this method")
+		}
+	}
+
+	return context.WithValue(ctx, payloadContextKey, payload), nil
+}
+
+func (app *App) UnaryAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if publicMethods[info.FullMethod] {
+		return handler(ctx, req)
+	}
+
+	ctx, err := app.authenticateContext(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (app *App) StreamAuthInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if publicMethods[info.FullMethod] {
+		return handler(srv, stream)
+	}
+
+	ctx, err := app.authenticateContext(stream.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+}
+
+// authenticatedStream overrides the context of a stream with one carrying
+// the token payload.
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-playground/validator/v10"
@@ -10,14 +14,16 @@ import (
 	"github.com/sangketkit01/7-coding-test/internal/db"
 	"github.com/sangketkit01/7-coding-test/internal/token"
 	"github.com/sangketkit01/7-coding-test/pb"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 )
 
 type CreateUserRequest struct {
 	Name     string `json:"name" validate:"required"`
 	Email    string `json:"email" validate:"required,email"`
-	Password string `json:"password" validate:"required,min=8,alphanum"`
+	Password string `json:"password" validate:"required"`
 }
 
 func (app *App) CreateUser(c *fiber.Ctx) error {
@@ -31,14 +37,26 @@ func (app *App) CreateUser(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, err.Error())
 	}
 
-	err := app.model.Insert(db.User{
+	if err := app.passwordPolicy.Validate(req.Password); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	user, err := app.model.Insert(c.UserContext(), db.User{
 		Name:     req.Name,
 		Email:    req.Email,
 		Password: req.Password,
 	})
 
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		return storeError(err, fiber.StatusInternalServerError, err.Error())
+	}
+
+	event := newAuditEvent(c, db.AuditUserCreate, user.ID)
+	event.Changes = db.DiffUsers(nil, user)
+	app.audit.Record(event)
+
+	if err := app.verifier.SendVerification(c.UserContext(), user); err != nil {
+		log.Printf("failed to send verification email: %v\n", err)
 	}
 
 	return c.JSON(fiber.Map{"message": "create user successfully."})
@@ -46,14 +64,27 @@ func (app *App) CreateUser(c *fiber.Ctx) error {
 
 type LoginUserRequest struct {
 	Email    string `json:"email" validate:"required,email"`
-	Password string `json:"password" validate:"required,min=8,alphanum"`
+	Password string `json:"password" validate:"required"`
+	// Org is the slug of the organization to sign in to. It picks the
+	// organization's own account when emails are unique per tenant.
+	Org string `json:"org"`
 }
 
 type LoginUserResponse struct {
-	Token     string    `json:"token"`
-	Email     string    `json:"email"`
-	IssuedAt  time.Time `json:"issued_at"`
-	ExpiredAt time.Time `json:"expired_at"`
+	Token                 string    `json:"token"`
+	RefreshToken          string    `json:"refresh_token"`
+	Email                 string    `json:"email"`
+	IssuedAt              time.Time `json:"issued_at"`
+	ExpiredAt             time.Time `json:"expired_at"`
+	RefreshTokenExpiredAt time.Time `json:"refresh_token_expired_at"`
+}
+
+// MFARequiredResponse is returned by LoginUser instead of a token pair when
+// the user has two-factor authentication enabled.
+type MFARequiredResponse struct {
+	MFARequired bool      `json:"mfa_required"`
+	MFAToken    string    `json:"mfa_token"`
+	ExpiredAt   time.Time `json:"expired_at"`
 }
 
 func (app *App) LoginUser(c *fiber.Ctx) error {
@@ -67,35 +98,187 @@ func (app *App) LoginUser(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, err.Error())
 	}
 
-	user := db.User{
+	tenantID, err := app.tenantBySlug(c.UserContext(), req.Org)
+	if err != nil {
+		if errors.Is(err, db.ErrOrganizationNotFound) {
+			return fiber.NewError(fiber.StatusUnauthorized, fmt.Sprintf("invalid credentials: %v", err))
+		}
+
+		return storeError(err, fiber.StatusInternalServerError, "cannot log in")
+	}
+
+	if err := app.checkLoginGuard(c, tenantID, req.Email); err != nil {
+		return err
+	}
+
+	credentials := db.User{
 		Email:    req.Email,
 		Password: req.Password,
+		TenantID: tenantID,
 	}
 
-	loggedInUser, err := user.LoginUser()
+	loggedInUser, err := app.model.LoginUser(c.UserContext(), credentials)
 	if err != nil {
+		if errors.Is(err, db.ErrInvalidCredentials) {
+			if err := app.loginGuard.RecordFailure(c.UserContext(), tenantID, req.Email, c.IP()); err != nil {
+				log.Printf("failed to record login failure: %v\n", err)
+			}
+
+			app.recordLoginFailure(c, req.Email, "invalid credentials")
+		}
+
 		return fiber.NewError(fiber.StatusUnauthorized, fmt.Sprintf("invalid credentials: %v", err))
 	}
 
-	token, payload, err := app.jwtMaker.CreateToken(loggedInUser.ID, time.Hour*24*7)
+	return app.completeLogin(c, loggedInUser, tenantID, "password")
+}
+
+// completeLogin finishes a login once the user has proven who they are,
+// with a password or through an external provider. Users with two-factor
+// authentication get an mfa pending token instead of a token pair. orgID
+// is the organization the session starts in, nil for the user's first one.
+// method names how the user signed in, for the audit log.
+func (app *App) completeLogin(c *fiber.Ctx, user *db.User, orgID *primitive.ObjectID, method string) error {
+	if app.config.RequireEmailVerification && !user.EmailVerified {
+		return fiber.NewError(fiber.StatusForbidden, "email is not verified")
+	}
+
+	if orgID != nil && user.Membership(*orgID) == nil {
+		return fiber.NewError(fiber.StatusForbidden, db.ErrNotMember.Error())
+	}
+
+	if user.TOTPEnabled {
+		opts := []token.PayloadOption{token.WithTokenType(token.TokenTypeMFAPending)}
+		if orgID != nil {
+			opts = append(opts, token.WithOrg(*orgID, ""))
+		}
+
+		mfaToken, mfaPayload, err := app.jwtMaker.CreateToken(user.ID, app.config.MFAPendingTokenDuration, opts...)
+		if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		}
+
+		return c.JSON(MFARequiredResponse{
+			MFARequired: true,
+			MFAToken:    mfaToken,
+			ExpiredAt:   mfaPayload.ExpiredAt,
+		})
+	}
+
+	if err := app.loginGuard.RecordSuccess(c.UserContext(), orgID, user.Email); err != nil {
+		log.Printf("failed to reset login failures: %v\n", err)
+	}
+
+	app.recordLogin(c, user, method)
+
+	pair, err := app.tokens.IssueTokenPair(c.UserContext(), user, orgID, c.Get(fiber.HeaderUserAgent), c.IP())
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		return storeError(err, fiber.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(newLoginUserResponse(pair, user.Email))
+}
+
+func newLoginUserResponse(pair *TokenPair, email string) LoginUserResponse {
+	return LoginUserResponse{
+		Token:                 pair.AccessToken,
+		RefreshToken:          pair.RefreshToken,
+		Email:                 email,
+		IssuedAt:              pair.IssuedAt,
+		ExpiredAt:             pair.AccessTokenExpiredAt,
+		RefreshTokenExpiredAt: pair.RefreshTokenExpiredAt,
 	}
+}
 
-	response := LoginUserResponse{
-		Token:     token,
-		Email:     loggedInUser.Email,
-		IssuedAt:  payload.IssuedAt,
-		ExpiredAt: payload.ExpiredAt,
+// checkLoginGuard turns a refused login attempt into the matching HTTP
+// error with a Retry-After header. tenantID is the organization the login
+// is made against, nil for none.
+func (app *App) checkLoginGuard(c *fiber.Ctx, tenantID *primitive.ObjectID, email string) error {
+	err := app.loginGuard.Check(c.UserContext(), tenantID, email, c.IP())
+	if err == nil {
+		return nil
 	}
 
-	return c.JSON(response)
+	var throttled *loginThrottledError
+	if errors.As(err, &throttled) {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(throttled.retryAfter.Seconds()))))
+		if throttled.locked {
+			return fiber.NewError(fiber.StatusLocked, throttled.Error())
+		}
+
+		return fiber.NewError(fiber.StatusTooManyRequests, throttled.Error())
+	}
+
+	log.Printf("login guard failed: %v\n", err)
+	return storeError(err, fiber.StatusInternalServerError, "cannot log in")
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
+}
+
+func (app *App) RefreshToken(c *fiber.Ctx) error {
+	var req RefreshTokenRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid refresh token request")
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	pair, err := app.tokens.RotateRefreshToken(c.UserContext(), req.RefreshToken, c.Get(fiber.HeaderUserAgent), c.IP())
+	if err != nil {
+		if errors.Is(err, errInvalidRefreshToken) || errors.Is(err, errRefreshTokenReused) {
+			return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+		}
+
+		log.Printf("refresh token failed: %v\n", err)
+		return storeError(err, fiber.StatusInternalServerError, "cannot refresh token")
+	}
+
+	return c.JSON(pair)
+}
+
+func (app *App) Logout(c *fiber.Ctx) error {
+	p := c.Locals(payloadHeader)
+
+	payload, ok := p.(*token.Payload)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
+	}
+
+	if err := app.sessions.RevokeSession(c.UserContext(), payload.SessionID.String()); err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot revoke session")
+	}
+
+	return c.JSON(fiber.Map{"message": "Logout successfully."})
+}
+
+func (app *App) LogoutAll(c *fiber.Ctx) error {
+	p := c.Locals(payloadHeader)
+
+	payload, ok := p.(*token.Payload)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
+	}
+
+	revoked, err := app.sessions.RevokeUserSessions(c.UserContext(), payload.ID)
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot revoke sessions")
+	}
+
+	return c.JSON(fiber.Map{
+		"message":          "Logout from every session successfully.",
+		"revoked_sessions": revoked,
+	})
 }
 
 func (app *App) FetchUserById(c *fiber.Ctx) error {
 	p := c.Locals(payloadHeader)
 
-	_, ok := p.(*token.Payload)
+	payload, ok := p.(*token.Payload)
 	if !ok {
 		return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
 	}
@@ -105,28 +288,147 @@ func (app *App) FetchUserById(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, "user id is not provided.")
 	}
 
-	user, err := app.model.FetchUserByID(userId)
+	if userId != payload.ID.Hex() && !payload.HasRole(db.RoleAdmin) && !db.IsOrgAdminRole(payload.OrgRole) {
+		return fiber.NewError(fiber.StatusForbidden, "you are not allowed to read this user")
+	}
+
+	user, err := app.model.FetchUserByID(c.UserContext(), userId)
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		return storeError(err, fiber.StatusInternalServerError, err.Error())
 	}
 
-	return c.JSON(fiber.Map{"user": user})
+	if !canReadUser(payload, user) {
+		return fiber.NewError(fiber.StatusForbidden, "you are not allowed to read this user")
+	}
+
+	return c.JSON(fiber.Map{"user": newUserProfile(user)})
 }
 
+const (
+	defaultUserPageSize = 50
+	maxUserPageSize     = 100
+)
+
+var errInvalidUserOrder = errors.New("sort must be created_at or name and order asc or desc")
+
+// userListOrder checks the order of a user listing, by default the oldest
+// users come first.
+func userListOrder(sortBy, order string) (string, bool, error) {
+	if sortBy == "" {
+		sortBy = db.UserSortCreatedAt
+	}
+
+	if !db.IsValidUserSort(sortBy) || (order != "" && order != "asc" && order != "desc") {
+		return "", false, errInvalidUserOrder
+	}
+
+	return sortBy, order == "desc", nil
+}
+
+// userPageSize applies the default and the cap of a user listing.
+func userPageSize(size int) int64 {
+	if size < 1 {
+		return defaultUserPageSize
+	}
+
+	if size > maxUserPageSize {
+		return maxUserPageSize
+	}
+
+	return int64(size)
+}
+
+// ListAllUsers returns a page of users, next_page_token fetches the next
+// one with the same query.
 func (app *App) ListAllUsers(c *fiber.Ctx) error {
 	p := c.Locals(payloadHeader)
 
-	_, ok := p.(*token.Payload)
+	payload, ok := p.(*token.Payload)
 	if !ok {
 		return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
 	}
 
-	users, err := app.model.ListAllUsers()
+	sortBy, descending, err := userListOrder(c.Query("sort"), c.Query("order"))
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
 	}
 
-	return c.JSON(fiber.Map{"users": users})
+	filter := db.UserFilter{
+		NamePrefix:  c.Query("name_prefix"),
+		EmailPrefix: c.Query("email_prefix"),
+		// an admin working in an organization only sees its members
+		OrgID:      payload.OrgID,
+		SortBy:     sortBy,
+		Descending: descending,
+		Limit:      userPageSize(c.QueryInt("page_size", defaultUserPageSize)),
+		PageToken:  c.Query("page_token"),
+	}
+
+	if from := c.Query("created_from"); from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "created_from must be an RFC 3339 time")
+		}
+	}
+
+	if to := c.Query("created_to"); to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, "created_to must be an RFC 3339 time")
+		}
+	}
+
+	page, err := app.model.ListUsers(c.UserContext(), filter)
+	if err != nil {
+		if errors.Is(err, db.ErrInvalidPageToken) {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		return storeError(err, fiber.StatusInternalServerError, "cannot list users")
+	}
+
+	users := make([]UserProfile, 0, len(page.Users))
+	for _, user := range page.Users {
+		users = append(users, newUserProfile(user))
+	}
+
+	return c.JSON(fiber.Map{"users": users, "next_page_token": page.NextPageToken})
+}
+
+// SearchUsers finds users by part of their name or email, the best
+// matches first.
+func (app *App) SearchUsers(c *fiber.Ctx) error {
+	p := c.Locals(payloadHeader)
+
+	payload, ok := p.(*token.Payload)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
+	}
+
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "q is required")
+	}
+
+	page, err := app.model.SearchUsers(c.UserContext(), db.UserSearch{
+		Query: q,
+		// an admin working in an organization only finds its members
+		OrgID:     payload.OrgID,
+		Limit:     userPageSize(c.QueryInt("page_size", defaultUserPageSize)),
+		PageToken: c.Query("page_token"),
+	})
+	if err != nil {
+		if errors.Is(err, db.ErrInvalidPageToken) {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		return storeError(err, fiber.StatusInternalServerError, "cannot search users")
+	}
+
+	users := make([]UserProfile, 0, len(page.Users))
+	for _, user := range page.Users {
+		users = append(users, newUserProfile(user))
+	}
+
+	return c.JSON(fiber.Map{"users": users, "next_page_token": page.NextPageToken})
 }
 
 type UpdateUserRequest struct {
@@ -134,9 +436,8 @@ type UpdateUserRequest struct {
 	Name  string `json:"name" validate:"omitempty"`
 }
 
-
 type UpdateUserResponse struct {
-	NewToken  string    `json:"new_token"`
+	NewToken  string    `json:"new_token,omitempty"`
 	Email     string    `json:"email"`
 	Name      string    `json:"name"`
 	IssuedAt  time.Time `json:"issued_at"`
@@ -161,52 +462,73 @@ func (app *App) UpdateUser(c *fiber.Ctx) error {
 		return fiber.NewError(fiber.StatusBadRequest, err.Error())
 	}
 
-	
-	user, err := app.model.FetchUserByID(payload.ID.Hex())
+	user, err := app.model.FetchUserByID(c.UserContext(), payload.ID.Hex())
 	if err != nil {
-		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+		return storeError(err, fiber.StatusInternalServerError, err.Error())
 	}
-	
+
 	if user.ID != payload.ID {
 		fmt.Println(user.Email, req.Email)
 		return fiber.NewError(fiber.StatusForbidden, "you are not allowed to update this user")
 	}
 
+	emailChanged := req.Email != "" && req.Email != user.Email
+	before := *user
+
 	user.Email = req.Email
 	user.Name = req.Name
 
-	err = user.UpdateUser()
+	err = app.model.UpdateUser(c.UserContext(), *user)
 	if err != nil {
 		log.Printf("updated user failed: %v\n", err)
-		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
-	}
+		if errors.Is(err, db.ErrEmailTaken) {
+			return fiber.NewError(fiber.StatusConflict, err.Error())
+		}
 
-	newToken, newPayload, err := app.jwtMaker.CreateToken(user.ID, time.Hour * 24 * 7)
-	if err != nil{
-		log.Printf("create token failed: %v\n", err)
-		return fiber.NewError(fiber.StatusInternalServerError, "cannot create new token")
+		return storeError(err, fiber.StatusInternalServerError, err.Error())
 	}
 
-	newUser, err := app.model.FetchUserByID(newPayload.ID.Hex())
-	if err != nil{
+	newUser, err := app.model.FetchUserByID(c.UserContext(), user.ID.Hex())
+	if err != nil {
 		log.Println("failed to fetch user's data:", err)
-		return fiber.NewError(fiber.StatusInternalServerError, "cannot fetch user data")
+		return storeError(err, fiber.StatusInternalServerError, "cannot fetch user data")
 	}
 
-	c.Locals("payload", newPayload)
+	event := newAuditEvent(c, db.AuditUserUpdate, user.ID)
+	event.Changes = db.DiffUsers(&before, newUser)
+	app.audit.Record(event)
+
+	if emailChanged {
+		if err := app.verifier.SendVerification(c.UserContext(), newUser); err != nil {
+			log.Printf("failed to send verification email: %v\n", err)
+		}
+	}
 
 	response := UpdateUserResponse{
-		NewToken: newToken,
 		Email: newUser.Email,
-		Name: newUser.Name,
-		IssuedAt: newPayload.IssuedAt,
-		ExpiredAt: newPayload.ExpiredAt,
+		Name:  newUser.Name,
+	}
+
+	// API keys have no session to mint a new token for.
+	if payload.TokenType == token.TokenTypeAccess {
+		newToken, newPayload, err := app.tokens.ReissueAccessToken(
+			user, payload.SessionID, payload.OrgID, payload.OrgRole, c.Get(fiber.HeaderUserAgent), c.IP())
+		if err != nil {
+			log.Printf("create token failed: %v\n", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "cannot create new token")
+		}
+
+		c.Locals("payload", newPayload)
+
+		response.NewToken = newToken
+		response.IssuedAt = newPayload.IssuedAt
+		response.ExpiredAt = newPayload.ExpiredAt
 	}
 
 	return c.JSON(response)
 }
 
-func (app *App) DeleteUser(c *fiber.Ctx) error{
+func (app *App) DeleteUser(c *fiber.Ctx) error {
 	p := c.Locals(payloadHeader)
 
 	payload, ok := p.(*token.Payload)
@@ -214,21 +536,29 @@ func (app *App) DeleteUser(c *fiber.Ctx) error{
 		return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
 	}
 
-	user, err := app.model.FetchUserByID(payload.ID.Hex())
-	if err != nil{
-		return fiber.NewError(fiber.StatusInternalServerError, "cannot get user to delete")
+	user, err := app.model.FetchUserByID(c.UserContext(), payload.ID.Hex())
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot get user to delete")
 	}
 
-	if err = user.DeleteUser() ; err != nil{
-		return fiber.NewError(fiber.StatusInternalServerError, fmt.Sprintf("failed to delete user: %v\n", err))
+	if err = app.model.DeleteUser(c.UserContext(), user.ID, app.config.DeletedEmailPolicy == deletedEmailRelease); err != nil {
+		return storeError(err, fiber.StatusInternalServerError, fmt.Sprintf("failed to delete user: %v\n", err))
 	}
 
-	return c.JSON(fiber.Map{"message" : "Delete user successfully."})
+	event := newAuditEvent(c, db.AuditUserDelete, user.ID)
+	event.Changes = db.DiffUsers(user, nil)
+	app.audit.Record(event)
+
+	if _, err := app.sessions.RevokeUserSessions(c.UserContext(), user.ID); err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot revoke user sessions")
+	}
+
+	return c.JSON(fiber.Map{"message": "Delete user successfully."})
 }
 
-func (app *App) CreateUserViaGrpc(c *fiber.Ctx) error{
+func (app *App) CreateUserViaGrpc(c *fiber.Ctx) error {
 	var req CreateUserRequest
-	if err := c.BodyParser(&req) ; err != nil{
+	if err := c.BodyParser(&req); err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, "bad request")
 	}
 
@@ -236,38 +566,37 @@ func (app *App) CreateUserViaGrpc(c *fiber.Ctx) error{
 	if err := validate.Struct(req); err != nil {
 		return fiber.NewError(fiber.StatusBadRequest, err.Error())
 	}
-	
 
 	conn, err := grpc.Dial("localhost:50001", grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil{
+	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
 	}
 
 	defer conn.Close()
 
 	service := pb.NewSevenCodingTestClient(conn)
-	
+
 	serviceResponse, err := service.CreateUser(c.Context(), &pb.CreateUserRequest{
-		Name: req.Name,
-		Email: req.Email,
+		Name:     req.Name,
+		Email:    req.Email,
 		Password: req.Password,
 	})
 
-	if err != nil{
+	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
 	}
 
 	return c.JSON(fiber.Map{
-		"message" : "Create user successfully.",
-		"name" : serviceResponse.User.Name,
-		"email" : serviceResponse.User.Email,
+		"message": "Create user successfully.",
+		"name":    serviceResponse.User.Name,
+		"email":   serviceResponse.User.Email,
 	})
 }
 
-func (app *App) GetUserViaGrpc(c *fiber.Ctx) error{
+func (app *App) GetUserViaGrpc(c *fiber.Ctx) error {
 	p := c.Locals(payloadHeader)
 
-	_, ok := p.(*token.Payload)
+	payload, ok := p.(*token.Payload)
 	if !ok {
 		return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
 	}
@@ -277,24 +606,116 @@ func (app *App) GetUserViaGrpc(c *fiber.Ctx) error{
 		return fiber.NewError(fiber.StatusBadRequest, "user id is not provided.")
 	}
 
+	if userId != payload.ID.Hex() && !payload.HasRole(db.RoleAdmin) && !db.IsOrgAdminRole(payload.OrgRole) {
+		return fiber.NewError(fiber.StatusForbidden, "you are not allowed to read this user")
+	}
+
 	conn, err := grpc.Dial("localhost:50001", grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil{
+	if err != nil {
 		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
 	}
 
 	defer conn.Close()
 
 	service := pb.NewSevenCodingTestClient(conn)
-	
-	serviceResponse, err := service.GetUser(c.Context(), &pb.GetUserRequest{
+
+	// forward the caller's token so the gRPC service authorizes the same user
+	ctx := metadata.AppendToOutgoingContext(c.Context(), authorizationHeader, c.Get(authorizationHeader))
+
+	serviceResponse, err := service.GetUser(ctx, &pb.GetUserRequest{
 		XId: userId,
 	})
 
-	if err !=  nil{
-		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	if err != nil {
+		return grpcToFiberError(err)
 	}
 
 	return c.JSON(serviceResponse.User)
-	
+
 }
 
+type UpdateRoleRequest struct {
+	Role string `json:"role" validate:"required"`
+}
+
+func (app *App) GrantRole(c *fiber.Ctx) error {
+	userId := c.Params("id", "")
+	if userId == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "user id is not provided.")
+	}
+
+	var req UpdateRoleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid role request")
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	if !db.IsValidRole(req.Role) {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("unknown role: %s", req.Role))
+	}
+
+	user, err := app.model.FetchUserByID(c.UserContext(), userId)
+	if err != nil {
+		return storeError(err, fiber.StatusNotFound, err.Error())
+	}
+
+	if err := app.model.GrantRole(c.UserContext(), userId, req.Role); err != nil {
+		return storeError(err, fiber.StatusInternalServerError, err.Error())
+	}
+
+	app.recordUserChange(c, db.AuditRoleGrant, user)
+
+	return c.JSON(fiber.Map{"message": "Grant role successfully."})
+}
+
+func (app *App) RevokeRole(c *fiber.Ctx) error {
+	userId := c.Params("id", "")
+	role := c.Params("role", "")
+	if userId == "" || role == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "user id and role must be provided.")
+	}
+
+	if !db.IsValidRole(role) {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("unknown role: %s", role))
+	}
+
+	user, err := app.model.FetchUserByID(c.UserContext(), userId)
+	if err != nil {
+		return storeError(err, fiber.StatusNotFound, err.Error())
+	}
+
+	if err := app.model.RevokeRole(c.UserContext(), userId, role); err != nil {
+		return storeError(err, fiber.StatusInternalServerError, err.Error())
+	}
+
+	app.recordUserChange(c, db.AuditRoleRevoke, user)
+
+	// a revoked role must not live on in tokens that were issued before
+	if _, err := app.sessions.RevokeUserSessions(c.UserContext(), user.ID); err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot revoke user sessions")
+	}
+
+	return c.JSON(fiber.Map{"message": "Revoke role successfully."})
+}
+
+func (app *App) UnlockUser(c *fiber.Ctx) error {
+	userId := c.Params("id", "")
+	if userId == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "user id is not provided.")
+	}
+
+	user, err := app.model.FetchUserByID(c.UserContext(), userId)
+	if err != nil {
+		return storeError(err, fiber.StatusNotFound, err.Error())
+	}
+
+	if err := app.loginGuard.Unlock(c.UserContext(), user); err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot unlock user")
+	}
+
+	return c.JSON(fiber.Map{"message": "Unlock user successfully."})
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sangketkit01/7-coding-test/internal/db"
+	"github.com/sangketkit01/7-coding-test/internal/token"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const errImpersonationForbidden = "this action is not allowed while impersonating a user"
+
+// impersonationBlockedMethods are the gRPC methods an impersonation token
+// cannot call, like the routes behind RejectImpersonation.
+var impersonationBlockedMethods = map[string]bool{
+	"/pb.SevenCodingTest/ChangePassword": true,
+}
+
+type ImpersonationResponse struct {
+	Token     string             `json:"token"`
+	SessionID string             `json:"session_id"`
+	UserID    primitive.ObjectID `json:"user_id"`
+	ActorID   primitive.ObjectID `json:"actor_id"`
+	IssuedAt  time.Time          `json:"issued_at"`
+	ExpiredAt time.Time          `json:"expired_at"`
+}
+
+// Impersonate gives an admin an access token for another user, so support
+// staff can see what the user sees. The token cannot be refreshed, ends
+// with the session it starts and carries the admin as its actor.
+func (app *App) Impersonate(c *fiber.Ctx) error {
+	payload, ok := c.Locals(payloadHeader).(*token.Payload)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
+	}
+
+	target, err := app.model.FetchUserByID(c.UserContext(), c.Params("id"))
+	if err != nil {
+		return storeError(err, fiber.StatusNotFound, err.Error())
+	}
+
+	switch {
+	case target.ID == payload.ID:
+		return fiber.NewError(fiber.StatusBadRequest, "you cannot impersonate yourself")
+	case target.HasRole(db.RoleAdmin):
+		return fiber.NewError(fiber.StatusForbidden, "admins cannot be impersonated")
+	case target.ServiceAccount:
+		return fiber.NewError(fiber.StatusBadRequest, "service accounts cannot be impersonated")
+	}
+
+	actorID := payload.ID
+
+	accessToken, accessPayload, err := app.jwtMaker.CreateToken(
+		target.ID,
+		app.config.ImpersonationTokenDuration,
+		token.WithRoles(target.Roles),
+		token.WithActor(actorID),
+	)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	err = app.sessions.CreateSession(c.UserContext(), db.Session{
+		ID:             accessPayload.SessionID.String(),
+		UserID:         target.ID,
+		UserAgent:      c.Get(fiber.HeaderUserAgent),
+		ClientIP:       c.IP(),
+		ImpersonatorID: &actorID,
+		ExpiresAt:      accessPayload.ExpiredAt,
+	})
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "cannot start impersonation session")
+	}
+
+	event := newAuditEvent(c, db.AuditImpersonationStart, target.ID)
+	event.SetMetadata("session_id", accessPayload.SessionID.String())
+	app.audit.Record(event)
+
+	return c.Status(fiber.StatusCreated).JSON(ImpersonationResponse{
+		Token:     accessToken,
+		SessionID: accessPayload.SessionID.String(),
+		UserID:    target.ID,
+		ActorID:   actorID,
+		IssuedAt:  accessPayload.IssuedAt,
+		ExpiredAt: accessPayload.ExpiredAt,
+	})
+}
+
+// RejectImpersonation must run after AuthMiddleware. It keeps impersonation
+// tokens away from actions that only the real user may take.
+func (app *App) RejectImpersonation() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		payload, ok := c.Locals(payloadHeader).(*token.Payload)
+		if !ok {
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
+		}
+
+		if payload.IsImpersonation() {
+			return fiber.NewError(fiber.StatusForbidden, errImpersonationForbidden)
+		}
+
+		return c.Next()
+	}
+}
+
+// AuditImpersonation must run after AuthMiddleware. Every request made with
+// an impersonation token is logged and written to the audit trail with
+// both the admin and the impersonated user.
+func (app *App) AuditImpersonation() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		payload, ok := c.Locals(payloadHeader).(*token.Payload)
+		if !ok || !payload.IsImpersonation() {
+			return c.Next()
+		}
+
+		err := c.Next()
+
+		code := c.Response().StatusCode()
+		var fiberErr *fiber.Error
+		if errors.As(err, &fiberErr) {
+			code = fiberErr.Code
+		} else if err != nil {
+			code = fiber.StatusInternalServerError
+		}
+
+		log.Printf("impersonation: admin %s as user %s: %s %s %d\n",
+			payload.ActorID.Hex(), payload.ID.Hex(), c.Method(), c.Path(), code)
+
+		event := newAuditEvent(c, db.AuditImpersonationRequest, payload.ID)
+		event.SetMetadata("request", c.Method()+" "+c.Path())
+		event.SetMetadata("status", strconv.Itoa(code))
+		app.audit.Record(event)
+
+		return err
+	}
+}
+
+// recordImpersonatedCall is AuditImpersonation for gRPC calls.
+func (app *App) recordImpersonatedCall(ctx context.Context, payload *token.Payload, method string, err error) {
+	code := status.Code(err)
+
+	log.Printf("impersonation: admin %s as user %s: %s %s\n",
+		payload.ActorID.Hex(), payload.ID.Hex(), method, code)
+
+	event := newGRPCAuditEvent(ctx, db.AuditImpersonationRequest, payload.ID)
+	event.SetMetadata("request", method)
+	event.SetMetadata("status", code.String())
+	app.audit.Record(event)
+}
+
+func (app *App) UnaryImpersonationInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	payload, ok := payloadFromContext(ctx)
+	if !ok || !payload.IsImpersonation() {
+		return handler(ctx, req)
+	}
+
+	var resp interface{}
+	var err error
+
+	if impersonationBlockedMethods[info.FullMethod] {
+		err = status.Error(codes.PermissionDenied, errImpersonationForbidden)
+	} else {
+		resp, err = handler(ctx, req)
+	}
+
+	app.recordImpersonatedCall(ctx, payload, info.FullMethod, err)
+
+	return resp, err
+}
+
+func (app *App) StreamImpersonationInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	payload, ok := payloadFromContext(stream.Context())
+	if !ok || !payload.IsImpersonation() {
+		return handler(srv, stream)
+	}
+
+	var err error
+
+	if impersonationBlockedMethods[info.FullMethod] {
+		err = status.Error(codes.PermissionDenied, errImpersonationForbidden)
+	} else {
+		err = handler(srv, stream)
+	}
+
+	app.recordImpersonatedCall(stream.Context(), payload, info.FullMethod, err)
+
+	return err
+}
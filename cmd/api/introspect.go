@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/sangketkit01/7-coding-test/internal/db"
+	"github.com/sangketkit01/7-coding-test/internal/token"
+)
+
+const tokenTypeHintAPIKey = "api_key"
+
+// IntrospectionResponse follows RFC 7662. An inactive token only has Active
+// set, nothing else about it is given away.
+type IntrospectionResponse struct {
+	Active    bool     `json:"active"`
+	Scope     string   `json:"scope,omitempty"`
+	Username  string   `json:"username,omitempty"`
+	TokenType string   `json:"token_type,omitempty"`
+	Exp       int64    `json:"exp,omitempty"`
+	Iat       int64    `json:"iat,omitempty"`
+	Sub       string   `json:"sub,omitempty"`
+	SessionID string   `json:"session_id,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	APIKeyID  string   `json:"api_key_id,omitempty"`
+	// ActorID is the admin using an impersonation token.
+	ActorID string `json:"actor_id,omitempty"`
+	OrgID   string `json:"org_id,omitempty"`
+	OrgRole string `json:"org_role,omitempty"`
+}
+
+// tokenIntrospector tells other services whether a token is still good. It
+// is shared by the HTTP handler and the gRPC service.
+type tokenIntrospector struct {
+	users                   db.MongoClient
+	authenticateAccessToken func(ctx context.Context, accessToken string) (*token.Payload, error)
+	authenticateAPIKey      func(ctx context.Context, rawKey string) (*token.Payload, error)
+}
+
+// Introspect checks an access token or an API key the same way the
+// middleware does, including its session. Refresh and mfa pending tokens
+// are never active here, other services have no use for them.
+func (introspector *tokenIntrospector) Introspect(ctx context.Context, rawToken, tokenTypeHint string) (*IntrospectionResponse, error) {
+	authenticate := introspector.authenticateAccessToken
+	if tokenTypeHint == tokenTypeHintAPIKey || strings.HasPrefix(rawToken, apiKeyPrefix) {
+		authenticate = introspector.authenticateAPIKey
+	}
+
+	payload, err := authenticate(ctx, rawToken)
+	if err != nil {
+		if isUnauthenticated(err) {
+			return &IntrospectionResponse{Active: false}, nil
+		}
+
+		return nil, err
+	}
+
+	user, err := introspector.users.FetchUserByID(ctx, payload.ID.Hex())
+	if err != nil {
+		log.Printf("cannot load user %s for introspection: %v\n", payload.ID.Hex(), err)
+		return &IntrospectionResponse{Active: false}, nil
+	}
+
+	response := &IntrospectionResponse{
+		Active:    true,
+		Scope:     strings.Join(payload.Scopes, " "),
+		Username:  user.Email,
+		TokenType: string(payload.TokenType),
+		Exp:       payload.ExpiredAt.Unix(),
+		Iat:       payload.IssuedAt.Unix(),
+		Sub:       payload.ID.Hex(),
+		Roles:     payload.Roles,
+		APIKeyID:  payload.APIKeyID,
+	}
+
+	if payload.TokenType == token.TokenTypeAccess {
+		response.SessionID = payload.SessionID.String()
+	}
+
+	if payload.IsImpersonation() {
+		response.ActorID = payload.ActorID.Hex()
+	}
+
+	if payload.OrgID != nil {
+		response.OrgID = payload.OrgID.Hex()
+		response.OrgRole = payload.OrgRole
+	}
+
+	return response, nil
+}
+
+type IntrospectRequest struct {
+	Token         string `json:"token" form:"token" validate:"required"`
+	TokenTypeHint string `json:"token_type_hint" form:"token_type_hint"`
+}
+
+// Introspect accepts the form encoded body of RFC 7662 as well as JSON.
+func (app *App) Introspect(c *fiber.Ctx) error {
+	var req IntrospectRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid introspection request")
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	response, err := app.introspector.Introspect(c.UserContext(), req.Token, req.TokenTypeHint)
+	if err != nil {
+		log.Printf("introspection failed: %v\n", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "cannot introspect token")
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+
+	return c.JSON(response)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sangketkit01/7-coding-test/internal/db"
+	"github.com/sangketkit01/7-coding-test/internal/token"
+)
+
+const (
+	signingKeySyncInterval = time.Minute
+	// a new key only signs once every replica had the chance to load it
+	signingKeyActivationDelay = 2 * signingKeySyncInterval
+)
+
+// signingKeyRotator keeps the in-memory key ring in sync with the signing
+// keys stored in Mongo, generates a new key when the current one is older
+// than the rotation interval and retires the keys it replaces.
+type signingKeyRotator struct {
+	store            db.SigningKeyStore
+	ring             *token.KeyRing
+	algorithm        string
+	rotationInterval time.Duration
+	gracePeriod      time.Duration
+}
+
+func newSigningKeyRotator(store db.SigningKeyStore, algorithm string, rotationInterval, gracePeriod time.Duration) *signingKeyRotator {
+	return &signingKeyRotator{
+		store:            store,
+		ring:             token.NewKeyRing(gracePeriod, signingKeyActivationDelay),
+		algorithm:        algorithm,
+		rotationInterval: rotationInterval,
+		gracePeriod:      gracePeriod,
+	}
+}
+
+func (rotator *signingKeyRotator) Sync(ctx context.Context) error {
+	records, err := rotator.store.ListSigningKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	var keys []*token.SigningKey
+	var active []*token.SigningKey
+	var newest *token.SigningKey
+	for _, record := range records {
+		if record.RetiredAt != nil && now.After(record.RetiredAt.Add(rotator.gracePeriod)) {
+			if err := rotator.store.DeleteSigningKey(ctx, record.ID); err != nil {
+				return err
+			}
+			continue
+		}
+
+		key, err := token.ParseSigningKey(record.ID, record.Algorithm, []byte(record.PrivateKey), record.CreatedAt, record.RetiredAt)
+		if err != nil {
+			log.Printf("skipping signing key %s: %v\n", record.ID, err)
+			continue
+		}
+
+		keys = append(keys, key)
+		if key.IsRetired() {
+			continue
+		}
+
+		active = append(active, key)
+		if newest == nil || key.CreatedAt.After(newest.CreatedAt) {
+			newest = key
+		}
+	}
+
+	if newest == nil || newest.Algorithm != rotator.algorithm || now.Sub(newest.CreatedAt) >= rotator.rotationInterval {
+		key, err := rotator.generate(ctx)
+		if err != nil {
+			return err
+		}
+
+		keys = append(keys, key)
+		active = append(active, key)
+		newest = key
+	}
+
+	if now.Sub(newest.CreatedAt) >= signingKeyActivationDelay {
+		for _, key := range active {
+			if key == newest {
+				continue
+			}
+
+			if err := rotator.store.RetireSigningKey(ctx, key.ID, now); err != nil {
+				return err
+			}
+
+			retiredAt := now
+			key.RetiredAt = &retiredAt
+			log.Println("retired signing key:", key.ID)
+		}
+	}
+
+	rotator.ring.SetKeys(keys)
+
+	return nil
+}
+
+func (rotator *signingKeyRotator) generate(ctx context.Context) (*token.SigningKey, error) {
+	key, err := token.GenerateSigningKey(rotator.algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := key.MarshalPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	err = rotator.store.InsertSigningKey(ctx, db.SigningKey{
+		ID:         key.ID,
+		Algorithm:  key.Algorithm,
+		PrivateKey: string(privateKey),
+		CreatedAt:  key.CreatedAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+func (app *App) RotateSigningKeys() {
+	for {
+		time.Sleep(signingKeySyncInterval)
+
+		if err := app.keyRotator.Sync(context.Background()); err != nil {
+			log.Println("failed to sync signing keys:", err)
+		}
+	}
+}
+
+func (app *App) JWKS(c *fiber.Ctx) error {
+	if app.keyRotator == nil {
+		return fiber.NewError(fiber.StatusNotFound, "tokens are not signed with asymmetric keys")
+	}
+
+	// keep caches shorter than the activation delay of a new key
+	c.Set(fiber.HeaderCacheControl, "public, max-age=60")
+
+	return c.JSON(app.keyRotator.ring.JWKS())
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/sangketkit01/7-coding-test/internal/db"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// loginThrottledError is returned when a login attempt is refused before
+// the password is checked.
+type loginThrottledError struct {
+	locked     bool
+	retryAfter time.Duration
+	message    string
+}
+
+func (e *loginThrottledError) Error() string {
+	return e.message
+}
+
+// loginGuard slows down and locks out repeated failed logins. Failures are
+// counted per account, the tenant and email
+// the login was made against, and per client IP. Every failure on an account
+// doubles the wait before the next attempt, and reaching the threshold
+// locks the account or the IP for the lockout duration.
+type loginGuard struct {
+	store              db.LoginAttemptStore
+	maxAccountFailures int
+	maxIPFailures      int
+	window             time.Duration
+	lockout            time.Duration
+	baseDelay          time.Duration
+	maxDelay           time.Duration
+}
+
+// accountAttemptKey names the counter of email in tenantID, nil for logins
+// without an organization. The same email can belong to different people in
+// different tenants, failures against one must not lock out the others.
+func accountAttemptKey(tenantID *primitive.ObjectID, email string) string {
+	tenant := "-"
+	if tenantID != nil {
+		tenant = tenantID.Hex()
+	}
+
+	return "account:" + tenant + ":" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+func (guard *loginGuard) Check(ctx context.Context, tenantID *primitive.ObjectID, email, ip string) error {
+	now := time.Now()
+
+	ipAttempt, err := guard.store.GetLoginAttempt(ctx, ipAttemptKey(ip))
+	if err != nil {
+		return err
+	}
+
+	if ipAttempt != nil && ipAttempt.LockedUntil != nil && now.Before(*ipAttempt.LockedUntil) {
+		return &loginThrottledError{
+			retryAfter: ipAttempt.LockedUntil.Sub(now),
+			message:    "too many failed login attempts from this address, try again later",
+		}
+	}
+
+	accountAttempt, err := guard.store.GetLoginAttempt(ctx, accountAttemptKey(tenantID, email))
+	if err != nil {
+		return err
+	}
+
+	if accountAttempt == nil {
+		return nil
+	}
+
+	if accountAttempt.LockedUntil != nil && now.Before(*accountAttempt.LockedUntil) {
+		return &loginThrottledError{
+			locked:     true,
+			retryAfter: accountAttempt.LockedUntil.Sub(now),
+			message:    "account is temporarily locked due to too many failed login attempts",
+		}
+	}
+
+	if now.Sub(accountAttempt.LastFailureAt) < guard.window {
+		next := accountAttempt.LastFailureAt.Add(guard.delay(accountAttempt.Failures))
+		if now.Before(next) {
+			return &loginThrottledError{
+				retryAfter: next.Sub(now),
+				message:    "too many failed login attempts, try again later",
+			}
+		}
+	}
+
+	return nil
+}
+
+func (guard *loginGuard) RecordFailure(ctx context.Context, tenantID *primitive.ObjectID, email, ip string) error {
+	lockUntil := time.Now().Add(guard.lockout)
+
+	accountKey := accountAttemptKey(tenantID, email)
+	accountAttempt, err := guard.store.RecordLoginFailure(ctx, accountKey, guard.window)
+	if err != nil {
+		return err
+	}
+
+	if accountAttempt.Failures >= guard.maxAccountFailures {
+		if err := guard.store.LockLoginAttempt(ctx, accountKey, lockUntil); err != nil {
+			return err
+		}
+	}
+
+	ipKey := ipAttemptKey(ip)
+	ipAttempt, err := guard.store.RecordLoginFailure(ctx, ipKey, guard.window)
+	if err != nil {
+		return err
+	}
+
+	if ipAttempt.Failures >= guard.maxIPFailures {
+		if err := guard.store.LockLoginAttempt(ctx, ipKey, lockUntil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RecordSuccess clears the account's failures. The IP counter is left to
+// expire on its own, a stuffing source may own some valid credentials.
+func (guard *loginGuard) RecordSuccess(ctx context.Context, tenantID *primitive.ObjectID, email string) error {
+	return guard.store.ResetLoginAttempts(ctx, accountAttemptKey(tenantID, email))
+}
+
+// Unlock clears the failures of user in every tenant they can log in to,
+// their own and the organizations they are a member of.
+func (guard *loginGuard) Unlock(ctx context.Context, user *db.User) error {
+	if err := guard.store.ResetLoginAttempts(ctx, accountAttemptKey(user.TenantID, user.Email)); err != nil {
+		return err
+	}
+
+	for _, membership := range user.Memberships {
+		if err := guard.store.ResetLoginAttempts(ctx, accountAttemptKey(&membership.OrgID, user.Email)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (guard *loginGuard) delay(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+
+	delay := guard.baseDelay
+	for i := 1; i < failures && delay < guard.maxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > guard.maxDelay {
+		delay = guard.maxDelay
+	}
+
+	return delay
+}
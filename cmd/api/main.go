@@ -11,7 +11,11 @@ import (
 	"github.com/joho/godotenv"
 	"github.com/sangketkit01/7-coding-test/internal/config"
 	"github.com/sangketkit01/7-coding-test/internal/db"
+	"github.com/sangketkit01/7-coding-test/internal/mail"
+	"github.com/sangketkit01/7-coding-test/internal/oidc"
+	"github.com/sangketkit01/7-coding-test/internal/policy"
 	"github.com/sangketkit01/7-coding-test/internal/token"
+	"github.com/sangketkit01/7-coding-test/internal/util"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -24,10 +28,27 @@ const (
 var client *mongo.Client
 
 type App struct {
-	router   *fiber.App
-	model    db.MongoClient
-	jwtMaker token.Maker
-	config   *config.Config
+	router         *fiber.App
+	model          db.MongoClient
+	orgs           db.OrganizationStore
+	sessions       db.SessionStore
+	passwordResets db.PasswordResetStore
+	mailer         mail.Mailer
+	verifier       *emailVerifier
+	loginGuard     *loginGuard
+	jwtMaker       token.Maker
+	keyRotator     *signingKeyRotator
+	tokens         *tokenIssuer
+	oidcProviders  map[string]*oidc.Provider
+	oidcStates     db.OIDCStateStore
+	apiKeys        db.APIKeyStore
+	passwordPolicy *policy.PasswordPolicy
+	passwords      *passwordChanger
+	audit          *auditLogger
+	rateLimiters   map[string]*rateLimiter
+	introspector   *tokenIntrospector
+	profiles       *profileLoader
+	config         *config.Config
 }
 
 func init() {
@@ -52,42 +73,280 @@ func main() {
 
 	fmt.Println("environment:", config.Environment)
 
-	mongoClient, err := connectToMongo(config.MongoUrl, config.MongoUsername, config.MongoPassword)
+	if err := db.SetEmailUniqueness(config.EmailUniqueness); err != nil {
+		log.Panic(err)
+	}
+
+	stores, err := newStores(config)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	client = mongoClient
+	if client != nil {
+		ctx, cancle := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancle()
+
+		defer func() {
+			if err := client.Disconnect(ctx); err != nil {
+				panic(err)
+			}
+		}()
+	}
 
-	ctx, cancle := context.WithTimeout(context.Background(), 15*time.Second)
-	defer cancle()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if client == nil {
+			log.Panic("migrations only apply to STORE=mongo")
+		}
+
+		if err := runMigrate(db.NewMigrator(client), os.Args[2:]); err != nil {
+			log.Panic(err)
+		}
+		return
+	}
 
-	defer func() {
-		if err := client.Disconnect(ctx); err != nil {
-			panic(err)
+	// the memory stores start empty, there is no schema to check
+	if client != nil {
+		if err := prepareSchema(db.NewMigrator(client), config.MigrateOnStart); err != nil {
+			log.Panic(err)
 		}
-	}()
+	}
+
+	err = util.SetPasswordHashParams(util.PasswordHashParams{
+		Algorithm:         config.PasswordHashAlgorithm,
+		BcryptCost:        config.PasswordBcryptCost,
+		Argon2Memory:      config.PasswordArgon2Memory,
+		Argon2Iterations:  config.PasswordArgon2Iterations,
+		Argon2Parallelism: config.PasswordArgon2Parallelism,
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	passwordPolicy, err := policy.NewPasswordPolicy(policy.PasswordConfig{
+		MinLength:     config.PasswordMinLength,
+		MaxLength:     config.PasswordMaxLength,
+		RequireUpper:  config.PasswordRequireUpper,
+		RequireLower:  config.PasswordRequireLower,
+		RequireDigit:  config.PasswordRequireDigit,
+		RequireSymbol: config.PasswordRequireSymbol,
+		HistorySize:   config.PasswordHistory,
+		BlocklistFile: config.PasswordBlocklistFile,
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+
+	jwtMaker, keyRotator, err := newTokenMaker(config, stores.signingKeys)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if err := checkDeletedEmailPolicy(config.DeletedEmailPolicy); err != nil {
+		log.Panic(err)
+	}
 
-	jwtMaker, err := token.NewMaker(config.SecretKey)
+	db.SetOperationTimeouts(config.DBReadTimeout, config.DBWriteTimeout)
+
+	model := stores.users
+	sessions := stores.sessions
+
+	audit := &auditLogger{store: stores.auditEvents}
+
+	mailer, err := newMailer(config)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	rateLimiters, err := newRateLimiters(config)
 	if err != nil {
 		log.Panic(err)
 	}
 
 	app := App{
-		model:    db.New(client),
-		jwtMaker: jwtMaker,
-		config:   config,
+		model:          model,
+		orgs:           stores.orgs,
+		sessions:       sessions,
+		passwordResets: stores.passwordResets,
+		mailer:         mailer,
+		verifier: &emailVerifier{
+			store:          stores.emailVerifications,
+			mailer:         mailer,
+			baseUrl:        config.AppBaseUrl,
+			expiry:         config.EmailVerificationExpiry,
+			resendCooldown: config.EmailVerificationCooldown,
+			maxPerHour:     config.EmailVerificationMaxPerHour,
+		},
+		loginGuard: &loginGuard{
+			store:              stores.loginAttempts,
+			maxAccountFailures: config.LoginMaxAccountFailures,
+			maxIPFailures:      config.LoginMaxIPFailures,
+			window:             config.LoginFailureWindow,
+			lockout:            config.LoginLockoutDuration,
+			baseDelay:          config.LoginBaseDelay,
+			maxDelay:           config.LoginMaxDelay,
+		},
+		jwtMaker:   jwtMaker,
+		keyRotator: keyRotator,
+		tokens: &tokenIssuer{
+			maker:                jwtMaker,
+			users:                model,
+			refreshTokens:        stores.refreshTokens,
+			sessions:             sessions,
+			audit:                audit,
+			accessTokenDuration:  config.AccessTokenDuration,
+			refreshTokenDuration: config.RefreshTokenDuration,
+		},
+		oidcProviders:  newOIDCProviders(config.OIDCProviders),
+		oidcStates:     stores.oidcStates,
+		apiKeys:        stores.apiKeys,
+		passwordPolicy: passwordPolicy,
+		passwords: &passwordChanger{
+			users:    model,
+			sessions: sessions,
+			policy:   passwordPolicy,
+		},
+		audit:        audit,
+		rateLimiters: rateLimiters,
+		config:       config,
+	}
+
+	app.introspector = &tokenIntrospector{
+		users:                   model,
+		authenticateAccessToken: app.authenticateAccessToken,
+		authenticateAPIKey:      app.authenticateAPIKey,
+	}
+	app.profiles = &profileLoader{
+		users:    model,
+		sessions: sessions,
+		apiKeys:  app.apiKeys,
 	}
 
 	app.router = app.routes()
 
+	if config.AdminEmail != "" {
+		app.bootstrapAdmin(config.AdminEmail)
+	}
+
 	go app.LogsNumberOfUser()
+	if config.DeletedUserRetention > 0 && config.DeletedUserPurgeInterval > 0 {
+		go app.PurgeDeletedUsers()
+	}
+	if app.keyRotator != nil {
+		go app.RotateSigningKeys()
+	}
 	go app.gRPCListen()
 
 	app.router.Listen(fmt.Sprintf(":%s", webPort))
 
 }
 
+// newTokenMaker returns the maker selected by TOKEN_MAKER. Key ring based
+// makers also return the rotator that keeps their keys up to date.
+func newTokenMaker(config *config.Config, signingKeys db.SigningKeyStore) (token.Maker, *signingKeyRotator, error) {
+	var maker token.Maker
+	var err error
+
+	switch config.TokenMaker {
+	case "", "jwt":
+		maker, err = token.NewMaker(config.SecretKey)
+	case "jwt-rs256", "jwt-eddsa":
+		algorithm := token.AlgorithmRS256
+		if config.TokenMaker == "jwt-eddsa" {
+			algorithm = token.AlgorithmEdDSA
+		}
+
+		rotator := newSigningKeyRotator(signingKeys, algorithm, config.KeyRotationInterval, config.KeyGracePeriod)
+		if err := rotator.Sync(context.Background()); err != nil {
+			return nil, nil, err
+		}
+
+		return token.NewKeyRingMaker(rotator.ring), rotator, nil
+	case "paseto-local":
+		maker, err = token.NewPasetoLocalMaker(config.PasetoLocalKey)
+	case "paseto-public":
+		maker, err = token.NewPasetoPublicMaker(config.PasetoSecretKey)
+	default:
+		err = fmt.Errorf("unknown token maker: %s", config.TokenMaker)
+	}
+
+	return maker, nil, err
+}
+
+// stores is where the API keeps its state.
+type stores struct {
+	users              db.MongoClient
+	orgs               db.OrganizationStore
+	sessions           db.SessionStore
+	refreshTokens      db.RefreshTokenStore
+	passwordResets     db.PasswordResetStore
+	emailVerifications db.EmailVerificationStore
+	loginAttempts      db.LoginAttemptStore
+	oidcStates         db.OIDCStateStore
+	apiKeys            db.APIKeyStore
+	auditEvents        db.AuditEventStore
+	signingKeys        db.SigningKeyStore
+}
+
+// newStores builds the stores selected by STORE. mongo connects to the
+// database, memory keeps everything in the process and loses it on
+// restart.
+func newStores(config *config.Config) (*stores, error) {
+	switch config.Store {
+	case "", "mongo":
+		mongoClient, err := connectToMongo(config.MongoUrl, config.MongoUsername, config.MongoPassword)
+		if err != nil {
+			return nil, err
+		}
+
+		client = mongoClient
+
+		return &stores{
+			users:              db.New(client),
+			orgs:               db.NewOrganizationStore(client),
+			sessions:           db.NewSessionStore(client),
+			refreshTokens:      db.NewRefreshTokenStore(client),
+			passwordResets:     db.NewPasswordResetStore(client),
+			emailVerifications: db.NewEmailVerificationStore(client),
+			loginAttempts:      db.NewLoginAttemptStore(client),
+			oidcStates:         db.NewOIDCStateStore(client),
+			apiKeys:            db.NewAPIKeyStore(client),
+			auditEvents:        db.NewAuditEventStore(client),
+			signingKeys:        db.NewSigningKeyStore(client),
+		}, nil
+	case "memory":
+		log.Println("state is kept in memory and is lost on restart")
+
+		return &stores{
+			users:              db.NewMemoryUserStore(),
+			orgs:               db.NewMemoryOrganizationStore(),
+			sessions:           db.NewMemorySessionStore(),
+			refreshTokens:      db.NewMemoryRefreshTokenStore(),
+			passwordResets:     db.NewMemoryPasswordResetStore(),
+			emailVerifications: db.NewMemoryEmailVerificationStore(),
+			loginAttempts:      db.NewMemoryLoginAttemptStore(),
+			oidcStates:         db.NewMemoryOIDCStateStore(),
+			apiKeys:            db.NewMemoryAPIKeyStore(),
+			auditEvents:        db.NewMemoryAuditEventStore(),
+			signingKeys:        db.NewMemorySigningKeyStore(),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown store: %s", config.Store)
+	}
+}
+
+func newMailer(config *config.Config) (mail.Mailer, error) {
+	switch config.Mailer {
+	case "", "stdout":
+		return mail.NewFileMailer("", config.MailFrom), nil
+	case "file":
+		return mail.NewFileMailer(config.MailFile, config.MailFrom), nil
+	case "smtp":
+		return mail.NewSMTPMailer(config.SMTPHost, config.SMTPPort, config.SMTPUsername, config.SMTPPassword, config.MailFrom), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer: %s", config.Mailer)
+	}
+}
+
 func connectToMongo(url, username, password string) (*mongo.Client, error) {
 	clientOptions := options.Client().ApplyURI(url)
 	clientOptions.SetAuth(options.Credential{
@@ -104,15 +363,33 @@ func connectToMongo(url, username, password string) (*mongo.Client, error) {
 	return conn, nil
 }
 
+// bootstrapAdmin grants the admin role to the configured user, so that there
+// is someone who can grant roles to others.
+func (app *App) bootstrapAdmin(email string) {
+	user, err := app.model.GetUserByEmail(context.Background(), email)
+	if err != nil {
+		log.Printf("cannot bootstrap admin %s: %v\n", email, err)
+		return
+	}
+
+	if user.HasRole(db.RoleAdmin) {
+		return
+	}
+
+	if err := app.model.GrantRole(context.Background(), user.ID.Hex(), db.RoleAdmin); err != nil {
+		log.Printf("cannot bootstrap admin %s: %v\n", email, err)
+	}
+}
+
 func (app *App) LogsNumberOfUser() {
 	for {
-		users, err := app.model.ListAllUsers()
+		count, err := app.model.CountUsers(context.Background())
 		if err != nil {
 			log.Println(err)
-			continue
+		} else {
+			log.Printf("Number of users:%d\n", count)
 		}
 
-		log.Printf("Number of users:%d\n", len(users))
 		time.Sleep(10 * time.Second)
 	}
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/sangketkit01/7-coding-test/internal/db"
+	"github.com/sangketkit01/7-coding-test/internal/token"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UserProfile is the part of a user that is safe to hand back to clients.
+// It leaves out the password hash, the password history and the two-factor
+// secrets.
+type UserProfile struct {
+	ID             primitive.ObjectID  `json:"id"`
+	Name           string              `json:"name"`
+	Email          string              `json:"email"`
+	Roles          []string            `json:"roles"`
+	EmailVerified  bool                `json:"email_verified"`
+	TOTPEnabled    bool                `json:"totp_enabled"`
+	Identities     []db.Identity       `json:"identities,omitempty"`
+	ServiceAccount bool                `json:"service_account,omitempty"`
+	TenantID       *primitive.ObjectID `json:"tenant_id,omitempty"`
+	Memberships    []db.Membership     `json:"memberships,omitempty"`
+	CreatedAt      time.Time           `json:"created_at"`
+}
+
+func newUserProfile(user *db.User) UserProfile {
+	return UserProfile{
+		ID:             user.ID,
+		Name:           user.Name,
+		Email:          user.Email,
+		Roles:          user.Roles,
+		EmailVerified:  user.EmailVerified,
+		TOTPEnabled:    user.TOTPEnabled,
+		Identities:     user.Identities,
+		ServiceAccount: user.ServiceAccount,
+		TenantID:       user.TenantID,
+		Memberships:    user.Memberships,
+		CreatedAt:      user.CreatedAt,
+	}
+}
+
+// MeResponse describes the caller: their profile and either the session
+// of their token or the API key they used.
+type MeResponse struct {
+	User    UserProfile `json:"user"`
+	Session *db.Session `json:"session,omitempty"`
+	APIKey  *db.APIKey  `json:"api_key,omitempty"`
+	// ImpersonatedBy is the admin behind an impersonation token.
+	ImpersonatedBy *primitive.ObjectID `json:"impersonated_by,omitempty"`
+	// OrgID and OrgRole are the active organization of the token.
+	OrgID   *primitive.ObjectID `json:"org_id,omitempty"`
+	OrgRole string              `json:"org_role,omitempty"`
+}
+
+// profileLoader answers "who am I". It is shared by the HTTP handler and the
+// gRPC service.
+type profileLoader struct {
+	users    db.MongoClient
+	sessions db.SessionStore
+	apiKeys  db.APIKeyStore
+}
+
+func (loader *profileLoader) Me(ctx context.Context, payload *token.Payload) (*MeResponse, error) {
+	user, err := loader.users.FetchUserByID(ctx, payload.ID.Hex())
+	if err != nil {
+		return nil, err
+	}
+
+	response := &MeResponse{
+		User:           newUserProfile(user),
+		ImpersonatedBy: payload.ActorID,
+		OrgID:          payload.OrgID,
+		OrgRole:        payload.OrgRole,
+	}
+
+	if payload.TokenType == token.TokenTypeAPIKey {
+		keyID, err := primitive.ObjectIDFromHex(payload.APIKeyID)
+		if err != nil {
+			return nil, err
+		}
+
+		if response.APIKey, err = loader.apiKeys.GetAPIKey(ctx, keyID); err != nil {
+			return nil, err
+		}
+
+		return response, nil
+	}
+
+	if payload.SessionID != uuid.Nil {
+		session, err := loader.sessions.GetSession(ctx, payload.SessionID.String())
+		if err != nil && !errors.Is(err, db.ErrSessionNotFound) {
+			return nil, err
+		}
+		response.Session = session
+	}
+
+	return response, nil
+}
+
+func (app *App) Me(c *fiber.Ctx) error {
+	payload, ok := c.Locals(payloadHeader).(*token.Payload)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
+	}
+
+	response, err := app.profiles.Me(c.UserContext(), payload)
+	if err != nil {
+		log.Printf("cannot load profile: %v\n", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "cannot load profile")
+	}
+
+	return c.JSON(response)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/sangketkit01/7-coding-test/internal/db"
+	"github.com/sangketkit01/7-coding-test/internal/token"
+	"github.com/sangketkit01/7-coding-test/internal/totp"
+	"github.com/sangketkit01/7-coding-test/internal/util"
+)
+
+const recoveryCodeCount = 10
+
+var errInvalidMFACode = errors.New("invalid two-factor code")
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// generateRecoveryCodes returns the plain codes to show the user once and
+// the hashes to store.
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = util.HashToken(normalizeRecoveryCode(codes[i]))
+	}
+
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused
+// recovery code. Both are single-use.
+func (app *App) verifySecondFactor(ctx context.Context, user *db.User, code string) error {
+	if step, ok := totp.Validate(user.TOTPSecret, code, time.Now()); ok {
+		if err := app.model.UseTOTPStep(ctx, user.ID, step); err != nil {
+			if errors.Is(err, db.ErrTOTPCodeReused) {
+				return errInvalidMFACode
+			}
+
+			return err
+		}
+
+		return nil
+	}
+
+	ok, err := app.model.ConsumeRecoveryCode(ctx, user.ID, util.HashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errInvalidMFACode
+	}
+
+	log.Println("recovery code used by user:", user.ID.Hex())
+	return nil
+}
+
+type EnrollMFAResponse struct {
+	Secret     string `json:"secret"`
+	OtpauthUrl string `json:"otpauth_url"`
+}
+
+func (app *App) EnrollMFA(c *fiber.Ctx) error {
+	payload, ok := c.Locals(payloadHeader).(*token.Payload)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
+	}
+
+	user, err := app.model.FetchUserByID(c.UserContext(), payload.ID.Hex())
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, err.Error())
+	}
+
+	if user.TOTPEnabled {
+		return fiber.NewError(fiber.StatusConflict, "two-factor authentication is already enabled")
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "cannot generate secret")
+	}
+
+	if err := app.model.SetPendingTOTPSecret(c.UserContext(), user.ID, secret); err != nil {
+		return storeError(err, fiber.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(EnrollMFAResponse{
+		Secret:     secret,
+		OtpauthUrl: totp.URI(app.config.TOTPIssuer, user.Email, secret),
+	})
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
+func (app *App) VerifyMFAEnrollment(c *fiber.Ctx) error {
+	payload, ok := c.Locals(payloadHeader).(*token.Payload)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
+	}
+
+	var req MFACodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid two-factor request")
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	user, err := app.model.FetchUserByID(c.UserContext(), payload.ID.Hex())
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, err.Error())
+	}
+
+	if user.TOTPPendingSecret == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "two-factor enrolment has not been started")
+	}
+
+	step, ok := totp.Validate(user.TOTPPendingSecret, req.Code, time.Now())
+	if !ok {
+		return fiber.NewError(fiber.StatusBadRequest, errInvalidMFACode.Error())
+	}
+
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "cannot generate recovery codes")
+	}
+
+	if err := app.model.EnableTOTP(c.UserContext(), user.ID, user.TOTPPendingSecret, step, hashes); err != nil {
+		return storeError(err, fiber.StatusConflict, err.Error())
+	}
+
+	app.recordUserChange(c, db.AuditMFAEnable, user)
+
+	return c.JSON(fiber.Map{
+		"message":        "Two-factor authentication enabled. Store the recovery codes somewhere safe, they are shown only once.",
+		"recovery_codes": codes,
+	})
+}
+
+func (app *App) DisableMFA(c *fiber.Ctx) error {
+	payload, ok := c.Locals(payloadHeader).(*token.Payload)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
+	}
+
+	var req MFACodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid two-factor request")
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	user, err := app.model.FetchUserByID(c.UserContext(), payload.ID.Hex())
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, err.Error())
+	}
+
+	if !user.TOTPEnabled {
+		return fiber.NewError(fiber.StatusBadRequest, "two-factor authentication is not enabled")
+	}
+
+	if err := app.verifySecondFactor(c.UserContext(), user, req.Code); err != nil {
+		if errors.Is(err, errInvalidMFACode) {
+			return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+		}
+
+		return fiber.NewError(fiber.StatusInternalServerError, "cannot verify two-factor code")
+	}
+
+	if err := app.model.DisableTOTP(c.UserContext(), user.ID); err != nil {
+		return storeError(err, fiber.StatusInternalServerError, err.Error())
+	}
+
+	app.recordUserChange(c, db.AuditMFADisable, user)
+
+	return c.JSON(fiber.Map{"message": "Two-factor authentication disabled."})
+}
+
+type LoginMFARequest struct {
+	MFAToken string `json:"mfa_token" validate:"required"`
+	Code     string `json:"code" validate:"required"`
+}
+
+// LoginMFA is the second step of a login for users with two-factor
+// authentication. It exchanges the "mfa pending" token from LoginUser and a
+// code for a real token pair.
+func (app *App) LoginMFA(c *fiber.Ctx) error {
+	var req LoginMFARequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid two-factor request")
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	payload, err := app.jwtMaker.VerifyToken(req.MFAToken)
+	if err != nil || payload.TokenType != token.TokenTypeMFAPending {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid or expired mfa token")
+	}
+
+	user, err := app.model.FetchUserByID(c.UserContext(), payload.ID.Hex())
+	if err != nil || !user.TOTPEnabled {
+		return storeError(err, fiber.StatusUnauthorized, "invalid or expired mfa token")
+	}
+
+	if err := app.checkLoginGuard(c, payload.OrgID, user.Email); err != nil {
+		return err
+	}
+
+	if err := app.verifySecondFactor(c.UserContext(), user, req.Code); err != nil {
+		if errors.Is(err, errInvalidMFACode) {
+			if err := app.loginGuard.RecordFailure(c.UserContext(), payload.OrgID, user.Email, c.IP()); err != nil {
+				log.Printf("failed to record login failure: %v\n", err)
+			}
+
+			app.recordLoginFailure(c, user.Email, "invalid two-factor code")
+
+			return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+		}
+
+		return fiber.NewError(fiber.StatusInternalServerError, "cannot verify two-factor code")
+	}
+
+	if err := app.loginGuard.RecordSuccess(c.UserContext(), payload.OrgID, user.Email); err != nil {
+		log.Printf("failed to reset login failures: %v\n", err)
+	}
+
+	app.recordLogin(c, user, "mfa")
+
+	pair, err := app.tokens.IssueTokenPair(c.UserContext(), user, payload.OrgID, c.Get(fiber.HeaderUserAgent), c.IP())
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(newLoginUserResponse(pair, user.Email))
+}
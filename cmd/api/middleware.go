@@ -1,37 +1,174 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/sangketkit01/7-coding-test/internal/db"
+	"github.com/sangketkit01/7-coding-test/internal/token"
 )
 
 const (
 	authorizationHeader = "authorization"
 	bearer              = "bearer"
+	apiKeyScheme        = "apikey"
 	payloadHeader       = "payload"
 )
 
+var (
+	errMissingAuthorization = errors.New("missing authorization header")
+	errInvalidAuthorization = errors.New("invalid authorization header format")
+	errInvalidAccessToken   = errors.New("invalid or expired token")
+	errSessionNotFound      = errors.New("session not found")
+	errSessionRevoked       = errors.New("session has been revoked")
+	errInvalidAPIKey        = errors.New("invalid, expired or revoked api key")
+)
+
+// isUnauthenticated reports whether err means the caller's credentials were
+// rejected, as opposed to a failure while checking them.
+func isUnauthenticated(err error) bool {
+	return errors.Is(err, errMissingAuthorization) ||
+		errors.Is(err, errInvalidAuthorization) ||
+		errors.Is(err, errInvalidAccessToken) ||
+		errors.Is(err, errSessionNotFound) ||
+		errors.Is(err, errSessionRevoked) ||
+		errors.Is(err, errInvalidAPIKey)
+}
+
+// authenticate verifies a "Bearer <token>" or "ApiKey <key>" authorization
+// value. It is shared by AuthMiddleware and the gRPC interceptors.
+func (app *App) authenticate(ctx context.Context, authorization string) (*token.Payload, error) {
+	if authorization == "" {
+		return nil, errMissingAuthorization
+	}
+
+	parts := strings.Split(authorization, " ")
+	if len(parts) != 2 {
+		return nil, errInvalidAuthorization
+	}
+
+	switch strings.ToLower(parts[0]) {
+	case bearer:
+		return app.authenticateAccessToken(ctx, parts[1])
+	case apiKeyScheme:
+		return app.authenticateAPIKey(ctx, parts[1])
+	default:
+		return nil, errInvalidAuthorization
+	}
+}
+
+// authenticateAccessToken verifies an access token and the session behind
+// it.
+func (app *App) authenticateAccessToken(ctx context.Context, accessToken string) (*token.Payload, error) {
+	payload, err := app.jwtMaker.VerifyToken(accessToken)
+	if err != nil || payload.TokenType != token.TokenTypeAccess {
+		return nil, errInvalidAccessToken
+	}
+
+	session, err := app.sessions.GetSession(ctx, payload.SessionID.String())
+	if err != nil {
+		if errors.Is(err, db.ErrSessionNotFound) {
+			return nil, errSessionNotFound
+		}
+
+		return nil, err
+	}
+
+	if session.IsRevoked() || session.UserID != payload.ID {
+		return nil, errSessionRevoked
+	}
+
+	return payload, nil
+}
+
 func (app *App) AuthMiddleware() fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		authorization := c.Get(authorizationHeader)
-		if authorization == "" {
-			return fiber.NewError(fiber.StatusUnauthorized, "missing authorization header")
+		payload, err := app.authenticate(c.UserContext(), c.Get(authorizationHeader))
+		if err != nil {
+			if isUnauthenticated(err) {
+				return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+			}
+
+			log.Println("cannot verify session:", err)
+			return storeError(err, fiber.StatusInternalServerError, "cannot verify session")
+		}
+
+		c.Locals(payloadHeader, payload)
+
+		return c.Next()
+	}
+}
+
+// RequireRole must run after AuthMiddleware. It lets the request through
+// when the token carries at least one of roles.
+func (app *App) RequireRole(roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		payload, ok := c.Locals(payloadHeader).(*token.Payload)
+		if !ok {
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
 		}
-		parts := strings.Split(authorization, " ")
-		if len(parts) != 2 || strings.ToLower(parts[0]) != bearer {
-			return fiber.NewError(fiber.StatusUnauthorized, "invalid authorization header format")
+
+		for _, role := range roles {
+			if payload.HasRole(role) {
+				return c.Next()
+			}
 		}
 
-		token := parts[1]
-		payload, err := app.jwtMaker.VerifyToken(token)
-		if err != nil {
-			return fiber.NewError(fiber.StatusUnauthorized, "invalid or expired token")
+		return fiber.NewError(fiber.StatusForbidden, "you do not have permission to access this resource")
+	}
+}
+
+// RequireScope must run after AuthMiddleware. API keys need scope to pass,
+// access tokens always pass.
+func (app *App) RequireScope(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		payload, ok := c.Locals(payloadHeader).(*token.Payload)
+		if !ok {
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
 		}
 
-		c.Locals(payloadHeader, payload)
+		if !payload.HasScope(scope) {
+			return fiber.NewError(fiber.StatusForbidden, fmt.Sprintf("api key is missing the %s scope", scope))
+		}
+
+		return c.Next()
+	}
+}
+
+// RequireSession must run after AuthMiddleware. It keeps API keys out of
+// endpoints that manage the user's own credentials and sessions.
+func (app *App) RequireSession() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		payload, ok := c.Locals(payloadHeader).(*token.Payload)
+		if !ok {
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
+		}
+
+		if payload.TokenType == token.TokenTypeAPIKey {
+			return fiber.NewError(fiber.StatusForbidden, "this endpoint cannot be used with an api key")
+		}
+
+		return c.Next()
+	}
+}
+
+// RequireAPIKey must run after AuthMiddleware. It lets only API keys
+// through, for endpoints meant for other services rather than people.
+func (app *App) RequireAPIKey() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		payload, ok := c.Locals(payloadHeader).(*token.Payload)
+		if !ok {
+			return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
+		}
+
+		if payload.TokenType != token.TokenTypeAPIKey {
+			return fiber.NewError(fiber.StatusForbidden, "this endpoint can only be used with an api key")
+		}
 
 		return c.Next()
 	}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/sangketkit01/7-coding-test/internal/db"
+)
+
+const migrateUsage = "usage: migrate up | down [steps] | status"
+
+// runMigrate is the migrate command, it changes the schema and exits
+// without serving.
+func runMigrate(migrator *db.Migrator, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, migration := range applied {
+			fmt.Printf("applied %d %s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid steps: %s", args[1])
+			}
+			steps = n
+		}
+
+		reverted, err := migrator.Down(ctx, steps)
+		for _, migration := range reverted {
+			fmt.Printf("reverted %d %s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			return err
+		}
+
+		if len(reverted) == 0 {
+			fmt.Println("no migration to revert")
+		}
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, status := range statuses {
+			state := "pending"
+			if status.AppliedAt != nil {
+				state = "applied " + status.AppliedAt.Local().Format(time.RFC3339)
+			}
+			if status.Unknown {
+				state += " (unknown to this build)"
+			}
+
+			fmt.Printf("%4d  %-30s %s\n", status.Version, status.Name, state)
+		}
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	return nil
+}
+
+// migrationLockRetry is how often a replica waiting on another one's
+// migrations checks again.
+const migrationLockRetry = 5 * time.Second
+
+// prepareSchema refuses to start on a schema that is behind. With
+// MIGRATE_ON_START the replicas migrate first, the one holding the lock
+// runs the migrations and the others wait for it.
+func prepareSchema(migrator *db.Migrator, migrateOnStart bool) error {
+	ctx := context.Background()
+
+	if migrateOnStart {
+		for {
+			applied, err := migrator.Up(ctx)
+			for _, migration := range applied {
+				log.Printf("applied migration %d %s\n", migration.Version, migration.Name)
+			}
+
+			if !errors.Is(err, db.ErrMigrationLocked) {
+				if err != nil {
+					return err
+				}
+				break
+			}
+
+			log.Println("waiting for another replica to finish migrating")
+			time.Sleep(migrationLockRetry)
+		}
+	}
+
+	return migrator.CheckSchema(ctx)
+}
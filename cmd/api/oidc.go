@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sangketkit01/7-coding-test/internal/config"
+	"github.com/sangketkit01/7-coding-test/internal/db"
+	"github.com/sangketkit01/7-coding-test/internal/oidc"
+	"github.com/sangketkit01/7-coding-test/internal/util"
+)
+
+// oidcStateExpiry is how long a user has to finish signing in at the
+// external provider.
+const oidcStateExpiry = 10 * time.Minute
+
+var (
+	errOIDCNoEmail    = errors.New("the provider did not return an email address")
+	errOIDCEmailTaken = errors.New("an account with this email already exists, sign in with your password instead")
+)
+
+func newOIDCProviders(providers []config.OIDCProvider) map[string]*oidc.Provider {
+	result := make(map[string]*oidc.Provider, len(providers))
+	for _, provider := range providers {
+		result[provider.Name] = oidc.NewProvider(oidc.Config{
+			Name:         provider.Name,
+			Issuer:       provider.Issuer,
+			ClientID:     provider.ClientID,
+			ClientSecret: provider.ClientSecret,
+			RedirectUrl:  provider.RedirectUrl,
+			Scopes:       provider.Scopes,
+		})
+	}
+
+	return result
+}
+
+// OIDCLogin redirects the user to the provider's authorization endpoint.
+// The state, nonce and PKCE verifier are kept server side until the
+// callback.
+func (app *App) OIDCLogin(c *fiber.Ctx) error {
+	provider, ok := app.oidcProviders[c.Params("provider")]
+	if !ok {
+		return fiber.NewError(fiber.StatusNotFound, "unknown login provider")
+	}
+
+	state, err := util.RandomToken(32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "cannot start login")
+	}
+
+	nonce, err := util.RandomToken(32)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "cannot start login")
+	}
+
+	codeVerifier, err := oidc.NewCodeVerifier()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "cannot start login")
+	}
+
+	authUrl, err := provider.AuthCodeURL(c.UserContext(), state, nonce, codeVerifier)
+	if err != nil {
+		log.Println(err)
+		return fiber.NewError(fiber.StatusBadGateway, "login provider is unavailable")
+	}
+
+	err = app.oidcStates.InsertOIDCState(c.UserContext(), db.OIDCState{
+		StateHash:    util.HashToken(state),
+		Provider:     provider.Name(),
+		Nonce:        nonce,
+		CodeVerifier: codeVerifier,
+		ExpiresAt:    time.Now().Add(oidcStateExpiry),
+	})
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot start login")
+	}
+
+	return c.Redirect(authUrl, fiber.StatusFound)
+}
+
+// OIDCCallback finishes the authorization code flow and logs the linked
+// user in with our own tokens.
+func (app *App) OIDCCallback(c *fiber.Ctx) error {
+	provider, ok := app.oidcProviders[c.Params("provider")]
+	if !ok {
+		return fiber.NewError(fiber.StatusNotFound, "unknown login provider")
+	}
+
+	if providerError := c.Query("error"); providerError != "" {
+		return fiber.NewError(fiber.StatusBadRequest, "login was not completed: "+providerError)
+	}
+
+	code, state := c.Query("code"), c.Query("state")
+	if code == "" || state == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "code and state are required")
+	}
+
+	loginState, err := app.oidcStates.ConsumeOIDCState(c.UserContext(), util.HashToken(state))
+	if err != nil {
+		if errors.Is(err, db.ErrOIDCStateInvalid) {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		return storeError(err, fiber.StatusInternalServerError, "cannot complete login")
+	}
+
+	if loginState.Provider != provider.Name() {
+		return fiber.NewError(fiber.StatusBadRequest, db.ErrOIDCStateInvalid.Error())
+	}
+
+	tokenResponse, err := provider.Exchange(c.UserContext(), code, loginState.CodeVerifier)
+	if err != nil {
+		log.Printf("oidc code exchange with %s failed: %v\n", provider.Name(), err)
+		return fiber.NewError(fiber.StatusUnauthorized, "cannot complete login with the provider")
+	}
+
+	claims, err := provider.VerifyIDToken(c.UserContext(), tokenResponse.IDToken, loginState.Nonce)
+	if err != nil {
+		log.Printf("oidc id token from %s rejected: %v\n", provider.Name(), err)
+		return fiber.NewError(fiber.StatusUnauthorized, "cannot complete login with the provider")
+	}
+
+	user, err := app.oidcUser(c, provider.Name(), claims)
+	if err != nil {
+		if errors.Is(err, errOIDCNoEmail) || errors.Is(err, errOIDCEmailTaken) || errors.Is(err, db.ErrIdentityAlreadyLinked) {
+			return fiber.NewError(fiber.StatusConflict, err.Error())
+		}
+
+		return storeError(err, fiber.StatusInternalServerError, err.Error())
+	}
+
+	return app.completeLogin(c, user, nil, "oidc:"+provider.Name())
+}
+
+// oidcUser returns the user linked to the external identity. An identity
+// seen for the first time is linked to the account with the same email when
+// the provider has verified that email, otherwise a new account is created.
+func (app *App) oidcUser(c *fiber.Ctx, provider string, claims *oidc.Claims) (*db.User, error) {
+	user, err := app.model.GetUserByIdentity(c.UserContext(), provider, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if user != nil {
+		return user, nil
+	}
+
+	if claims.Email == "" {
+		return nil, errOIDCNoEmail
+	}
+
+	identity := db.Identity{
+		Provider: provider,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	}
+
+	existing, err := app.model.GetUserByEmail(c.UserContext(), claims.Email)
+	if err != nil && !errors.Is(err, db.ErrUserNotFound) {
+		return nil, err
+	}
+
+	if existing != nil {
+		if !claims.EmailVerified {
+			return nil, errOIDCEmailTaken
+		}
+
+		if err := app.model.LinkIdentity(c.UserContext(), existing.ID, identity); err != nil {
+			return nil, err
+		}
+
+		app.recordUserChange(c, db.AuditUserUpdate, existing)
+
+		return existing, nil
+	}
+
+	// Accounts created here have no usable password until the user resets
+	// it.
+	password, err := util.RandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	name := claims.Name
+	if name == "" {
+		name = claims.Email
+	}
+
+	user, err = app.model.Insert(c.UserContext(), db.User{
+		Name:     name,
+		Email:    claims.Email,
+		Password: password,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	event := newAuditEvent(c, db.AuditUserCreate, user.ID)
+	event.Changes = db.DiffUsers(nil, user)
+	event.SetMetadata("provider", provider)
+	app.audit.Record(event)
+
+	if claims.EmailVerified {
+		if err := app.model.MarkEmailVerified(c.UserContext(), user.ID, user.Email); err != nil {
+			return nil, err
+		}
+		user.EmailVerified = true
+	}
+
+	if err := app.model.LinkIdentity(c.UserContext(), user.ID, identity); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
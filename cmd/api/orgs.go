@@ -0,0 +1,660 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/sangketkit01/7-coding-test/internal/db"
+	"github.com/sangketkit01/7-coding-test/internal/token"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var orgSlugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// canReadUser decides whether the caller may look up target. Everyone may
+// read themselves. With an active organization other users are only found
+// when they are members of it, and its admins may read them as well.
+func canReadUser(payload *token.Payload, target *db.User) bool {
+	if target.ID == payload.ID {
+		return true
+	}
+
+	if payload.OrgID == nil {
+		return payload.HasRole(db.RoleAdmin)
+	}
+
+	if target.Membership(*payload.OrgID) == nil {
+		return false
+	}
+
+	return payload.HasRole(db.RoleAdmin) || db.IsOrgAdminRole(payload.OrgRole)
+}
+
+// tenantBySlug resolves the optional organization of a request made before
+// login. An empty slug is no organization.
+func (app *App) tenantBySlug(ctx context.Context, slug string) (*primitive.ObjectID, error) {
+	if slug == "" {
+		return nil, nil
+	}
+
+	org, err := app.orgs.GetOrganizationBySlug(ctx, slug)
+	if err != nil {
+		return nil, err
+	}
+
+	return &org.ID, nil
+}
+
+// orgAccess loads the organization of the route and checks that the caller
+// holds at least minRole in it. The role is read from the database, not the
+// token, so changes apply at once. Admins act as owners of every
+// organization.
+func (app *App) orgAccess(c *fiber.Ctx, minRole string) (*db.Organization, string, error) {
+	payload, ok := c.Locals(payloadHeader).(*token.Payload)
+	if !ok {
+		return nil, "", fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
+	}
+
+	orgID, err := primitive.ObjectIDFromHex(c.Params("orgId"))
+	if err != nil {
+		return nil, "", fiber.NewError(fiber.StatusBadRequest, "invalid organization id")
+	}
+
+	org, err := app.orgs.GetOrganization(c.UserContext(), orgID)
+	if err != nil {
+		if errors.Is(err, db.ErrOrganizationNotFound) {
+			return nil, "", fiber.NewError(fiber.StatusNotFound, err.Error())
+		}
+
+		return nil, "", storeError(err, fiber.StatusInternalServerError, "cannot load organization")
+	}
+
+	caller, err := app.model.FetchUserByID(c.UserContext(), payload.ID.Hex())
+	if err != nil {
+		return nil, "", storeError(err, fiber.StatusInternalServerError, "cannot load user")
+	}
+
+	role := ""
+	if membership := caller.Membership(org.ID); membership != nil {
+		role = membership.Role
+	}
+
+	if payload.HasRole(db.RoleAdmin) {
+		role = db.OrgRoleOwner
+	}
+
+	if role == "" {
+		// outsiders do not learn that the organization exists
+		return nil, "", fiber.NewError(fiber.StatusNotFound, db.ErrOrganizationNotFound.Error())
+	}
+
+	if db.OrgRoleRank(role) < db.OrgRoleRank(minRole) {
+		return nil, "", fiber.NewError(fiber.StatusForbidden, fmt.Sprintf("this action needs the %s role in the organization", minRole))
+	}
+
+	return org, role, nil
+}
+
+// recordOrgEvent records action on an organization itself.
+func (app *App) recordOrgEvent(c *fiber.Ctx, action string, org *db.Organization, changes ...db.FieldChange) {
+	event := newAuditEvent(c, action, primitive.NilObjectID)
+	event.Changes = changes
+	event.SetMetadata("org_id", org.ID.Hex())
+	event.SetMetadata("org_slug", org.Slug)
+
+	app.audit.Record(event)
+}
+
+// recordMembershipChange is recordUserChange for a membership of org.
+func (app *App) recordMembershipChange(c *fiber.Ctx, action string, org *db.Organization, before *db.User) {
+	event := app.userChangeEvent(c, action, before)
+	event.SetMetadata("org_id", org.ID.Hex())
+
+	app.audit.Record(event)
+}
+
+type OrganizationResponse struct {
+	*db.Organization
+	Role string `json:"role"`
+}
+
+type CreateOrganizationRequest struct {
+	Name string `json:"name" validate:"required,max=100"`
+	Slug string `json:"slug" validate:"required,min=2,max=50"`
+}
+
+// CreateOrganization creates an organization with the caller as its owner.
+func (app *App) CreateOrganization(c *fiber.Ctx) error {
+	payload, ok := c.Locals(payloadHeader).(*token.Payload)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
+	}
+
+	var req CreateOrganizationRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid organization request")
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	if !orgSlugPattern.MatchString(req.Slug) {
+		return fiber.NewError(fiber.StatusBadRequest, "slug may only contain lowercase letters, digits and single dashes")
+	}
+
+	org, err := app.orgs.InsertOrganization(c.UserContext(), db.Organization{
+		Name: req.Name,
+		Slug: req.Slug,
+	})
+	if err != nil {
+		if errors.Is(err, db.ErrOrganizationSlugTaken) {
+			return fiber.NewError(fiber.StatusConflict, err.Error())
+		}
+
+		return storeError(err, fiber.StatusInternalServerError, "cannot create organization")
+	}
+
+	caller, err := app.model.FetchUserByID(c.UserContext(), payload.ID.Hex())
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot load user")
+	}
+
+	if err := app.model.AddMembership(c.UserContext(), caller.ID, db.Membership{OrgID: org.ID, Role: db.OrgRoleOwner}); err != nil {
+		// the request may have timed out, the clean up gets its own context
+		if err := app.orgs.DeleteOrganization(context.Background(), org.ID); err != nil {
+			log.Printf("cannot clean up organization %s: %v\n", org.ID.Hex(), err)
+		}
+
+		return storeError(err, fiber.StatusInternalServerError, "cannot create organization")
+	}
+
+	app.recordOrgEvent(c, db.AuditOrgCreate, org)
+	app.recordMembershipChange(c, db.AuditOrgMemberAdd, org, caller)
+
+	return c.Status(fiber.StatusCreated).JSON(OrganizationResponse{Organization: org, Role: db.OrgRoleOwner})
+}
+
+// ListOrganizations returns the organizations the caller is a member of.
+func (app *App) ListOrganizations(c *fiber.Ctx) error {
+	payload, ok := c.Locals(payloadHeader).(*token.Payload)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
+	}
+
+	caller, err := app.model.FetchUserByID(c.UserContext(), payload.ID.Hex())
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot load user")
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(caller.Memberships))
+	for _, membership := range caller.Memberships {
+		ids = append(ids, membership.OrgID)
+	}
+
+	orgs, err := app.orgs.ListOrganizations(c.UserContext(), ids)
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot list organizations")
+	}
+
+	response := make([]OrganizationResponse, 0, len(orgs))
+	for _, org := range orgs {
+		response = append(response, OrganizationResponse{Organization: org, Role: caller.Membership(org.ID).Role})
+	}
+
+	return c.JSON(fiber.Map{"organizations": response})
+}
+
+func (app *App) GetOrganization(c *fiber.Ctx) error {
+	org, role, err := app.orgAccess(c, db.OrgRoleMember)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(OrganizationResponse{Organization: org, Role: role})
+}
+
+type UpdateOrganizationRequest struct {
+	Name string `json:"name" validate:"required,max=100"`
+}
+
+// UpdateOrganization renames an organization. The slug never changes, it
+// is what users type to sign in.
+func (app *App) UpdateOrganization(c *fiber.Ctx) error {
+	org, role, err := app.orgAccess(c, db.OrgRoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	var req UpdateOrganizationRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid organization request")
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	if err := app.orgs.UpdateOrganization(c.UserContext(), org.ID, req.Name); err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot update organization")
+	}
+
+	before := *org
+	org.Name = req.Name
+
+	app.recordOrgEvent(c, db.AuditOrgUpdate, org, db.NewFieldChange("name", before.Name, org.Name))
+
+	return c.JSON(OrganizationResponse{Organization: org, Role: role})
+}
+
+// DeleteOrganization only deletes an organization its owner has emptied,
+// so no member loses access without being removed first.
+func (app *App) DeleteOrganization(c *fiber.Ctx) error {
+	org, _, err := app.orgAccess(c, db.OrgRoleOwner)
+	if err != nil {
+		return err
+	}
+
+	members, err := app.model.ListOrgMembers(c.UserContext(), org.ID)
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot list organization members")
+	}
+
+	if len(members) > 1 {
+		return fiber.NewError(fiber.StatusConflict, "remove the other members before deleting the organization")
+	}
+
+	for _, member := range members {
+		if err := app.model.RemoveMembership(c.UserContext(), member.ID, org.ID); err != nil && !errors.Is(err, db.ErrNotMember) {
+			return storeError(err, fiber.StatusInternalServerError, "cannot delete organization")
+		}
+
+		app.recordMembershipChange(c, db.AuditOrgMemberRemove, org, member)
+	}
+
+	if err := app.orgs.DeleteOrganization(c.UserContext(), org.ID); err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot delete organization")
+	}
+
+	app.recordOrgEvent(c, db.AuditOrgDelete, org)
+
+	return c.JSON(fiber.Map{"message": "Delete organization successfully."})
+}
+
+type MemberResponse struct {
+	ID       primitive.ObjectID `json:"id"`
+	Name     string             `json:"name"`
+	Email    string             `json:"email"`
+	Role     string             `json:"role"`
+	JoinedAt time.Time          `json:"joined_at"`
+}
+
+func newMemberResponse(user *db.User, membership *db.Membership) MemberResponse {
+	return MemberResponse{
+		ID:       user.ID,
+		Name:     user.Name,
+		Email:    user.Email,
+		Role:     membership.Role,
+		JoinedAt: membership.JoinedAt,
+	}
+}
+
+func (app *App) ListOrganizationMembers(c *fiber.Ctx) error {
+	org, _, err := app.orgAccess(c, db.OrgRoleMember)
+	if err != nil {
+		return err
+	}
+
+	members, err := app.model.ListOrgMembers(c.UserContext(), org.ID)
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot list organization members")
+	}
+
+	response := make([]MemberResponse, 0, len(members))
+	for _, member := range members {
+		response = append(response, newMemberResponse(member, member.Membership(org.ID)))
+	}
+
+	return c.JSON(fiber.Map{"members": response})
+}
+
+type AddMemberRequest struct {
+	UserID string `json:"user_id" validate:"required_without=Email"`
+	Email  string `json:"email" validate:"omitempty,email"`
+	Role   string `json:"role" validate:"required"`
+}
+
+// AddOrganizationMember adds an existing account to the organization. No
+// one can hand out a role above their own.
+func (app *App) AddOrganizationMember(c *fiber.Ctx) error {
+	org, callerRole, err := app.orgAccess(c, db.OrgRoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	var req AddMemberRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid member request")
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	if err := checkOrgRoleGrant(callerRole, req.Role); err != nil {
+		return err
+	}
+
+	var user *db.User
+	if req.UserID != "" {
+		user, err = app.model.FetchUserByID(c.UserContext(), req.UserID)
+	} else {
+		user, err = app.model.GetUserByEmail(c.UserContext(), req.Email)
+	}
+	if err != nil {
+		return storeError(err, fiber.StatusNotFound, "user not found")
+	}
+
+	if user.ServiceAccount {
+		return fiber.NewError(fiber.StatusBadRequest, "service accounts cannot join organizations")
+	}
+
+	if err := app.model.AddMembership(c.UserContext(), user.ID, db.Membership{OrgID: org.ID, Role: req.Role}); err != nil {
+		if errors.Is(err, db.ErrAlreadyMember) {
+			return storeError(err, fiber.StatusConflict, err.Error())
+		}
+
+		return storeError(err, fiber.StatusInternalServerError, "cannot add member")
+	}
+
+	app.recordMembershipChange(c, db.AuditOrgMemberAdd, org, user)
+
+	added, err := app.model.FetchUserByID(c.UserContext(), user.ID.Hex())
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot load member")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(newMemberResponse(added, added.Membership(org.ID)))
+}
+
+type CreateOrganizationUserRequest struct {
+	Name     string `json:"name" validate:"required"`
+	Email    string `json:"email" validate:"required,email"`
+	Password string `json:"password" validate:"required"`
+	Role     string `json:"role"`
+}
+
+// CreateOrganizationUser creates an account owned by the organization.
+// When emails are unique per tenant, its email may also be in use by other
+// organizations.
+func (app *App) CreateOrganizationUser(c *fiber.Ctx) error {
+	org, callerRole, err := app.orgAccess(c, db.OrgRoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	var req CreateOrganizationUserRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid user request")
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	if req.Role == "" {
+		req.Role = db.OrgRoleMember
+	}
+
+	if err := checkOrgRoleGrant(callerRole, req.Role); err != nil {
+		return err
+	}
+
+	if err := app.passwordPolicy.Validate(req.Password); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	user, err := app.model.Insert(c.UserContext(), db.User{
+		Name:        req.Name,
+		Email:       req.Email,
+		Password:    req.Password,
+		TenantID:    &org.ID,
+		Memberships: []db.Membership{{OrgID: org.ID, Role: req.Role, JoinedAt: time.Now()}},
+	})
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	event := newAuditEvent(c, db.AuditUserCreate, user.ID)
+	event.Changes = db.DiffUsers(nil, user)
+	event.SetMetadata("org_id", org.ID.Hex())
+	app.audit.Record(event)
+
+	if err := app.verifier.SendVerification(c.UserContext(), user); err != nil {
+		log.Printf("failed to send verification email: %v\n", err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(newMemberResponse(user, user.Membership(org.ID)))
+}
+
+type UpdateMemberRequest struct {
+	Role string `json:"role" validate:"required"`
+}
+
+func (app *App) UpdateOrganizationMember(c *fiber.Ctx) error {
+	org, callerRole, err := app.orgAccess(c, db.OrgRoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	var req UpdateMemberRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid member request")
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	if err := checkOrgRoleGrant(callerRole, req.Role); err != nil {
+		return err
+	}
+
+	member, membership, err := app.orgMember(c, org)
+	if err != nil {
+		return err
+	}
+
+	if db.OrgRoleRank(membership.Role) > db.OrgRoleRank(callerRole) {
+		return fiber.NewError(fiber.StatusForbidden, "you cannot change the role of a member above you")
+	}
+
+	if err := app.checkLastOwner(c.UserContext(), org, membership, req.Role); err != nil {
+		return err
+	}
+
+	if err := app.model.UpdateMembershipRole(c.UserContext(), member.ID, org.ID, req.Role); err != nil {
+		if errors.Is(err, db.ErrNotMember) {
+			return storeError(err, fiber.StatusNotFound, err.Error())
+		}
+
+		return storeError(err, fiber.StatusInternalServerError, "cannot update member")
+	}
+
+	app.recordMembershipChange(c, db.AuditOrgMemberUpdate, org, member)
+
+	// the old role must not live on in tokens that were issued before
+	if _, err := app.sessions.RevokeUserOrgSessions(c.UserContext(), member.ID, org.ID); err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot revoke member sessions")
+	}
+
+	membership.Role = req.Role
+
+	return c.JSON(newMemberResponse(member, membership))
+}
+
+// RemoveOrganizationMember removes a member. Members may always leave on
+// their own.
+func (app *App) RemoveOrganizationMember(c *fiber.Ctx) error {
+	payload, ok := c.Locals(payloadHeader).(*token.Payload)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
+	}
+
+	minRole := db.OrgRoleAdmin
+	if c.Params("userId") == payload.ID.Hex() {
+		minRole = db.OrgRoleMember
+	}
+
+	org, callerRole, err := app.orgAccess(c, minRole)
+	if err != nil {
+		return err
+	}
+
+	member, membership, err := app.orgMember(c, org)
+	if err != nil {
+		return err
+	}
+
+	if member.ID != payload.ID && db.OrgRoleRank(membership.Role) > db.OrgRoleRank(callerRole) {
+		return fiber.NewError(fiber.StatusForbidden, "you cannot remove a member above you")
+	}
+
+	if err := app.checkLastOwner(c.UserContext(), org, membership, ""); err != nil {
+		return err
+	}
+
+	if err := app.model.RemoveMembership(c.UserContext(), member.ID, org.ID); err != nil {
+		if errors.Is(err, db.ErrNotMember) {
+			return storeError(err, fiber.StatusNotFound, err.Error())
+		}
+
+		return storeError(err, fiber.StatusInternalServerError, "cannot remove member")
+	}
+
+	app.recordMembershipChange(c, db.AuditOrgMemberRemove, org, member)
+
+	if _, err := app.sessions.RevokeUserOrgSessions(c.UserContext(), member.ID, org.ID); err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot revoke member sessions")
+	}
+
+	return c.JSON(fiber.Map{"message": "Remove member successfully."})
+}
+
+type SwitchOrganizationResponse struct {
+	Token     string             `json:"token"`
+	OrgID     primitive.ObjectID `json:"org_id"`
+	OrgRole   string             `json:"org_role"`
+	IssuedAt  time.Time          `json:"issued_at"`
+	ExpiredAt time.Time          `json:"expired_at"`
+}
+
+// SwitchOrganization makes the organization the active one of the caller's
+// session. The new access token replaces the old one, refreshed tokens stay
+// in the organization.
+func (app *App) SwitchOrganization(c *fiber.Ctx) error {
+	payload, ok := c.Locals(payloadHeader).(*token.Payload)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
+	}
+
+	orgID, err := primitive.ObjectIDFromHex(c.Params("orgId"))
+	if err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid organization id")
+	}
+
+	user, err := app.model.FetchUserByID(c.UserContext(), payload.ID.Hex())
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot load user")
+	}
+
+	// admins manage every organization but only work in their own
+	membership := user.Membership(orgID)
+	if membership == nil {
+		return fiber.NewError(fiber.StatusNotFound, db.ErrOrganizationNotFound.Error())
+	}
+
+	if err := app.sessions.SetSessionOrg(c.UserContext(), payload.SessionID.String(), orgID); err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot switch organization")
+	}
+
+	newToken, newPayload, err := app.tokens.ReissueAccessToken(
+		user, payload.SessionID, &orgID, membership.Role, c.Get(fiber.HeaderUserAgent), c.IP())
+	if err != nil {
+		log.Printf("create token failed: %v\n", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "cannot create new token")
+	}
+
+	return c.JSON(SwitchOrganizationResponse{
+		Token:     newToken,
+		OrgID:     orgID,
+		OrgRole:   membership.Role,
+		IssuedAt:  newPayload.IssuedAt,
+		ExpiredAt: newPayload.ExpiredAt,
+	})
+}
+
+// orgMember loads the member of the route's userId.
+func (app *App) orgMember(c *fiber.Ctx, org *db.Organization) (*db.User, *db.Membership, error) {
+	member, err := app.model.FetchUserByID(c.UserContext(), c.Params("userId"))
+	if err != nil {
+		return nil, nil, fiber.NewError(fiber.StatusNotFound, db.ErrNotMember.Error())
+	}
+
+	membership := member.Membership(org.ID)
+	if membership == nil {
+		return nil, nil, fiber.NewError(fiber.StatusNotFound, db.ErrNotMember.Error())
+	}
+
+	return member, membership, nil
+}
+
+// checkOrgRoleGrant refuses unknown roles and roles above the caller's.
+func checkOrgRoleGrant(callerRole, role string) error {
+	if !db.IsValidOrgRole(role) {
+		return fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("unknown organization role: %s", role))
+	}
+
+	if db.OrgRoleRank(role) > db.OrgRoleRank(callerRole) {
+		return fiber.NewError(fiber.StatusForbidden, "you cannot grant a role above your own")
+	}
+
+	return nil
+}
+
+// checkLastOwner keeps an organization from losing its last owner when
+// membership changes to newRole, empty for a removal.
+func (app *App) checkLastOwner(ctx context.Context, org *db.Organization, membership *db.Membership, newRole string) error {
+	if membership.Role != db.OrgRoleOwner || newRole == db.OrgRoleOwner {
+		return nil
+	}
+
+	members, err := app.model.ListOrgMembers(ctx, org.ID)
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot list organization members")
+	}
+
+	owners := 0
+	for _, member := range members {
+		if m := member.Membership(org.ID); m != nil && m.Role == db.OrgRoleOwner {
+			owners++
+		}
+	}
+
+	if owners <= 1 {
+		return fiber.NewError(fiber.StatusConflict, "an organization needs at least one owner")
+	}
+
+	return nil
+}
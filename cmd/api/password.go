@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/sangketkit01/7-coding-test/internal/db"
+	"github.com/sangketkit01/7-coding-test/internal/mail"
+	"github.com/sangketkit01/7-coding-test/internal/policy"
+	"github.com/sangketkit01/7-coding-test/internal/token"
+	"github.com/sangketkit01/7-coding-test/internal/util"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var errCurrentPasswordIncorrect = errors.New("current password is incorrect")
+
+// passwordChanger changes the password of a signed-in user. It is shared by
+// the HTTP handler and the gRPC service.
+type passwordChanger struct {
+	users    db.MongoClient
+	sessions db.SessionStore
+	policy   *policy.PasswordPolicy
+}
+
+// Change checks the current password, stores the new one and revokes every
+// session of the user except keepSessionID. It returns how many sessions
+// were revoked.
+func (changer *passwordChanger) Change(ctx context.Context, userID primitive.ObjectID, keepSessionID, currentPassword, newPassword string) (int64, error) {
+	user, err := changer.users.FetchUserByID(ctx, userID.Hex())
+	if err != nil {
+		return 0, err
+	}
+
+	if err := util.CheckPassword(user.Password, currentPassword); err != nil {
+		return 0, errCurrentPasswordIncorrect
+	}
+
+	if err := changer.policy.Validate(newPassword); err != nil {
+		return 0, err
+	}
+
+	if err := changer.policy.CheckReuse(newPassword, user.Password, user.PasswordHistory); err != nil {
+		return 0, err
+	}
+
+	hashedPassword, err := util.HashPassword(newPassword)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := changer.users.UpdatePassword(ctx, user.ID.Hex(), hashedPassword, changer.policy.HistorySize()); err != nil {
+		return 0, err
+	}
+
+	return changer.sessions.RevokeOtherUserSessions(ctx, user.ID, keepSessionID)
+}
+
+// isPasswordChangeRejected reports whether err means the request was
+// refused, as opposed to a failure while handling it.
+func isPasswordChangeRejected(err error) bool {
+	var policyErr *policy.PasswordError
+	return errors.Is(err, errCurrentPasswordIncorrect) ||
+		errors.Is(err, policy.ErrPasswordReused) ||
+		errors.As(err, &policyErr)
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email"`
+	Org   string `json:"org"`
+}
+
+// ForgotPassword always answers the same way, whether or not the email
+// belongs to an account, so it cannot be used to discover users.
+func (app *App) ForgotPassword(c *fiber.Ctx) error {
+	var req ForgotPasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid forgot password request")
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	response := fiber.Map{"message": "If the email exists, a password reset link has been sent."}
+
+	tenantID, err := app.tenantBySlug(c.UserContext(), req.Org)
+	if err != nil {
+		return c.JSON(response)
+	}
+
+	user, err := app.model.GetUserByEmailInTenant(c.UserContext(), req.Email, tenantID)
+	if err != nil {
+		return c.JSON(response)
+	}
+
+	// The token is stored and sent in the background, a known email then
+	// takes no longer to answer than an unknown one and a failure does not
+	// tell them apart either.
+	go app.sendPasswordReset(user)
+
+	return c.JSON(response)
+}
+
+// sendPasswordReset runs after the response, so it gets its own deadline
+// rather than the request's.
+func (app *App) sendPasswordReset(user *db.User) {
+	ctx, cancel := context.WithTimeout(context.Background(), app.config.DBWriteTimeout)
+	defer cancel()
+
+	resetToken, err := util.RandomToken(32)
+	if err != nil {
+		log.Println("failed to create password reset token:", err)
+		return
+	}
+
+	err = app.passwordResets.InsertPasswordReset(ctx, db.PasswordReset{
+		TokenHash: util.HashToken(resetToken),
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(app.config.PasswordResetExpiry),
+	})
+	if err != nil {
+		log.Println("failed to store password reset token:", err)
+		return
+	}
+
+	link := fmt.Sprintf("%s/password/reset?token=%s", app.config.AppBaseUrl, url.QueryEscape(resetToken))
+	msg := mail.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nUse the link below to reset your password. It expires in %s and works only once.\n\n%s\n\nIf you did not ask for this, you can ignore this email.",
+			user.Name, app.config.PasswordResetExpiry, link),
+	}
+
+	if err := app.mailer.Send(msg); err != nil {
+		log.Println("failed to send password reset email:", err)
+	}
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token" validate:"required"`
+	NewPassword string `json:"new_password" validate:"required"`
+}
+
+func (app *App) ResetPassword(c *fiber.Ctx) error {
+	var req ResetPasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid reset password request")
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	if err := app.passwordPolicy.Validate(req.NewPassword); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	tokenHash := util.HashToken(req.Token)
+
+	// Look the token up first, so a password that is refused below does not
+	// use up the link.
+	reset, err := app.passwordResets.GetPasswordReset(c.UserContext(), tokenHash)
+	if err != nil {
+		if errors.Is(err, db.ErrPasswordResetInvalid) {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		return storeError(err, fiber.StatusInternalServerError, "cannot reset password")
+	}
+
+	user, err := app.model.FetchUserByID(c.UserContext(), reset.UserID.Hex())
+	if err != nil {
+		return storeError(err, fiber.StatusBadRequest, db.ErrPasswordResetInvalid.Error())
+	}
+
+	if err := app.passwordPolicy.CheckReuse(req.NewPassword, user.Password, user.PasswordHistory); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	if _, err := app.passwordResets.ConsumePasswordReset(c.UserContext(), tokenHash); err != nil {
+		if errors.Is(err, db.ErrPasswordResetInvalid) {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		return storeError(err, fiber.StatusInternalServerError, "cannot reset password")
+	}
+
+	hashedPassword, err := util.HashPassword(req.NewPassword)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "failed to hash password")
+	}
+
+	if err := app.model.UpdatePassword(c.UserContext(), reset.UserID.Hex(), hashedPassword, app.passwordPolicy.HistorySize()); err != nil {
+		return storeError(err, fiber.StatusInternalServerError, err.Error())
+	}
+
+	if _, err := app.sessions.RevokeUserSessions(c.UserContext(), reset.UserID); err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot revoke user sessions")
+	}
+
+	app.audit.Record(newAuditEvent(c, db.AuditPasswordReset, reset.UserID))
+
+	return c.JSON(fiber.Map{"message": "Reset password successfully."})
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required"`
+}
+
+func (app *App) ChangePassword(c *fiber.Ctx) error {
+	payload, ok := c.Locals(payloadHeader).(*token.Payload)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid payload")
+	}
+
+	var req ChangePasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid change password request")
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	revoked, err := app.passwords.Change(c.UserContext(), payload.ID, payload.SessionID.String(), req.CurrentPassword, req.NewPassword)
+	if err != nil {
+		if isPasswordChangeRejected(err) {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		log.Printf("change password failed: %v\n", err)
+		return storeError(err, fiber.StatusInternalServerError, "cannot change password")
+	}
+
+	app.audit.Record(newAuditEvent(c, db.AuditPasswordChange, payload.ID))
+
+	return c.JSON(fiber.Map{
+		"message":          "Change password successfully.",
+		"revoked_sessions": revoked,
+	})
+}
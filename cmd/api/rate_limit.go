@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sangketkit01/7-coding-test/internal/config"
+	"github.com/sangketkit01/7-coding-test/internal/db"
+	"github.com/sangketkit01/7-coding-test/internal/ratelimit"
+	"github.com/sangketkit01/7-coding-test/internal/token"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Route groups with their own rate limit.
+const (
+	rateLimitPublic = "public"
+	rateLimitAuth   = "auth"
+	rateLimitAdmin  = "admin"
+	rateLimitGRPC   = "grpc"
+)
+
+// What a rate limit counts requests by.
+const (
+	rateLimitByIP     = "ip"
+	rateLimitByUser   = "user"
+	rateLimitByAPIKey = "api_key"
+)
+
+// rateLimiter applies the limit of one route group.
+type rateLimiter struct {
+	group string
+	store ratelimit.Store
+	limit ratelimit.Limit
+	keyBy string
+}
+
+// newRateLimiters builds the limiter of every route group. Groups without a
+// limit are left out.
+func newRateLimiters(config *config.Config) (map[string]*rateLimiter, error) {
+	var store ratelimit.Store
+
+	switch config.RateLimitStore {
+	case "", "memory":
+		store = ratelimit.NewMemoryStore()
+	case "mongo":
+		if client == nil {
+			return nil, fmt.Errorf("rate limit store mongo needs STORE=mongo")
+		}
+		store = db.NewRateLimitStore(client)
+	default:
+		return nil, fmt.Errorf("unknown rate limit store: %s", config.RateLimitStore)
+	}
+
+	groups := []struct {
+		name, limit, keyBy string
+	}{
+		{rateLimitPublic, config.RateLimitPublic, config.RateLimitPublicKey},
+		{rateLimitAuth, config.RateLimitAuth, config.RateLimitAuthKey},
+		{rateLimitAdmin, config.RateLimitAdmin, config.RateLimitAdminKey},
+		{rateLimitGRPC, config.RateLimitGRPC, config.RateLimitGRPCKey},
+	}
+
+	limiters := make(map[string]*rateLimiter)
+	for _, group := range groups {
+		limit, err := ratelimit.ParseLimit(group.limit)
+		if err != nil {
+			return nil, fmt.Errorf("%s rate limit: %w", group.name, err)
+		}
+
+		if limit.IsZero() {
+			continue
+		}
+
+		switch group.keyBy {
+		case rateLimitByIP, rateLimitByUser, rateLimitByAPIKey:
+		default:
+			return nil, fmt.Errorf("%s rate limit cannot be keyed by %q", group.name, group.keyBy)
+		}
+
+		limiters[group.name] = &rateLimiter{
+			group: group.name,
+			store: store,
+			limit: limit,
+			keyBy: group.keyBy,
+		}
+	}
+
+	return limiters, nil
+}
+
+// key picks the bucket of a request. Requests without a token are always
+// counted by IP, and requests without an API key by user.
+func (limiter *rateLimiter) key(ip string, payload *token.Payload) string {
+	switch {
+	case limiter.keyBy == rateLimitByAPIKey && payload != nil && payload.APIKeyID != "":
+		return limiter.group + ":api_key:" + payload.APIKeyID
+	case limiter.keyBy != rateLimitByIP && payload != nil:
+		return limiter.group + ":user:" + payload.ID.Hex()
+	default:
+		return limiter.group + ":ip:" + ip
+	}
+}
+
+// Take spends a token of the request's bucket. When the store fails the
+// request is let through, a broken limiter should not take the service
+// down with it.
+func (limiter *rateLimiter) Take(ctx context.Context, ip string, payload *token.Payload) (ratelimit.Result, bool) {
+	result, err := limiter.store.Take(ctx, limiter.key(ip, payload), limiter.limit, time.Now())
+	if err != nil {
+		log.Printf("%s rate limit failed: %v\n", limiter.group, err)
+		return ratelimit.Result{}, false
+	}
+
+	return result, true
+}
+
+// headers returns the RateLimit-* fields of the IETF draft, plus
+// Retry-After when the request was refused.
+func (limiter *rateLimiter) headers(result ratelimit.Result) map[string]string {
+	headers := map[string]string{
+		"RateLimit-Limit":     strconv.Itoa(result.Limit),
+		"RateLimit-Remaining": strconv.Itoa(result.Remaining),
+		"RateLimit-Reset":     strconv.Itoa(ceilSeconds(result.ResetAfter)),
+		"RateLimit-Policy":    fmt.Sprintf("%d;w=%d", limiter.limit.Requests, ceilSeconds(limiter.limit.Period)),
+	}
+
+	if !result.Allowed {
+		headers[fiber.HeaderRetryAfter] = strconv.Itoa(ceilSeconds(result.RetryAfter))
+	}
+
+	return headers
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// RateLimit limits the requests of a route group. It must run after
+// AuthMiddleware to count by user or API key.
+func (app *App) RateLimit(group string) fiber.Handler {
+	limiter := app.rateLimiters[group]
+
+	return func(c *fiber.Ctx) error {
+		if limiter == nil {
+			return c.Next()
+		}
+
+		payload, _ := c.Locals(payloadHeader).(*token.Payload)
+
+		result, ok := limiter.Take(c.UserContext(), c.IP(), payload)
+		if !ok {
+			return c.Next()
+		}
+
+		for name, value := range limiter.headers(result) {
+			c.Set(name, value)
+		}
+
+		if !result.Allowed {
+			return fiber.NewError(fiber.StatusTooManyRequests, "too many requests, try again later")
+		}
+
+		return c.Next()
+	}
+}
+
+// checkGRPCRateLimit applies the gRPC limit to a call. It runs after the
+// auth interceptors, so ctx carries the payload of authenticated calls.
+func (app *App) checkGRPCRateLimit(ctx context.Context) error {
+	limiter := app.rateLimiters[rateLimitGRPC]
+	if limiter == nil {
+		return nil
+	}
+
+	payload, _ := payloadFromContext(ctx)
+	ip, _ := grpcClientInfo(ctx)
+
+	result, ok := limiter.Take(ctx, ip, payload)
+	if !ok {
+		return nil
+	}
+
+	md := metadata.MD{}
+	for name, value := range limiter.headers(result) {
+		md.Set(name, value)
+	}
+
+	if err := grpc.SetHeader(ctx, md); err != nil {
+		log.Println("cannot set rate limit headers:", err)
+	}
+
+	if !result.Allowed {
+		return status.Error(codes.ResourceExhausted, "too many requests, try again later")
+	}
+
+	return nil
+}
+
+func (app *App) UnaryRateLimitInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := app.checkGRPCRateLimit(ctx); err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (app *App) StreamRateLimitInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := app.checkGRPCRateLimit(stream.Context()); err != nil {
+		return err
+	}
+
+	return handler(srv, stream)
+}
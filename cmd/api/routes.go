@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/bytedance/sonic"
 	"github.com/gofiber/fiber/v2"
+	"github.com/sangketkit01/7-coding-test/internal/db"
 )
 
 func (app *App) routes() *fiber.App{
@@ -17,18 +18,67 @@ func (app *App) routes() *fiber.App{
 	})
 
 	router.Use(app.LoggingMiddleware())
-	router.Post("/grpc/create-user", app.CreateUserViaGrpc)
+	router.Use(app.RequestTimeout())
+	router.Get("/.well-known/jwks.json", app.JWKS)
+	publicLimit := app.RateLimit(rateLimitPublic)
+	router.Post("/grpc/create-user", publicLimit, app.CreateUserViaGrpc)
 
-	router.Post("/create-user", app.CreateUser)
-	router.Post("/login-user", app.LoginUser)
+	router.Post("/create-user", publicLimit, app.CreateUser)
+	router.Post("/login-user", publicLimit, app.LoginUser)
+	router.Post("/login/mfa", publicLimit, app.LoginMFA)
+	router.Get("/oidc/:provider/login", publicLimit, app.OIDCLogin)
+	router.Get("/oidc/:provider/callback", publicLimit, app.OIDCCallback)
+	router.Post("/refresh-token", publicLimit, app.RefreshToken)
+	router.Post("/password/forgot", publicLimit, app.ForgotPassword)
+	router.Post("/password/reset", publicLimit, app.ResetPassword)
+	router.Get("/verify-email", publicLimit, app.VerifyEmail)
+	router.Post("/verify-email/resend", publicLimit, app.ResendEmailVerification)
 
-	authRouter := router.Group("/", app.AuthMiddleware())
-	authRouter.Get("/get-user/:id", app.FetchUserById)
-	authRouter.Get("/all-users", app.ListAllUsers)
-	authRouter.Put("/update-user", app.UpdateUser)
-	authRouter.Delete("/delete-user", app.DeleteUser)
+	authRouter := router.Group("/", app.AuthMiddleware(), app.AuditImpersonation(), app.RateLimit(rateLimitAuth))
+	authRouter.Get("/get-user/:id", app.RequireScope(db.ScopeUsersRead), app.FetchUserById)
+	authRouter.Get("/all-users", app.RequireRole(db.RoleAdmin), app.RequireScope(db.ScopeAdmin), app.ListAllUsers)
+	authRouter.Get("/users/search", app.RequireRole(db.RoleAdmin), app.RequireScope(db.ScopeAdmin), app.SearchUsers)
+	authRouter.Put("/update-user", app.RequireScope(db.ScopeUsersWrite), app.RejectImpersonation(), app.UpdateUser)
+	authRouter.Delete("/delete-user", app.RequireScope(db.ScopeUsersWrite), app.RejectImpersonation(), app.DeleteUser)
+	authRouter.Get("/me", app.RequireScope(db.ScopeUsersRead), app.Me)
+	authRouter.Put("/me/password", app.RequireSession(), app.RejectImpersonation(), app.ChangePassword)
+	authRouter.Post("/introspect", app.RequireAPIKey(), app.RequireScope(db.ScopeIntrospect), app.Introspect)
+	authRouter.Post("/logout", app.RequireSession(), app.Logout)
+	authRouter.Post("/logout-all", app.RequireSession(), app.RejectImpersonation(), app.LogoutAll)
+	authRouter.Post("/2fa/enroll", app.RequireSession(), app.RejectImpersonation(), app.EnrollMFA)
+	authRouter.Post("/2fa/enroll/verify", app.RequireSession(), app.RejectImpersonation(), app.VerifyMFAEnrollment)
+	authRouter.Post("/2fa/disable", app.RequireSession(), app.RejectImpersonation(), app.DisableMFA)
+	authRouter.Post("/api-keys", app.RequireSession(), app.RejectImpersonation(), app.CreateAPIKey)
+	authRouter.Get("/api-keys", app.RequireSession(), app.ListAPIKeys)
+	authRouter.Delete("/api-keys/:keyId", app.RequireSession(), app.RejectImpersonation(), app.RevokeAPIKey)
 
-	authRouter.Get("/grpc/get-user/:id", app.GetUserViaGrpc)
+	authRouter.Post("/orgs", app.RequireSession(), app.RejectImpersonation(), app.CreateOrganization)
+	authRouter.Get("/orgs", app.RequireScope(db.ScopeUsersRead), app.ListOrganizations)
+	authRouter.Get("/orgs/:orgId", app.RequireScope(db.ScopeUsersRead), app.GetOrganization)
+	authRouter.Put("/orgs/:orgId", app.RequireSession(), app.RejectImpersonation(), app.UpdateOrganization)
+	authRouter.Delete("/orgs/:orgId", app.RequireSession(), app.RejectImpersonation(), app.DeleteOrganization)
+	authRouter.Post("/orgs/:orgId/switch", app.RequireSession(), app.RejectImpersonation(), app.SwitchOrganization)
+	authRouter.Get("/orgs/:orgId/members", app.RequireScope(db.ScopeUsersRead), app.ListOrganizationMembers)
+	authRouter.Post("/orgs/:orgId/members", app.RequireSession(), app.RejectImpersonation(), app.AddOrganizationMember)
+	authRouter.Put("/orgs/:orgId/members/:userId", app.RequireSession(), app.RejectImpersonation(), app.UpdateOrganizationMember)
+	authRouter.Delete("/orgs/:orgId/members/:userId", app.RequireSession(), app.RejectImpersonation(), app.RemoveOrganizationMember)
+	authRouter.Post("/orgs/:orgId/users", app.RequireSession(), app.RejectImpersonation(), app.CreateOrganizationUser)
+
+	authRouter.Get("/grpc/get-user/:id", app.RequireScope(db.ScopeUsersRead), app.GetUserViaGrpc)
+	authRouter.Get("/audit-events", app.RequireRole(db.RoleAdmin), app.RequireScope(db.ScopeAdmin), app.ListAuditEvents)
+	authRouter.Get("/audit-events/verify", app.RequireRole(db.RoleAdmin), app.RequireScope(db.ScopeAdmin), app.VerifyAuditEvents)
+
+	adminRouter := authRouter.Group("/admin", app.RequireRole(db.RoleAdmin), app.RequireScope(db.ScopeAdmin), app.RateLimit(rateLimitAdmin))
+	adminRouter.Post("/users/:id/roles", app.GrantRole)
+	adminRouter.Delete("/users/:id/roles/:role", app.RevokeRole)
+	adminRouter.Post("/users/:id/unlock", app.UnlockUser)
+	adminRouter.Get("/deleted-users", app.ListDeletedUsers)
+	adminRouter.Post("/users/:id/restore", app.RestoreUser)
+	adminRouter.Post("/users/:id/api-keys", app.CreateUserAPIKey)
+	adminRouter.Get("/users/:id/api-keys", app.ListUserAPIKeys)
+	adminRouter.Delete("/users/:id/api-keys/:keyId", app.RevokeUserAPIKey)
+	adminRouter.Post("/service-accounts", app.CreateServiceAccount)
+	adminRouter.Post("/users/:id/impersonate", app.RequireSession(), app.Impersonate)
 
 	return router
 }
@@ -40,6 +90,9 @@ func errorHandler(c *fiber.Ctx, err error) error {
 	if e, ok := err.(*fiber.Error); ok {
 		code = e.Code
 		msg = e.Message
+	} else if db.IsTimeout(err) {
+		code = fiber.StatusGatewayTimeout
+		msg = errDatabaseTimeout
 	}
 
 	return c.Status(code).JSON(fiber.Map{
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/sangketkit01/7-coding-test/internal/db"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const errDatabaseTimeout = "the database did not respond in time"
+
+// storeError builds the response for a failed store call. A database that
+// did not answer before the deadline is reported as 504 whatever the call
+// site would otherwise say, so a slow database never looks like a missing
+// user or a bad request.
+func storeError(err error, code int, message string) error {
+	if db.IsTimeout(err) {
+		return fiber.NewError(fiber.StatusGatewayTimeout, errDatabaseTimeout)
+	}
+
+	return fiber.NewError(code, message)
+}
+
+// grpcStoreError is storeError for the gRPC service.
+func grpcStoreError(err error, code codes.Code, message string) error {
+	if db.IsTimeout(err) {
+		return status.Error(codes.DeadlineExceeded, errDatabaseTimeout)
+	}
+
+	return status.Error(code, message)
+}
+
+// RequestTimeout bounds the whole request. Store calls derive their own
+// deadlines from the request context, so none of them outlives it.
+func (app *App) RequestTimeout() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if app.config.RequestTimeout <= 0 {
+			return c.Next()
+		}
+
+		ctx, cancel := context.WithTimeout(c.UserContext(), app.config.RequestTimeout)
+		defer cancel()
+
+		c.SetUserContext(ctx)
+		return c.Next()
+	}
+}
+
+// UnaryTimeoutInterceptor bounds a call like RequestTimeout and turns store
+// timeouts that reach it unwrapped into DEADLINE_EXCEEDED.
+func (app *App) UnaryTimeoutInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if app.config.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, app.config.RequestTimeout)
+		defer cancel()
+	}
+
+	resp, err := handler(ctx, req)
+	if err != nil {
+		if _, ok := status.FromError(err); !ok && db.IsTimeout(err) {
+			return nil, status.Error(codes.DeadlineExceeded, errDatabaseTimeout)
+		}
+	}
+
+	return resp, err
+}
+
+func (app *App) StreamTimeoutInterceptor(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	err := handler(srv, stream)
+	if err != nil {
+		if _, ok := status.FromError(err); !ok && db.IsTimeout(err) {
+			return status.Error(codes.DeadlineExceeded, errDatabaseTimeout)
+		}
+	}
+
+	return err
+}
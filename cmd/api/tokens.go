@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sangketkit01/7-coding-test/internal/db"
+	"github.com/sangketkit01/7-coding-test/internal/token"
+	"github.com/sangketkit01/7-coding-test/internal/util"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	errInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	errRefreshTokenReused  = errors.New("refresh token has already been used, session revoked")
+)
+
+type TokenPair struct {
+	AccessToken           string    `json:"access_token"`
+	RefreshToken          string    `json:"refresh_token"`
+	SessionID             string    `json:"session_id"`
+	IssuedAt              time.Time `json:"issued_at"`
+	AccessTokenExpiredAt  time.Time `json:"access_token_expired_at"`
+	RefreshTokenExpiredAt time.Time `json:"refresh_token_expired_at"`
+}
+
+// tokenIssuer mints access/refresh token pairs and keeps the refresh token
+// and session stores in sync. It is shared by the HTTP handlers and the gRPC
+// service.
+type tokenIssuer struct {
+	maker                token.Maker
+	users                db.MongoClient
+	refreshTokens        db.RefreshTokenStore
+	sessions             db.SessionStore
+	audit                *auditLogger
+	accessTokenDuration  time.Duration
+	refreshTokenDuration time.Duration
+}
+
+// IssueTokenPair starts a new session for the user. The session starts in
+// orgID, or in the user's first organization when orgID is nil.
+func (issuer *tokenIssuer) IssueTokenPair(ctx context.Context, user *db.User, orgID *primitive.ObjectID, userAgent, clientIP string) (*TokenPair, error) {
+	userID := user.ID
+
+	opts := []token.PayloadOption{token.WithRoles(user.Roles)}
+
+	var sessionOrgID *primitive.ObjectID
+	if membership := activeMembership(user, orgID); membership != nil {
+		opts = append(opts, token.WithOrg(membership.OrgID, membership.Role))
+		sessionOrgID = &membership.OrgID
+	}
+
+	accessToken, accessPayload, err := issuer.maker.CreateToken(userID, issuer.accessTokenDuration, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, refreshPayload, err := issuer.maker.CreateToken(
+		userID,
+		issuer.refreshTokenDuration,
+		token.WithSessionID(accessPayload.SessionID),
+		token.WithTokenType(token.TokenTypeRefresh),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = issuer.sessions.CreateSession(ctx, db.Session{
+		ID:        refreshPayload.SessionID.String(),
+		UserID:    userID,
+		UserAgent: userAgent,
+		ClientIP:  clientIP,
+		OrgID:     sessionOrgID,
+		ExpiresAt: refreshPayload.ExpiredAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = issuer.refreshTokens.InsertRefreshToken(ctx, db.RefreshToken{
+		SessionID: refreshPayload.SessionID.String(),
+		UserID:    userID,
+		TokenHash: util.HashToken(refreshToken),
+		ExpiresAt: refreshPayload.ExpiredAt,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	issuer.recordIssue(db.AuditTokenIssue, userID, refreshPayload.SessionID.String(), userAgent, clientIP)
+
+	return newTokenPair(accessToken, accessPayload, refreshToken, refreshPayload), nil
+}
+
+// ReissueAccessToken mints an access token in an existing session, for
+// when the roles or the organization of the current one are out of date.
+// orgID is nil outside any organization.
+func (issuer *tokenIssuer) ReissueAccessToken(user *db.User, sessionID uuid.UUID, orgID *primitive.ObjectID, orgRole, userAgent, clientIP string) (string, *token.Payload, error) {
+	opts := []token.PayloadOption{
+		token.WithSessionID(sessionID),
+		token.WithRoles(user.Roles),
+	}
+	if orgID != nil {
+		opts = append(opts, token.WithOrg(*orgID, orgRole))
+	}
+
+	accessToken, accessPayload, err := issuer.maker.CreateToken(user.ID, issuer.accessTokenDuration, opts...)
+	if err != nil {
+		return "", nil, err
+	}
+
+	issuer.recordIssue(db.AuditTokenIssue, user.ID, sessionID.String(), userAgent, clientIP)
+
+	return accessToken, accessPayload, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new pair in the same
+// session. Presenting a refresh token that was already rotated means it has
+// leaked, so the whole session is revoked.
+func (issuer *tokenIssuer) RotateRefreshToken(ctx context.Context, refreshToken, userAgent, clientIP string) (*TokenPair, error) {
+	payload, err := issuer.maker.VerifyToken(refreshToken)
+	if err != nil || payload.TokenType != token.TokenTypeRefresh {
+		return nil, errInvalidRefreshToken
+	}
+
+	sessionID := payload.SessionID.String()
+
+	stored, err := issuer.refreshTokens.GetRefreshToken(ctx, sessionID)
+	if err != nil {
+		if errors.Is(err, db.ErrRefreshTokenNotFound) {
+			return nil, errInvalidRefreshToken
+		}
+
+		return nil, err
+	}
+
+	if stored.Revoked || stored.UserID != payload.ID {
+		return nil, errInvalidRefreshToken
+	}
+
+	session, err := issuer.sessions.GetSession(ctx, sessionID)
+	if err != nil {
+		if errors.Is(err, db.ErrSessionNotFound) {
+			return nil, errInvalidRefreshToken
+		}
+
+		return nil, err
+	}
+
+	if session.IsRevoked() {
+		return nil, errInvalidRefreshToken
+	}
+
+	oldHash := util.HashToken(refreshToken)
+	if stored.TokenHash != oldHash {
+		return nil, issuer.revokeReusedSession(ctx, sessionID)
+	}
+
+	// roles are read again so that grants and revocations apply on refresh
+	user, err := issuer.users.FetchUserByID(ctx, payload.ID.Hex())
+	if err != nil {
+		return nil, errInvalidRefreshToken
+	}
+
+	opts := []token.PayloadOption{
+		token.WithSessionID(payload.SessionID),
+		token.WithRoles(user.Roles),
+	}
+
+	// so is the organization role, a user who left drops out of the organization
+	if session.OrgID != nil {
+		if membership := user.Membership(*session.OrgID); membership != nil {
+			opts = append(opts, token.WithOrg(membership.OrgID, membership.Role))
+		}
+	}
+
+	accessToken, accessPayload, err := issuer.maker.CreateToken(payload.ID, issuer.accessTokenDuration, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	newRefreshToken, newRefreshPayload, err := issuer.maker.CreateToken(
+		payload.ID,
+		issuer.refreshTokenDuration,
+		token.WithSessionID(payload.SessionID),
+		token.WithTokenType(token.TokenTypeRefresh),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	err = issuer.refreshTokens.RotateRefreshToken(ctx, sessionID, oldHash, util.HashToken(newRefreshToken), newRefreshPayload.ExpiredAt)
+	if err != nil {
+		if errors.Is(err, db.ErrRefreshTokenReused) {
+			return nil, issuer.revokeReusedSession(ctx, sessionID)
+		}
+
+		return nil, err
+	}
+
+	if err := issuer.sessions.ExtendSession(ctx, sessionID, newRefreshPayload.ExpiredAt); err != nil {
+		return nil, err
+	}
+
+	issuer.recordIssue(db.AuditTokenRefresh, payload.ID, sessionID, userAgent, clientIP)
+
+	return newTokenPair(accessToken, accessPayload, newRefreshToken, newRefreshPayload), nil
+}
+
+// activeMembership returns the membership of orgID, or the user's first
+// membership when orgID is nil. It is nil for users outside any
+// organization.
+func activeMembership(user *db.User, orgID *primitive.ObjectID) *db.Membership {
+	if orgID != nil {
+		return user.Membership(*orgID)
+	}
+
+	if len(user.Memberships) > 0 {
+		return &user.Memberships[0]
+	}
+
+	return nil
+}
+
+func (issuer *tokenIssuer) revokeReusedSession(ctx context.Context, sessionID string) error {
+	log.Printf("refresh token reuse detected, revoking session %s\n", sessionID)
+
+	if err := issuer.refreshTokens.RevokeRefreshToken(ctx, sessionID); err != nil {
+		return err
+	}
+
+	if err := issuer.sessions.RevokeSession(ctx, sessionID); err != nil {
+		return err
+	}
+
+	return errRefreshTokenReused
+}
+
+func (issuer *tokenIssuer) recordIssue(action string, userID primitive.ObjectID, sessionID, userAgent, clientIP string) {
+	issuer.audit.Record(db.AuditEvent{
+		Action:    action,
+		ActorID:   userID,
+		TargetID:  userID,
+		IP:        clientIP,
+		UserAgent: userAgent,
+		Metadata:  map[string]string{"session_id": sessionID},
+	})
+}
+
+func newTokenPair(accessToken string, accessPayload *token.Payload, refreshToken string, refreshPayload *token.Payload) *TokenPair {
+	return &TokenPair{
+		AccessToken:           accessToken,
+		RefreshToken:          refreshToken,
+		SessionID:             accessPayload.SessionID.String(),
+		IssuedAt:              accessPayload.IssuedAt,
+		AccessTokenExpiredAt:  accessPayload.ExpiredAt,
+		RefreshTokenExpiredAt: refreshPayload.ExpiredAt,
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/gofiber/fiber/v2"
+	"github.com/sangketkit01/7-coding-test/internal/db"
+	"github.com/sangketkit01/7-coding-test/internal/mail"
+	"github.com/sangketkit01/7-coding-test/internal/util"
+)
+
+var errVerificationThrottled = errors.New("too many verification emails, try again later")
+
+// emailVerifier sends verification links and enforces the resend limits. It
+// is shared by the HTTP handlers and the gRPC service.
+type emailVerifier struct {
+	store          db.EmailVerificationStore
+	mailer         mail.Mailer
+	baseUrl        string
+	expiry         time.Duration
+	resendCooldown time.Duration
+	maxPerHour     int64
+}
+
+// SendVerification creates a verification token for the user's current
+// email and mails the link in the background.
+func (verifier *emailVerifier) SendVerification(ctx context.Context, user *db.User) error {
+	verificationToken, err := util.RandomToken(32)
+	if err != nil {
+		return err
+	}
+
+	err = verifier.store.InsertEmailVerification(ctx, db.EmailVerification{
+		TokenHash: util.HashToken(verificationToken),
+		UserID:    user.ID,
+		Email:     user.Email,
+		ExpiresAt: time.Now().Add(verifier.expiry),
+	})
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/verify-email?token=%s", verifier.baseUrl, url.QueryEscape(verificationToken))
+	msg := mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your email address by opening the link below. It expires in %s.\n\n%s",
+			user.Name, verifier.expiry, link),
+	}
+
+	go func() {
+		if err := verifier.mailer.Send(msg); err != nil {
+			log.Println("failed to send verification email:", err)
+		}
+	}()
+
+	return nil
+}
+
+// Throttle returns how long the user has to wait before another
+// verification email may be sent, zero if it may be sent now.
+func (verifier *emailVerifier) Throttle(ctx context.Context, user *db.User) (time.Duration, error) {
+	recent, err := verifier.store.CountEmailVerificationsSince(ctx, user.ID, time.Now().Add(-verifier.resendCooldown))
+	if err != nil {
+		return 0, err
+	}
+
+	if recent > 0 {
+		return verifier.resendCooldown, nil
+	}
+
+	lastHour, err := verifier.store.CountEmailVerificationsSince(ctx, user.ID, time.Now().Add(-time.Hour))
+	if err != nil {
+		return 0, err
+	}
+
+	if lastHour >= verifier.maxPerHour {
+		return time.Hour, nil
+	}
+
+	return 0, nil
+}
+
+func (app *App) VerifyEmail(c *fiber.Ctx) error {
+	verificationToken := c.Query("token")
+	if verificationToken == "" {
+		return fiber.NewError(fiber.StatusBadRequest, "token is not provided.")
+	}
+
+	verification, err := app.verifier.store.ConsumeEmailVerification(c.UserContext(), util.HashToken(verificationToken))
+	if err != nil {
+		if errors.Is(err, db.ErrEmailVerificationInvalid) {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		return storeError(err, fiber.StatusInternalServerError, "cannot verify email")
+	}
+
+	if err := app.model.MarkEmailVerified(c.UserContext(), verification.UserID, verification.Email); err != nil {
+		return storeError(err, fiber.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(fiber.Map{"message": "Verify email successfully."})
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email" validate:"required,email"`
+	Org   string `json:"org"`
+}
+
+func (app *App) ResendEmailVerification(c *fiber.Ctx) error {
+	var req ResendVerificationRequest
+	if err := c.BodyParser(&req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid resend verification request")
+	}
+
+	validate := validator.New()
+	if err := validate.Struct(req); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	}
+
+	response := fiber.Map{"message": "If the email exists and is not verified, a verification link has been sent."}
+
+	tenantID, err := app.tenantBySlug(c.UserContext(), req.Org)
+	if err != nil {
+		return c.JSON(response)
+	}
+
+	user, err := app.model.GetUserByEmailInTenant(c.UserContext(), req.Email, tenantID)
+	if err != nil || user.EmailVerified {
+		return c.JSON(response)
+	}
+
+	wait, err := app.verifier.Throttle(c.UserContext(), user)
+	if err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot send verification email")
+	}
+
+	if wait > 0 {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(wait.Seconds())))
+		return fiber.NewError(fiber.StatusTooManyRequests, errVerificationThrottled.Error())
+	}
+
+	if err := app.verifier.SendVerification(c.UserContext(), user); err != nil {
+		return storeError(err, fiber.StatusInternalServerError, "cannot send verification email")
+	}
+
+	return c.JSON(response)
+}
@@ -1,13 +1,97 @@
 package config
 
-import "github.com/spf13/viper"
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
 
 type Config struct {
-	Environment   string `mapstructure:"ENVIRONMENT"`
-	MongoUrl      string `mapstructure:"MONGO_URL"`
-	MongoUsername string `mapstructure:"MONGO_INITDB_ROOT_USERNAME"`
-	MongoPassword string `mapstructure:"MONGO_INITDB_ROOT_PASSWORD"`
-	SecretKey     string `mapstructure:"SECRETKEY"`
+	Environment                 string         `mapstructure:"ENVIRONMENT"`
+	MongoUrl                    string         `mapstructure:"MONGO_URL"`
+	MongoUsername               string         `mapstructure:"MONGO_INITDB_ROOT_USERNAME"`
+	MongoPassword               string         `mapstructure:"MONGO_INITDB_ROOT_PASSWORD"`
+	SecretKey                   string         `mapstructure:"SECRETKEY"`
+	AdminEmail                  string         `mapstructure:"ADMIN_EMAIL"`
+	TokenMaker                  string         `mapstructure:"TOKEN_MAKER"`
+	PasetoLocalKey              string         `mapstructure:"PASETO_LOCAL_KEY"`
+	PasetoSecretKey             string         `mapstructure:"PASETO_SECRET_KEY"`
+	KeyRotationInterval         time.Duration  `mapstructure:"JWT_KEY_ROTATION_INTERVAL"`
+	KeyGracePeriod              time.Duration  `mapstructure:"JWT_KEY_GRACE_PERIOD"`
+	AccessTokenDuration         time.Duration  `mapstructure:"ACCESS_TOKEN_DURATION"`
+	RefreshTokenDuration        time.Duration  `mapstructure:"REFRESH_TOKEN_DURATION"`
+	LoginMaxAccountFailures     int            `mapstructure:"LOGIN_MAX_ACCOUNT_FAILURES"`
+	LoginMaxIPFailures          int            `mapstructure:"LOGIN_MAX_IP_FAILURES"`
+	LoginFailureWindow          time.Duration  `mapstructure:"LOGIN_FAILURE_WINDOW"`
+	LoginLockoutDuration        time.Duration  `mapstructure:"LOGIN_LOCKOUT_DURATION"`
+	LoginBaseDelay              time.Duration  `mapstructure:"LOGIN_BASE_DELAY"`
+	LoginMaxDelay               time.Duration  `mapstructure:"LOGIN_MAX_DELAY"`
+	AppBaseUrl                  string         `mapstructure:"APP_BASE_URL"`
+	PasswordResetExpiry         time.Duration  `mapstructure:"PASSWORD_RESET_TOKEN_DURATION"`
+	RequireEmailVerification    bool           `mapstructure:"REQUIRE_EMAIL_VERIFICATION"`
+	EmailVerificationExpiry     time.Duration  `mapstructure:"EMAIL_VERIFICATION_TOKEN_DURATION"`
+	EmailVerificationCooldown   time.Duration  `mapstructure:"EMAIL_VERIFICATION_RESEND_COOLDOWN"`
+	EmailVerificationMaxPerHour int64          `mapstructure:"EMAIL_VERIFICATION_MAX_PER_HOUR"`
+	Mailer                      string         `mapstructure:"MAILER"`
+	MailFrom                    string         `mapstructure:"MAIL_FROM"`
+	MailFile                    string         `mapstructure:"MAIL_FILE"`
+	SMTPHost                    string         `mapstructure:"SMTP_HOST"`
+	SMTPPort                    string         `mapstructure:"SMTP_PORT"`
+	SMTPUsername                string         `mapstructure:"SMTP_USERNAME"`
+	SMTPPassword                string         `mapstructure:"SMTP_PASSWORD"`
+	MFAPendingTokenDuration     time.Duration  `mapstructure:"MFA_PENDING_TOKEN_DURATION"`
+	TOTPIssuer                  string         `mapstructure:"TOTP_ISSUER"`
+	OIDCProviderNames           []string       `mapstructure:"OIDC_PROVIDERS"`
+	OIDCProviders               []OIDCProvider `mapstructure:"-"`
+	APIKeyDefaultExpiry         time.Duration  `mapstructure:"API_KEY_DEFAULT_EXPIRY"`
+	APIKeyMaxExpiry             time.Duration  `mapstructure:"API_KEY_MAX_EXPIRY"`
+	PasswordMinLength           int            `mapstructure:"PASSWORD_MIN_LENGTH"`
+	PasswordMaxLength           int            `mapstructure:"PASSWORD_MAX_LENGTH"`
+	PasswordRequireUpper        bool           `mapstructure:"PASSWORD_REQUIRE_UPPER"`
+	PasswordRequireLower        bool           `mapstructure:"PASSWORD_REQUIRE_LOWER"`
+	PasswordRequireDigit        bool           `mapstructure:"PASSWORD_REQUIRE_DIGIT"`
+	PasswordRequireSymbol       bool           `mapstructure:"PASSWORD_REQUIRE_SYMBOL"`
+	PasswordHistory             int            `mapstructure:"PASSWORD_HISTORY"`
+	PasswordBlocklistFile       string         `mapstructure:"PASSWORD_BLOCKLIST_FILE"`
+	PasswordHashAlgorithm       string         `mapstructure:"PASSWORD_HASH_ALGORITHM"`
+	PasswordBcryptCost          int            `mapstructure:"PASSWORD_BCRYPT_COST"`
+	PasswordArgon2Memory        uint32         `mapstructure:"PASSWORD_ARGON2_MEMORY"`
+	PasswordArgon2Iterations    uint32         `mapstructure:"PASSWORD_ARGON2_ITERATIONS"`
+	PasswordArgon2Parallelism   uint8          `mapstructure:"PASSWORD_ARGON2_PARALLELISM"`
+	RateLimitStore              string         `mapstructure:"RATE_LIMIT_STORE"`
+	RateLimitPublic             string         `mapstructure:"RATE_LIMIT_PUBLIC"`
+	RateLimitPublicKey          string         `mapstructure:"RATE_LIMIT_PUBLIC_KEY"`
+	RateLimitAuth               string         `mapstructure:"RATE_LIMIT_AUTH"`
+	RateLimitAuthKey            string         `mapstructure:"RATE_LIMIT_AUTH_KEY"`
+	RateLimitAdmin              string         `mapstructure:"RATE_LIMIT_ADMIN"`
+	RateLimitAdminKey           string         `mapstructure:"RATE_LIMIT_ADMIN_KEY"`
+	RateLimitGRPC               string         `mapstructure:"RATE_LIMIT_GRPC"`
+	RateLimitGRPCKey            string         `mapstructure:"RATE_LIMIT_GRPC_KEY"`
+	ImpersonationTokenDuration  time.Duration  `mapstructure:"IMPERSONATION_TOKEN_DURATION"`
+	EmailUniqueness             string         `mapstructure:"EMAIL_UNIQUENESS"`
+	DeletedUserRetention        time.Duration  `mapstructure:"DELETED_USER_RETENTION"`
+	DeletedUserPurgeInterval    time.Duration  `mapstructure:"DELETED_USER_PURGE_INTERVAL"`
+	DeletedEmailPolicy          string         `mapstructure:"DELETED_EMAIL_POLICY"`
+	DBReadTimeout               time.Duration  `mapstructure:"DB_READ_TIMEOUT"`
+	DBWriteTimeout              time.Duration  `mapstructure:"DB_WRITE_TIMEOUT"`
+	RequestTimeout              time.Duration  `mapstructure:"REQUEST_TIMEOUT"`
+	Store                       string         `mapstructure:"STORE"`
+	MigrateOnStart              bool           `mapstructure:"MIGRATE_ON_START"`
+}
+
+// OIDCProvider configures an external OpenID Connect provider. Providers are
+// listed by name in OIDC_PROVIDERS and each one reads its settings from
+// OIDC_<NAME>_ISSUER, OIDC_<NAME>_CLIENT_ID, OIDC_<NAME>_CLIENT_SECRET,
+// OIDC_<NAME>_REDIRECT_URL and OIDC_<NAME>_SCOPES.
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectUrl  string
+	Scopes       []string
 }
 
 func NewConfig(path, env string) (*Config, error) {
@@ -17,6 +101,71 @@ func NewConfig(path, env string) (*Config, error) {
 	viper.AddConfigPath(path)
 	viper.SetConfigType("env")
 
+	viper.SetDefault("ADMIN_EMAIL", "")
+	viper.SetDefault("TOKEN_MAKER", "jwt")
+	viper.SetDefault("PASETO_LOCAL_KEY", "")
+	viper.SetDefault("PASETO_SECRET_KEY", "")
+	viper.SetDefault("JWT_KEY_ROTATION_INTERVAL", 30*24*time.Hour)
+	viper.SetDefault("JWT_KEY_GRACE_PERIOD", 7*24*time.Hour)
+	viper.SetDefault("ACCESS_TOKEN_DURATION", 15*time.Minute)
+	viper.SetDefault("REFRESH_TOKEN_DURATION", 7*24*time.Hour)
+	viper.SetDefault("LOGIN_MAX_ACCOUNT_FAILURES", 5)
+	viper.SetDefault("LOGIN_MAX_IP_FAILURES", 50)
+	viper.SetDefault("LOGIN_FAILURE_WINDOW", 15*time.Minute)
+	viper.SetDefault("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+	viper.SetDefault("LOGIN_BASE_DELAY", time.Second)
+	viper.SetDefault("LOGIN_MAX_DELAY", 30*time.Second)
+	viper.SetDefault("APP_BASE_URL", "http://localhost:8090")
+	viper.SetDefault("PASSWORD_RESET_TOKEN_DURATION", time.Hour)
+	viper.SetDefault("REQUIRE_EMAIL_VERIFICATION", false)
+	viper.SetDefault("EMAIL_VERIFICATION_TOKEN_DURATION", 24*time.Hour)
+	viper.SetDefault("EMAIL_VERIFICATION_RESEND_COOLDOWN", time.Minute)
+	viper.SetDefault("EMAIL_VERIFICATION_MAX_PER_HOUR", 5)
+	viper.SetDefault("MAILER", "stdout")
+	viper.SetDefault("MAIL_FROM", "no-reply@localhost")
+	viper.SetDefault("MAIL_FILE", "")
+	viper.SetDefault("SMTP_HOST", "")
+	viper.SetDefault("SMTP_PORT", "587")
+	viper.SetDefault("SMTP_USERNAME", "")
+	viper.SetDefault("SMTP_PASSWORD", "")
+	viper.SetDefault("MFA_PENDING_TOKEN_DURATION", 5*time.Minute)
+	viper.SetDefault("TOTP_ISSUER", "7-coding-test")
+	viper.SetDefault("OIDC_PROVIDERS", "")
+	viper.SetDefault("API_KEY_DEFAULT_EXPIRY", 90*24*time.Hour)
+	viper.SetDefault("API_KEY_MAX_EXPIRY", 365*24*time.Hour)
+	viper.SetDefault("PASSWORD_MIN_LENGTH", 8)
+	viper.SetDefault("PASSWORD_MAX_LENGTH", 64)
+	viper.SetDefault("PASSWORD_REQUIRE_UPPER", false)
+	viper.SetDefault("PASSWORD_REQUIRE_LOWER", false)
+	viper.SetDefault("PASSWORD_REQUIRE_DIGIT", false)
+	viper.SetDefault("PASSWORD_REQUIRE_SYMBOL", false)
+	viper.SetDefault("PASSWORD_HISTORY", 5)
+	viper.SetDefault("PASSWORD_BLOCKLIST_FILE", "")
+	viper.SetDefault("PASSWORD_HASH_ALGORITHM", "argon2id")
+	viper.SetDefault("PASSWORD_BCRYPT_COST", 12)
+	viper.SetDefault("PASSWORD_ARGON2_MEMORY", 64*1024)
+	viper.SetDefault("PASSWORD_ARGON2_ITERATIONS", 3)
+	viper.SetDefault("PASSWORD_ARGON2_PARALLELISM", 2)
+	viper.SetDefault("RATE_LIMIT_STORE", "memory")
+	viper.SetDefault("RATE_LIMIT_PUBLIC", "20/1m")
+	viper.SetDefault("RATE_LIMIT_PUBLIC_KEY", "ip")
+	viper.SetDefault("RATE_LIMIT_AUTH", "300/1m")
+	viper.SetDefault("RATE_LIMIT_AUTH_KEY", "user")
+	viper.SetDefault("RATE_LIMIT_ADMIN", "60/1m")
+	viper.SetDefault("RATE_LIMIT_ADMIN_KEY", "user")
+	viper.SetDefault("RATE_LIMIT_GRPC", "300/1m")
+	viper.SetDefault("RATE_LIMIT_GRPC_KEY", "user")
+	viper.SetDefault("IMPERSONATION_TOKEN_DURATION", 15*time.Minute)
+	viper.SetDefault("EMAIL_UNIQUENESS", "global")
+	viper.SetDefault("DELETED_USER_RETENTION", 30*24*time.Hour)
+	viper.SetDefault("DELETED_USER_PURGE_INTERVAL", time.Hour)
+	viper.SetDefault("DELETED_EMAIL_POLICY", "reserve")
+	viper.SetDefault("DB_READ_TIMEOUT", 5*time.Second)
+	viper.SetDefault("DB_WRITE_TIMEOUT", 10*time.Second)
+	viper.SetDefault("REQUEST_TIMEOUT", 30*time.Second)
+	viper.SetDefault("STORE", "mongo")
+	viper.SetDefault("MIGRATE_ON_START", false)
+
 	if err := viper.ReadInConfig(); err != nil {
 		return nil, err
 	}
@@ -26,5 +175,44 @@ func NewConfig(path, env string) (*Config, error) {
 		return nil, err
 	}
 
+	providers, err := loadOIDCProviders(config.OIDCProviderNames, config.AppBaseUrl)
+	if err != nil {
+		return nil, err
+	}
+	config.OIDCProviders = providers
+
 	return &config, nil
 }
+
+func loadOIDCProviders(names []string, appBaseUrl string) ([]OIDCProvider, error) {
+	var providers []OIDCProvider
+
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		provider := OIDCProvider{
+			Name:         name,
+			Issuer:       viper.GetString(prefix + "ISSUER"),
+			ClientID:     viper.GetString(prefix + "CLIENT_ID"),
+			ClientSecret: viper.GetString(prefix + "CLIENT_SECRET"),
+			RedirectUrl:  viper.GetString(prefix + "REDIRECT_URL"),
+			Scopes:       strings.Fields(viper.GetString(prefix + "SCOPES")),
+		}
+
+		if provider.Issuer == "" || provider.ClientID == "" {
+			return nil, fmt.Errorf("oidc provider %s needs %sISSUER and %sCLIENT_ID", name, prefix, prefix)
+		}
+
+		if provider.RedirectUrl == "" {
+			provider.RedirectUrl = fmt.Sprintf("%s/oidc/%s/callback", strings.TrimSuffix(appBaseUrl, "/"), name)
+		}
+
+		providers = append(providers, provider)
+	}
+
+	return providers, nil
+}
@@ -0,0 +1,192 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+const (
+	ScopeUsersRead  = "users:read"
+	ScopeUsersWrite = "users:write"
+	ScopeAdmin      = "admin"
+	// ScopeIntrospect lets a service account check tokens presented to it.
+	ScopeIntrospect = "tokens:introspect"
+)
+
+func IsValidScope(scope string) bool {
+	return scope == ScopeUsersRead || scope == ScopeUsersWrite || scope == ScopeAdmin || scope == ScopeIntrospect
+}
+
+// APIKey lets a program act as its owner, a user or a service account,
+// within the key's scopes. Only the hash of the key is stored, the prefix
+// is kept so people can tell their keys apart.
+type APIKey struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID     primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Name       string             `bson:"name" json:"name"`
+	Prefix     string             `bson:"prefix" json:"prefix"`
+	KeyHash    string             `bson:"key_hash" json:"-"`
+	Scopes     []string           `bson:"scopes" json:"scopes"`
+	ExpiresAt  time.Time          `bson:"expires_at" json:"expires_at"`
+	LastUsedAt *time.Time         `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time         `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+	CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+}
+
+func (k *APIKey) IsActive() bool {
+	return k.RevokedAt == nil && time.Now().Before(k.ExpiresAt)
+}
+
+// mongoAPIKeyStore is the APIKeyStore backed by the api_keys collection.
+type mongoAPIKeyStore struct {
+	collection *mongo.Collection
+}
+
+func NewAPIKeyStore(mongo *mongo.Client) APIKeyStore {
+	return mongoAPIKeyStore{collection: mongo.Database("users").Collection("api_keys")}
+}
+
+func createAPIKeyIndexes(ctx context.Context, collection *mongo.Collection) error {
+	indexModels := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "key_hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}},
+		},
+	}
+	_, err := collection.Indexes().CreateMany(ctx, indexModels)
+	return err
+}
+
+func (k mongoAPIKeyStore) InsertAPIKey(ctx context.Context, key APIKey) (*APIKey, error) {
+	collection := k.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	key.CreatedAt = time.Now()
+
+	result, err := collection.InsertOne(ctx, key)
+	if err != nil {
+		log.Println("failed to insert api key:", err)
+		return nil, err
+	}
+
+	key.ID = result.InsertedID.(primitive.ObjectID)
+
+	return &key, nil
+}
+
+func (k mongoAPIKeyStore) GetAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error) {
+	collection := k.collection
+
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+
+	var key APIKey
+	err := collection.FindOne(ctx, bson.M{"key_hash": keyHash}).Decode(&key)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrAPIKeyNotFound
+		}
+
+		log.Println("error finding api key:", err)
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func (k mongoAPIKeyStore) GetAPIKey(ctx context.Context, id primitive.ObjectID) (*APIKey, error) {
+	collection := k.collection
+
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+
+	var key APIKey
+	err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&key)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrAPIKeyNotFound
+		}
+
+		log.Println("error finding api key:", err)
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func (k mongoAPIKeyStore) ListAPIKeys(ctx context.Context, userID primitive.ObjectID) ([]*APIKey, error) {
+	collection := k.collection
+
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}})
+	cursor, err := collection.Find(ctx, bson.M{"user_id": userID}, opts)
+	if err != nil {
+		log.Println("error listing api keys:", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	keys := []*APIKey{}
+	if err := cursor.All(ctx, &keys); err != nil {
+		log.Println("error decoding api keys:", err)
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (k mongoAPIKeyStore) RevokeAPIKey(ctx context.Context, userID, id primitive.ObjectID) error {
+	collection := k.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	filter := bson.M{
+		"_id":        id,
+		"user_id":    userID,
+		"revoked_at": bson.M{"$exists": false},
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"revoked_at": time.Now()}})
+	if err != nil {
+		log.Println("failed to revoke api key:", err)
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+func (k mongoAPIKeyStore) TouchAPIKey(ctx context.Context, id primitive.ObjectID, usedAt time.Time) error {
+	collection := k.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	_, err := collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"last_used_at": usedAt}})
+	if err != nil {
+		log.Println("failed to update api key last use:", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,346 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	AuditUserCreate     = "user.create"
+	AuditUserLogin      = "user.login"
+	AuditUserLoginFail  = "user.login_failed"
+	AuditUserUpdate     = "user.update"
+	AuditUserDelete     = "user.delete"
+	AuditUserRestore    = "user.restore"
+	AuditUserPurge      = "user.purge"
+	AuditRoleGrant      = "user.role_grant"
+	AuditRoleRevoke     = "user.role_revoke"
+	AuditPasswordChange = "user.password_change"
+	AuditPasswordReset  = "user.password_reset"
+	AuditMFAEnable      = "user.mfa_enable"
+	AuditMFADisable     = "user.mfa_disable"
+	AuditTokenIssue     = "token.issue"
+	AuditTokenRefresh   = "token.refresh"
+	AuditAPIKeyCreate   = "api_key.create"
+	AuditAPIKeyRevoke   = "api_key.revoke"
+
+	// AuditImpersonationStart is written when an admin mints an
+	// impersonation token, AuditImpersonationRequest for every request
+	// made with one.
+	AuditImpersonationStart   = "impersonation.start"
+	AuditImpersonationRequest = "impersonation.request"
+
+	AuditOrgCreate       = "org.create"
+	AuditOrgUpdate       = "org.update"
+	AuditOrgDelete       = "org.delete"
+	AuditOrgMemberAdd    = "org.member_add"
+	AuditOrgMemberUpdate = "org.member_update"
+	AuditOrgMemberRemove = "org.member_remove"
+)
+
+const auditAppendAttempts = 5
+
+// FieldChange is the before and after value of one user field, JSON
+// encoded so the event hashes the same after a round trip through mongo.
+type FieldChange struct {
+	Field  string `bson:"field" json:"field"`
+	Before string `bson:"before" json:"before"`
+	After  string `bson:"after" json:"after"`
+}
+
+// AuditEvent records who did what to which account. Events form a hash
+// chain: each one includes the hash of the previous event, so changing or
+// deleting an event breaks every hash after it.
+type AuditEvent struct {
+	Seq       int64              `bson:"_id" json:"seq"`
+	Action    string             `bson:"action" json:"action"`
+	ActorID   primitive.ObjectID `bson:"actor_id,omitempty" json:"actor_id,omitempty"`
+	TargetID  primitive.ObjectID `bson:"target_id,omitempty" json:"target_id,omitempty"`
+	IP        string             `bson:"ip,omitempty" json:"ip,omitempty"`
+	UserAgent string             `bson:"user_agent,omitempty" json:"user_agent,omitempty"`
+	Changes   []FieldChange      `bson:"changes,omitempty" json:"changes,omitempty"`
+	Metadata  map[string]string  `bson:"metadata,omitempty" json:"metadata,omitempty"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	PrevHash  string             `bson:"prev_hash" json:"prev_hash"`
+	Hash      string             `bson:"hash" json:"hash"`
+}
+
+// SetMetadata sets key, creating the metadata on first use.
+func (e *AuditEvent) SetMetadata(key, value string) {
+	if e.Metadata == nil {
+		e.Metadata = map[string]string{}
+	}
+	e.Metadata[key] = value
+}
+
+// ComputeHash hashes every field of the event except Hash itself.
+func (e *AuditEvent) ComputeHash() string {
+	content, _ := json.Marshal(struct {
+		Seq       int64             `json:"seq"`
+		Action    string            `json:"action"`
+		ActorID   string            `json:"actor_id"`
+		TargetID  string            `json:"target_id"`
+		IP        string            `json:"ip"`
+		UserAgent string            `json:"user_agent"`
+		Changes   []FieldChange     `json:"changes"`
+		Metadata  map[string]string `json:"metadata"`
+		CreatedAt string            `json:"created_at"`
+		PrevHash  string            `json:"prev_hash"`
+	}{
+		Seq:       e.Seq,
+		Action:    e.Action,
+		ActorID:   e.ActorID.Hex(),
+		TargetID:  e.TargetID.Hex(),
+		IP:        e.IP,
+		UserAgent: e.UserAgent,
+		Changes:   e.Changes,
+		Metadata:  e.Metadata,
+		CreatedAt: e.CreatedAt.UTC().Format(time.RFC3339Nano),
+		PrevHash:  e.PrevHash,
+	})
+
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// DiffUsers lists the fields that differ between before and after, either
+// of which may be nil. Secrets, the fields hidden from JSON and the
+// password, are never included.
+func DiffUsers(before, after *User) []FieldChange {
+	var changes []FieldChange
+
+	userType := reflect.TypeOf(User{})
+	for i := 0; i < userType.NumField(); i++ {
+		field := userType.Field(i)
+		if field.Tag.Get("json") == "-" || field.Name == "Password" {
+			continue
+		}
+
+		var beforeValue, afterValue interface{}
+		if before != nil {
+			beforeValue = reflect.ValueOf(*before).Field(i).Interface()
+		}
+		if after != nil {
+			afterValue = reflect.ValueOf(*after).Field(i).Interface()
+		}
+
+		if reflect.DeepEqual(beforeValue, afterValue) {
+			continue
+		}
+
+		changes = append(changes, FieldChange{
+			Field:  strings.Split(field.Tag.Get("bson"), ",")[0],
+			Before: encodeAuditValue(beforeValue),
+			After:  encodeAuditValue(afterValue),
+		})
+	}
+
+	return changes
+}
+
+// NewFieldChange records a change of a field that does not belong to a
+// user, like the name of an organization.
+func NewFieldChange(field string, before, after interface{}) FieldChange {
+	return FieldChange{
+		Field:  field,
+		Before: encodeAuditValue(before),
+		After:  encodeAuditValue(after),
+	}
+}
+
+func encodeAuditValue(value interface{}) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+
+	return string(encoded)
+}
+
+type AuditEventFilter struct {
+	ActorID  primitive.ObjectID
+	TargetID primitive.ObjectID
+	Action   string
+	From     time.Time
+	To       time.Time
+	// BeforeSeq pages backwards, only events older than it are returned.
+	BeforeSeq int64
+	Limit     int64
+}
+
+// AuditChainReport is the result of checking the whole hash chain.
+type AuditChainReport struct {
+	Checked     int64  `json:"checked"`
+	Valid       bool   `json:"valid"`
+	BrokenAtSeq int64  `json:"broken_at_seq,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// mongoAuditEventStore is the AuditEventStore backed by the audit_events collection.
+type mongoAuditEventStore struct {
+	collection *mongo.Collection
+}
+
+func NewAuditEventStore(mongo *mongo.Client) AuditEventStore {
+	return mongoAuditEventStore{collection: mongo.Database("users").Collection("audit_events")}
+}
+
+func createAuditEventIndexes(ctx context.Context, collection *mongo.Collection) error {
+	indexModels := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "actor_id", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "target_id", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "action", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "created_at", Value: 1}}},
+	}
+	_, err := collection.Indexes().CreateMany(ctx, indexModels)
+	return err
+}
+
+// AppendAuditEvent links the event to the last one and inserts it. The
+// sequence number is the _id, so when two writers race for the same number
+// one insert fails and retries on top of the other.
+func (a mongoAuditEventStore) AppendAuditEvent(ctx context.Context, event AuditEvent) (*AuditEvent, error) {
+	collection := a.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	// mongo keeps milliseconds, truncate so the hash still matches later
+	event.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+
+	for attempt := 0; attempt < auditAppendAttempts; attempt++ {
+		var last AuditEvent
+		err := collection.FindOne(
+			ctx,
+			bson.M{},
+			options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}}),
+		).Decode(&last)
+		if err != nil && err != mongo.ErrNoDocuments {
+			log.Println("failed to read last audit event:", err)
+			return nil, err
+		}
+
+		event.Seq = last.Seq + 1
+		event.PrevHash = last.Hash
+		event.Hash = event.ComputeHash()
+
+		_, err = collection.InsertOne(ctx, event)
+		if err == nil {
+			return &event, nil
+		}
+
+		if !mongo.IsDuplicateKeyError(err) {
+			log.Println("failed to insert audit event:", err)
+			return nil, err
+		}
+	}
+
+	return nil, errors.New("cannot append audit event, too many concurrent writers")
+}
+
+// ListAuditEvents returns matching events, newest first.
+func (a mongoAuditEventStore) ListAuditEvents(ctx context.Context, filter AuditEventFilter) ([]*AuditEvent, error) {
+	collection := a.collection
+
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+
+	query := bson.M{}
+	if !filter.ActorID.IsZero() {
+		query["actor_id"] = filter.ActorID
+	}
+	if !filter.TargetID.IsZero() {
+		query["target_id"] = filter.TargetID
+	}
+	if filter.Action != "" {
+		query["action"] = filter.Action
+	}
+	if filter.BeforeSeq > 0 {
+		query["_id"] = bson.M{"$lt": filter.BeforeSeq}
+	}
+
+	createdAt := bson.M{}
+	if !filter.From.IsZero() {
+		createdAt["$gte"] = filter.From
+	}
+	if !filter.To.IsZero() {
+		createdAt["$lte"] = filter.To
+	}
+	if len(createdAt) > 0 {
+		query["created_at"] = createdAt
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(filter.Limit)
+
+	cursor, err := collection.Find(ctx, query, opts)
+	if err != nil {
+		log.Println("error listing audit events:", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	events := []*AuditEvent{}
+	if err := cursor.All(ctx, &events); err != nil {
+		log.Println("error decoding audit events:", err)
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// VerifyAuditChain walks the chain from the first event and reports the
+// first event whose sequence, link or hash does not match. Walking a long
+// chain takes longer than a single read, only the caller's deadline applies.
+func (a mongoAuditEventStore) VerifyAuditChain(ctx context.Context) (*AuditChainReport, error) {
+	collection := a.collection
+
+	cursor, err := collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		log.Println("error reading audit events:", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	report := &AuditChainReport{Valid: true}
+	var prev AuditEvent
+
+	for cursor.Next(ctx) {
+		var event AuditEvent
+		if err := cursor.Decode(&event); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case event.Seq != prev.Seq+1:
+			report.Reason = fmt.Sprintf("expected event %d", prev.Seq+1)
+		case event.PrevHash != prev.Hash:
+			report.Reason = "previous hash does not match"
+		case event.Hash != event.ComputeHash():
+			report.Reason = "event hash does not match its content"
+		}
+
+		if report.Reason != "" {
+			report.Valid = false
+			report.BrokenAtSeq = event.Seq
+			return report, nil
+		}
+
+		report.Checked++
+		prev = event
+	}
+
+	return report, cursor.Err()
+}
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// deletedEmailDomain makes up the placeholder address of a deleted user
+// whose email was released. .invalid can never receive mail.
+const deletedEmailDomain = "@deleted.invalid"
+
+var (
+	ErrDeletedUserNotFound = errors.New("deleted user not found")
+	// ErrEmailTaken is returned when another account has the email, by
+	// RestoreUser when a new account took the released email in the meantime.
+	ErrEmailTaken = errors.New("email already exists")
+)
+
+func createDeletedAtIndex(ctx context.Context, collection *mongo.Collection) error {
+	indexModel := mongo.IndexModel{
+		Keys:    bson.D{{Key: "deleted_at", Value: 1}},
+		Options: options.Index().SetSparse(true),
+	}
+	_, err := collection.Indexes().CreateOne(ctx, indexModel)
+	return err
+}
+
+// RestoreUser takes a user out of the trash, with its email if it had been
+// released.
+func (s mongoUserStore) RestoreUser(ctx context.Context, id string) (*User, error) {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		log.Println("invalid object id:", err)
+		return nil, errors.New("invalid user ID")
+	}
+
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{"email": bson.M{"$ifNull": bson.A{"$deleted_email", "$email"}}}}},
+		{{Key: "$unset", Value: bson.A{"deleted_at", "deleted_email"}}},
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var user User
+	err = collection.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": objectID, "deleted_at": bson.M{"$ne": nil}},
+		update,
+		opts,
+	).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrDeletedUserNotFound
+		}
+
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrEmailTaken
+		}
+
+		log.Println("failed to restore user:", err)
+		return nil, err
+	}
+
+	log.Println("user restored:", id)
+	return &user, nil
+}
+
+// ListDeletedUsers returns the users in the trash, the oldest deletion
+// first.
+func (s mongoUserStore) ListDeletedUsers(ctx context.Context) ([]*User, error) {
+	collection := s.collection
+
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+
+	opts := options.Find().SetSort(bson.D{{Key: "deleted_at", Value: 1}})
+
+	cursor, err := collection.Find(ctx, bson.M{"deleted_at": bson.M{"$ne": nil}}, opts)
+	if err != nil {
+		log.Println("failed to fetch deleted users:", err)
+		return nil, err
+	}
+
+	users := []*User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		log.Println("failed to decode deleted users:", err)
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// PurgeDeletedUsers removes the users deleted before the given time for
+// good and returns them.
+func (s mongoUserStore) PurgeDeletedUsers(ctx context.Context, before time.Time) ([]*User, error) {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"deleted_at": bson.M{"$lte": before}})
+	if err != nil {
+		log.Println("failed to fetch users to purge:", err)
+		return nil, err
+	}
+
+	users := []*User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		log.Println("failed to decode users to purge:", err)
+		return nil, err
+	}
+
+	// deleted_at is checked again, a user restored in between stays
+	purged := users[:0]
+	for _, user := range users {
+		result, err := collection.DeleteOne(ctx, bson.M{"_id": user.ID, "deleted_at": bson.M{"$lte": before}})
+		if err != nil {
+			log.Println("failed to purge deleted user:", err)
+			return purged, err
+		}
+
+		if result.DeletedCount > 0 {
+			purged = append(purged, user)
+		}
+	}
+
+	log.Printf("purged %d deleted users\n", len(purged))
+	return purged, nil
+}
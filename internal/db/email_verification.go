@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrEmailVerificationInvalid = errors.New("invalid or expired verification token")
+
+// EmailVerification is a single-use token proving ownership of Email. Only
+// the hash of the token is stored.
+type EmailVerification struct {
+	TokenHash string             `bson:"_id" json:"-"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	Email     string             `bson:"email" json:"email"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"`
+	UsedAt    *time.Time         `bson:"used_at,omitempty" json:"used_at,omitempty"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// mongoEmailVerificationStore is the EmailVerificationStore backed by the email_verifications collection.
+type mongoEmailVerificationStore struct {
+	collection *mongo.Collection
+}
+
+func NewEmailVerificationStore(mongo *mongo.Client) EmailVerificationStore {
+	return mongoEmailVerificationStore{collection: mongo.Database("users").Collection("email_verifications")}
+}
+
+func createEmailVerificationIndexes(ctx context.Context, collection *mongo.Collection) error {
+	indexModels := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}},
+		},
+	}
+	_, err := collection.Indexes().CreateMany(ctx, indexModels)
+	return err
+}
+
+func (v mongoEmailVerificationStore) InsertEmailVerification(ctx context.Context, verification EmailVerification) error {
+	collection := v.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	verification.CreatedAt = time.Now()
+
+	_, err := collection.InsertOne(ctx, verification)
+	if err != nil {
+		log.Println("failed to insert email verification:", err)
+		return err
+	}
+
+	return nil
+}
+
+// ConsumeEmailVerification marks an unused, unexpired token as used and
+// returns it.
+func (v mongoEmailVerificationStore) ConsumeEmailVerification(ctx context.Context, tokenHash string) (*EmailVerification, error) {
+	collection := v.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	now := time.Now()
+	filter := bson.M{
+		"_id":        tokenHash,
+		"used_at":    bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": now},
+	}
+
+	var verification EmailVerification
+	err := collection.FindOneAndUpdate(
+		ctx,
+		filter,
+		bson.M{"$set": bson.M{"used_at": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&verification)
+
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrEmailVerificationInvalid
+		}
+
+		log.Println("failed to consume email verification:", err)
+		return nil, err
+	}
+
+	return &verification, nil
+}
+
+// CountEmailVerificationsSince counts the verification emails sent to the
+// user since the given time, it backs the resend throttling.
+func (v mongoEmailVerificationStore) CountEmailVerificationsSince(ctx context.Context, userID primitive.ObjectID, since time.Time) (int64, error) {
+	collection := v.collection
+
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+
+	count, err := collection.CountDocuments(ctx, bson.M{
+		"user_id":    userID,
+		"created_at": bson.M{"$gt": since},
+	})
+
+	if err != nil {
+		log.Println("failed to count email verifications:", err)
+		return 0, err
+	}
+
+	return count, nil
+}
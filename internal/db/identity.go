@@ -0,0 +1,90 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrIdentityAlreadyLinked = errors.New("identity is already linked to an account")
+
+// Identity is an account at an external OpenID Connect provider linked to a
+// user. Subject is the provider's stable user id, the email may change.
+type Identity struct {
+	Provider string    `bson:"provider" json:"provider"`
+	Subject  string    `bson:"subject" json:"subject"`
+	Email    string    `bson:"email,omitempty" json:"email,omitempty"`
+	LinkedAt time.Time `bson:"linked_at" json:"linked_at"`
+}
+
+func createIdentityIndex(ctx context.Context, collection *mongo.Collection) error {
+	indexModel := mongo.IndexModel{
+		Keys:    bson.D{{Key: "identities.provider", Value: 1}, {Key: "identities.subject", Value: 1}},
+		Options: options.Index().SetUnique(true).SetSparse(true),
+	}
+	_, err := collection.Indexes().CreateOne(ctx, indexModel)
+	return err
+}
+
+// GetUserByIdentity returns nil when no user is linked to the identity.
+func (s mongoUserStore) GetUserByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	collection := s.collection
+
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+
+	filter := bson.M{
+		"identities": bson.M{"$elemMatch": bson.M{"provider": provider, "subject": subject}},
+		"deleted_at": nil,
+	}
+
+	var user User
+	err := collection.FindOne(ctx, filter).Decode(&user)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+
+		log.Println("error finding user by identity:", err)
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (s mongoUserStore) LinkIdentity(ctx context.Context, id primitive.ObjectID, identity Identity) error {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	identity.LinkedAt = time.Now()
+
+	filter := bson.M{
+		"_id":        id,
+		"identities": bson.M{"$not": bson.M{"$elemMatch": bson.M{"provider": identity.Provider}}},
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, bson.M{"$push": bson.M{"identities": identity}})
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrIdentityAlreadyLinked
+		}
+
+		log.Println("failed to link identity:", err)
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrIdentityAlreadyLinked
+	}
+
+	log.Printf("linked %s identity to user %s\n", identity.Provider, id.Hex())
+	return nil
+}
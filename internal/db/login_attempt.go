@@ -0,0 +1,134 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// LoginAttempt counts the failed logins of one key, an account email or a
+// client IP, inside the current failure window.
+type LoginAttempt struct {
+	Key           string     `bson:"_id" json:"key"`
+	Failures      int        `bson:"failures" json:"failures"`
+	LastFailureAt time.Time  `bson:"last_failure_at" json:"last_failure_at"`
+	LockedUntil   *time.Time `bson:"locked_until,omitempty" json:"locked_until,omitempty"`
+	ExpiresAt     time.Time  `bson:"expires_at" json:"expires_at"`
+}
+
+// mongoLoginAttemptStore is the LoginAttemptStore backed by the login_attempts collection.
+type mongoLoginAttemptStore struct {
+	collection *mongo.Collection
+}
+
+func NewLoginAttemptStore(mongo *mongo.Client) LoginAttemptStore {
+	return mongoLoginAttemptStore{collection: mongo.Database("users").Collection("login_attempts")}
+}
+
+func createLoginAttemptIndex(ctx context.Context, collection *mongo.Collection) error {
+	indexModel := mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+	_, err := collection.Indexes().CreateOne(ctx, indexModel)
+	return err
+}
+
+// GetLoginAttempt returns nil when the key has no recorded failures.
+func (a mongoLoginAttemptStore) GetLoginAttempt(ctx context.Context, key string) (*LoginAttempt, error) {
+	collection := a.collection
+
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+
+	var attempt LoginAttempt
+	err := collection.FindOne(ctx, bson.M{"_id": key}).Decode(&attempt)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+
+		log.Println("error finding login attempt:", err)
+		return nil, err
+	}
+
+	return &attempt, nil
+}
+
+// RecordLoginFailure increments the failure counter of key, starting over
+// when the previous failure is older than window. The counter is updated
+// with a single pipeline update so concurrent failures are all counted.
+func (a mongoLoginAttemptStore) RecordLoginFailure(ctx context.Context, key string, window time.Duration) (*LoginAttempt, error) {
+	collection := a.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	now := time.Now()
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"failures": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{"$last_failure_at", now.Add(-window)}},
+				bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$failures", 0}}, 1}},
+				1,
+			}},
+			"last_failure_at": now,
+			"expires_at":      now.Add(window),
+		}}},
+	}
+
+	var attempt LoginAttempt
+	err := collection.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": key},
+		update,
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&attempt)
+
+	if err != nil {
+		log.Println("failed to record login failure:", err)
+		return nil, err
+	}
+
+	return &attempt, nil
+}
+
+func (a mongoLoginAttemptStore) LockLoginAttempt(ctx context.Context, key string, until time.Time) error {
+	collection := a.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	_, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": key},
+		bson.M{"$set": bson.M{"locked_until": until, "expires_at": until}},
+	)
+
+	if err != nil {
+		log.Println("failed to lock login attempt:", err)
+		return err
+	}
+
+	log.Printf("locked %s until %s\n", key, until.Format(time.RFC3339))
+	return nil
+}
+
+func (a mongoLoginAttemptStore) ResetLoginAttempts(ctx context.Context, key string) error {
+	collection := a.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	_, err := collection.DeleteOne(ctx, bson.M{"_id": key})
+	if err != nil {
+		log.Println("failed to reset login attempts:", err)
+		return err
+	}
+
+	return nil
+}
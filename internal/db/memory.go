@@ -0,0 +1,837 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sangketkit01/7-coding-test/internal/search"
+	"github.com/sangketkit01/7-coding-test/internal/util"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryUserStore is a MongoClient that keeps users in the process, for
+// running the API locally and for tests. It follows the rules of the Mongo
+// store, unique emails included, but nothing survives a restart.
+type memoryUserStore struct {
+	mu    sync.RWMutex
+	users map[primitive.ObjectID]*User
+}
+
+func NewMemoryUserStore() MongoClient {
+	return &memoryUserStore{users: make(map[primitive.ObjectID]*User)}
+}
+
+// cloneUser copies everything a caller could change, so stored users are
+// only ever modified under the lock.
+func cloneUser(user *User) *User {
+	clone := *user
+	clone.Roles = append([]string(nil), user.Roles...)
+	clone.PasswordHistory = append([]string(nil), user.PasswordHistory...)
+	clone.RecoveryCodes = append([]string(nil), user.RecoveryCodes...)
+	clone.Identities = append([]Identity(nil), user.Identities...)
+	clone.Memberships = append([]Membership(nil), user.Memberships...)
+
+	if user.TenantID != nil {
+		tenantID := *user.TenantID
+		clone.TenantID = &tenantID
+	}
+
+	if user.DeletedAt != nil {
+		deletedAt := *user.DeletedAt
+		clone.DeletedAt = &deletedAt
+	}
+
+	return &clone
+}
+
+func sameTenant(a, b *primitive.ObjectID) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	return *a == *b
+}
+
+// emailTaken is the unique email index: deleted users keep their email
+// until it is released or purged.
+func (s *memoryUserStore) emailTaken(email string, tenantID *primitive.ObjectID, except primitive.ObjectID) bool {
+	for id, user := range s.users {
+		if id == except || user.Email != email {
+			continue
+		}
+
+		if emailUniqueness != EmailUniqueTenant || sameTenant(user.TenantID, tenantID) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchEmail is emailFilter.
+func matchEmail(user *User, email string, tenantID *primitive.ObjectID) bool {
+	if user.DeletedAt != nil || user.Email != email {
+		return false
+	}
+
+	return emailUniqueness != EmailUniqueTenant || sameTenant(user.TenantID, tenantID)
+}
+
+// find returns clones of the users that match, in insertion order like a
+// collection scan.
+func (s *memoryUserStore) find(match func(*User) bool) []*User {
+	users := []*User{}
+	for _, user := range s.users {
+		if match(user) {
+			users = append(users, cloneUser(user))
+		}
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return bytes.Compare(users[i].ID[:], users[j].ID[:]) < 0
+	})
+
+	return users
+}
+
+func (s *memoryUserStore) findOne(match func(*User) bool) *User {
+	if users := s.find(match); len(users) > 0 {
+		return users[0]
+	}
+
+	return nil
+}
+
+func (s *memoryUserStore) LoginUser(ctx context.Context, credentials User) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	// With a tenant the tenant's own account wins over an account without
+	// one that has the same email.
+	user := s.findOne(func(u *User) bool { return matchEmail(u, credentials.Email, credentials.TenantID) })
+	if user == nil && emailUniqueness == EmailUniqueTenant && credentials.TenantID != nil {
+		user = s.findOne(func(u *User) bool { return matchEmail(u, credentials.Email, nil) })
+	}
+	s.mu.RUnlock()
+
+	if user == nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	if err := util.CheckPassword(user.Password, credentials.Password); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	// Service accounts authenticate with API keys only.
+	if user.ServiceAccount {
+		return nil, ErrInvalidCredentials
+	}
+
+	if util.PasswordNeedsRehash(user.Password) {
+		if hashedPassword, err := util.HashPassword(credentials.Password); err == nil {
+			s.mu.Lock()
+			if stored, ok := s.users[user.ID]; ok && stored.Password == user.Password {
+				stored.Password = hashedPassword
+				user.Password = hashedPassword
+			}
+			s.mu.Unlock()
+		}
+	}
+
+	return user, nil
+}
+
+func (s *memoryUserStore) Insert(ctx context.Context, user User) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	hashedPassword, err := util.HashPassword(user.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	newUser := &User{
+		ID:             primitive.NewObjectID(),
+		Name:           user.Name,
+		Email:          user.Email,
+		Password:       hashedPassword,
+		Roles:          []string{RoleUser},
+		ServiceAccount: user.ServiceAccount,
+		TenantID:       user.TenantID,
+		Memberships:    user.Memberships,
+		CreatedAt:      time.Now(),
+	}
+	newUser = cloneUser(newUser)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.emailTaken(newUser.Email, newUser.TenantID, primitive.NilObjectID) {
+		return nil, ErrEmailTaken
+	}
+
+	s.users[newUser.ID] = newUser
+
+	return cloneUser(newUser), nil
+}
+
+func (s *memoryUserStore) FetchUserByID(ctx context.Context, id string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[objectID]
+	if !ok || user.DeletedAt != nil {
+		return nil, ErrUserNotFound
+	}
+
+	return cloneUser(user), nil
+}
+
+func (s *memoryUserStore) UpdateUser(ctx context.Context, user User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.users[user.ID]
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	name := current.Name
+	if user.Name != "" {
+		name = user.Name
+	}
+	email := current.Email
+	if user.Email != "" {
+		email = user.Email
+	}
+
+	if email != current.Email && s.emailTaken(email, current.TenantID, current.ID) {
+		return ErrEmailTaken
+	}
+
+	// a new address has to be verified again
+	if email != current.Email {
+		current.EmailVerified = false
+	}
+
+	current.Name = name
+	current.Email = email
+
+	return nil
+}
+
+func (s *memoryUserStore) DeleteUser(ctx context.Context, id primitive.ObjectID, releaseEmail bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok || user.DeletedAt != nil {
+		return ErrUserNotFound
+	}
+
+	now := time.Now()
+	user.DeletedAt = &now
+	if releaseEmail {
+		user.DeletedEmail = user.Email
+		user.Email = user.ID.Hex() + deletedEmailDomain
+	}
+
+	return nil
+}
+
+func (s *memoryUserStore) RestoreUser(ctx context.Context, id string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, errors.New("invalid user ID")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[objectID]
+	if !ok || user.DeletedAt == nil {
+		return nil, ErrDeletedUserNotFound
+	}
+
+	email := user.Email
+	if user.DeletedEmail != "" {
+		email = user.DeletedEmail
+	}
+
+	if s.emailTaken(email, user.TenantID, user.ID) {
+		return nil, ErrEmailTaken
+	}
+
+	user.Email = email
+	user.DeletedEmail = ""
+	user.DeletedAt = nil
+
+	return cloneUser(user), nil
+}
+
+func (s *memoryUserStore) ListDeletedUsers(ctx context.Context) ([]*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := s.find(func(u *User) bool { return u.DeletedAt != nil })
+	sort.SliceStable(users, func(i, j int) bool {
+		return users[i].DeletedAt.Before(*users[j].DeletedAt)
+	})
+
+	return users, nil
+}
+
+func (s *memoryUserStore) PurgeDeletedUsers(ctx context.Context, before time.Time) ([]*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := s.find(func(u *User) bool { return u.DeletedAt != nil && !u.DeletedAt.After(before) })
+	for _, user := range purged {
+		delete(s.users, user.ID)
+	}
+
+	return purged, nil
+}
+
+func (s *memoryUserStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	return s.GetUserByEmailInTenant(ctx, email, nil)
+}
+
+func (s *memoryUserStore) GetUserByEmailInTenant(ctx context.Context, email string, tenantID *primitive.ObjectID) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user := s.findOne(func(u *User) bool { return matchEmail(u, email, tenantID) })
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+
+	return user, nil
+}
+
+// update runs fn on the stored user with the lock held. The id is a hex
+// string for the methods that take one.
+func (s *memoryUserStore) update(ctx context.Context, id string, fn func(*User)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return errors.New("invalid user ID")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[objectID]
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	fn(user)
+	return nil
+}
+
+func (s *memoryUserStore) GrantRole(ctx context.Context, id string, role string) error {
+	return s.update(ctx, id, func(user *User) {
+		for _, r := range user.Roles {
+			if r == role {
+				return
+			}
+		}
+
+		user.Roles = append(user.Roles, role)
+	})
+}
+
+func (s *memoryUserStore) RevokeRole(ctx context.Context, id string, role string) error {
+	return s.update(ctx, id, func(user *User) {
+		roles := []string{}
+		for _, r := range user.Roles {
+			if r != role {
+				roles = append(roles, r)
+			}
+		}
+
+		user.Roles = roles
+	})
+}
+
+func (s *memoryUserStore) UpdatePassword(ctx context.Context, id string, hashedPassword string, historySize int) error {
+	return s.update(ctx, id, func(user *User) {
+		history := []string{}
+		if historySize > 0 {
+			history = append(append(history, user.PasswordHistory...), user.Password)
+			if len(history) > historySize {
+				history = history[len(history)-historySize:]
+			}
+		}
+
+		user.Password = hashedPassword
+		user.PasswordHistory = history
+	})
+}
+
+func (s *memoryUserStore) MarkEmailVerified(ctx context.Context, id primitive.ObjectID, email string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok || user.Email != email {
+		return errors.New("email has changed since the verification was sent")
+	}
+
+	user.EmailVerified = true
+	return nil
+}
+
+func (s *memoryUserStore) SetPendingTOTPSecret(ctx context.Context, id primitive.ObjectID, secret string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[id]; ok {
+		user.TOTPPendingSecret = secret
+	}
+
+	return nil
+}
+
+func (s *memoryUserStore) EnableTOTP(ctx context.Context, id primitive.ObjectID, secret string, step int64, recoveryCodeHashes []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok || user.TOTPPendingSecret == "" || user.TOTPPendingSecret != secret {
+		return errors.New("two-factor enrolment has changed, start again")
+	}
+
+	user.TOTPEnabled = true
+	user.TOTPSecret = secret
+	user.TOTPLastStep = step
+	user.RecoveryCodes = append([]string(nil), recoveryCodeHashes...)
+	user.TOTPPendingSecret = ""
+
+	return nil
+}
+
+func (s *memoryUserStore) DisableTOTP(ctx context.Context, id primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[id]; ok {
+		user.TOTPEnabled = false
+		user.TOTPSecret = ""
+		user.TOTPPendingSecret = ""
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+	}
+
+	return nil
+}
+
+func (s *memoryUserStore) UseTOTPStep(ctx context.Context, id primitive.ObjectID, step int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok || user.TOTPLastStep >= step {
+		return ErrTOTPCodeReused
+	}
+
+	user.TOTPLastStep = step
+	return nil
+}
+
+func (s *memoryUserStore) ConsumeRecoveryCode(ctx context.Context, id primitive.ObjectID, codeHash string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return false, nil
+	}
+
+	for i, code := range user.RecoveryCodes {
+		if code == codeHash {
+			user.RecoveryCodes = append(user.RecoveryCodes[:i:i], user.RecoveryCodes[i+1:]...)
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *memoryUserStore) GetUserByIdentity(ctx context.Context, provider, subject string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.findOne(func(u *User) bool {
+		if u.DeletedAt != nil {
+			return false
+		}
+
+		for _, identity := range u.Identities {
+			if identity.Provider == provider && identity.Subject == subject {
+				return true
+			}
+		}
+
+		return false
+	}), nil
+}
+
+func (s *memoryUserStore) LinkIdentity(ctx context.Context, id primitive.ObjectID, identity Identity) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	identity.LinkedAt = time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return ErrIdentityAlreadyLinked
+	}
+
+	for _, other := range s.users {
+		for _, linked := range other.Identities {
+			if other == user && linked.Provider == identity.Provider {
+				return ErrIdentityAlreadyLinked
+			}
+
+			if linked.Provider == identity.Provider && linked.Subject == identity.Subject {
+				return ErrIdentityAlreadyLinked
+			}
+		}
+	}
+
+	user.Identities = append(user.Identities, identity)
+	return nil
+}
+
+func (s *memoryUserStore) AddMembership(ctx context.Context, userID primitive.ObjectID, membership Membership) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	membership.JoinedAt = time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	if user.Membership(membership.OrgID) != nil {
+		return ErrAlreadyMember
+	}
+
+	user.Memberships = append(user.Memberships, membership)
+	return nil
+}
+
+func (s *memoryUserStore) UpdateMembershipRole(ctx context.Context, userID, orgID primitive.ObjectID, role string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok || user.Membership(orgID) == nil {
+		return ErrNotMember
+	}
+
+	user.Membership(orgID).Role = role
+	return nil
+}
+
+func (s *memoryUserStore) RemoveMembership(ctx context.Context, userID, orgID primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok || user.Membership(orgID) == nil {
+		return ErrNotMember
+	}
+
+	memberships := []Membership{}
+	for _, membership := range user.Memberships {
+		if membership.OrgID != orgID {
+			memberships = append(memberships, membership)
+		}
+	}
+
+	user.Memberships = memberships
+	return nil
+}
+
+func (s *memoryUserStore) ListOrgMembers(ctx context.Context, orgID primitive.ObjectID) ([]*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.find(func(u *User) bool { return u.DeletedAt == nil && u.Membership(orgID) != nil }), nil
+}
+
+func (s *memoryUserStore) ListUsers(ctx context.Context, filter UserFilter) (*UserPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	cursor, err := decodePageToken(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// compare orders two users like the sort of the Mongo store
+	compare := func(a, b *User) int {
+		var c int
+		if filter.SortBy == UserSortName {
+			c = strings.Compare(a.Name, b.Name)
+		} else {
+			c = a.CreatedAt.Compare(b.CreatedAt)
+		}
+		if c == 0 {
+			c = bytes.Compare(a.ID[:], b.ID[:])
+		}
+		if filter.Descending {
+			c = -c
+		}
+
+		return c
+	}
+
+	var last *User
+	if cursor != nil {
+		last = &User{ID: cursor.ID, Name: cursor.Value}
+		if cursor.SortBy == UserSortCreatedAt {
+			last.CreatedAt, _ = time.Parse(time.RFC3339Nano, cursor.Value)
+		}
+	}
+
+	s.mu.RLock()
+	users := s.find(func(u *User) bool {
+		switch {
+		case u.DeletedAt != nil:
+			return false
+		case !strings.HasPrefix(u.Name, filter.NamePrefix), !strings.HasPrefix(u.Email, filter.EmailPrefix):
+			return false
+		case filter.OrgID != nil && u.Membership(*filter.OrgID) == nil:
+			return false
+		case !filter.From.IsZero() && u.CreatedAt.Before(filter.From):
+			return false
+		case !filter.To.IsZero() && u.CreatedAt.After(filter.To):
+			return false
+		}
+
+		return last == nil || compare(u, last) > 0
+	})
+	s.mu.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool { return compare(users[i], users[j]) < 0 })
+	if filter.Limit > 0 && int64(len(users)) > filter.Limit+1 {
+		users = users[:filter.Limit+1]
+	}
+
+	return newUserPage(filter, users), nil
+}
+
+func (s *memoryUserStore) CountUsers(ctx context.Context) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var count int64
+	for _, user := range s.users {
+		if user.DeletedAt == nil {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// SearchUsers ranks users by the query terms their name and email share,
+// weighted like the text index of the Mongo store.
+func (s *memoryUserStore) SearchUsers(ctx context.Context, query UserSearch) (*UserPage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	cursor, err := decodeSearchToken(query.PageToken)
+	if err != nil {
+		return nil, err
+	}
+
+	match := func(u *User) bool {
+		return u.DeletedAt == nil && (query.OrgID == nil || u.Membership(*query.OrgID) != nil)
+	}
+
+	terms := search.Terms(query.Query)
+	if len(terms) > 0 && (cursor == nil || cursor.SortBy == searchByText) {
+		var after float64
+		if cursor != nil {
+			after, _ = strconv.ParseFloat(cursor.Value, 64)
+		}
+
+		s.mu.RLock()
+		users := stripSecrets(s.find(match))
+		s.mu.RUnlock()
+
+		results := []*scoredUser{}
+		for _, user := range users {
+			score := termScore(terms, search.Terms(user.Name), 3) + termScore(terms, search.Terms(user.Email), 2)
+			if score == 0 {
+				continue
+			}
+
+			if cursor != nil && (score > after || (score == after && bytes.Compare(user.ID[:], cursor.ID[:]) <= 0)) {
+				continue
+			}
+
+			results = append(results, &scoredUser{User: *user, Score: score})
+		}
+
+		sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+		if cursor != nil || len(results) > 0 {
+			return newSearchPage(query, results), nil
+		}
+	}
+
+	if cursor != nil && cursor.SortBy != searchByPrefix {
+		return nil, ErrInvalidPageToken
+	}
+
+	prefix := strings.ToLower(query.Query)
+
+	s.mu.RLock()
+	users := s.find(func(u *User) bool {
+		if !match(u) {
+			return false
+		}
+
+		if !strings.HasPrefix(strings.ToLower(u.Name), prefix) && !strings.HasPrefix(strings.ToLower(u.Email), prefix) {
+			return false
+		}
+
+		return cursor == nil || u.Name > cursor.Value || (u.Name == cursor.Value && bytes.Compare(u.ID[:], cursor.ID[:]) > 0)
+	})
+	s.mu.RUnlock()
+
+	sort.SliceStable(users, func(i, j int) bool { return users[i].Name < users[j].Name })
+
+	return newPrefixPage(query, stripSecrets(users)), nil
+}
+
+// stripSecrets is searchProjection.
+func stripSecrets(users []*User) []*User {
+	for _, user := range users {
+		user.Password = ""
+		user.PasswordHistory = nil
+		user.TOTPSecret = ""
+		user.TOTPPendingSecret = ""
+		user.RecoveryCodes = nil
+	}
+
+	return users
+}
+
+func termScore(query, terms []string, weight float64) float64 {
+	var score float64
+	for _, term := range terms {
+		for _, q := range query {
+			if term == q {
+				score += weight
+			}
+		}
+	}
+
+	return score
+}
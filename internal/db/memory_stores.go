@@ -0,0 +1,924 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The stores below keep the rest of the API's state in the process, so
+// that STORE=memory runs without a database. Each follows its Mongo
+// counterpart, expired documents included: what a TTL index would have
+// removed is treated as gone and dropped on the next insert.
+
+var errDuplicateID = errors.New("duplicate id")
+
+type memoryOrganizationStore struct {
+	mu   sync.RWMutex
+	orgs map[primitive.ObjectID]Organization
+}
+
+func NewMemoryOrganizationStore() OrganizationStore {
+	return &memoryOrganizationStore{orgs: make(map[primitive.ObjectID]Organization)}
+}
+
+func (s *memoryOrganizationStore) InsertOrganization(ctx context.Context, org Organization) (*Organization, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.orgs {
+		if existing.Slug == org.Slug {
+			return nil, ErrOrganizationSlugTaken
+		}
+	}
+
+	org.ID = primitive.NewObjectID()
+	org.CreatedAt = time.Now()
+	s.orgs[org.ID] = org
+
+	return &org, nil
+}
+
+func (s *memoryOrganizationStore) GetOrganization(ctx context.Context, id primitive.ObjectID) (*Organization, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	org, ok := s.orgs[id]
+	if !ok {
+		return nil, ErrOrganizationNotFound
+	}
+
+	return &org, nil
+}
+
+func (s *memoryOrganizationStore) GetOrganizationBySlug(ctx context.Context, slug string) (*Organization, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, org := range s.orgs {
+		if org.Slug == slug {
+			return &org, nil
+		}
+	}
+
+	return nil, ErrOrganizationNotFound
+}
+
+func (s *memoryOrganizationStore) ListOrganizations(ctx context.Context, ids []primitive.ObjectID) ([]*Organization, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orgs := []*Organization{}
+	for _, id := range ids {
+		if org, ok := s.orgs[id]; ok {
+			orgs = append(orgs, &org)
+		}
+	}
+
+	sort.Slice(orgs, func(i, j int) bool { return orgs[i].Name < orgs[j].Name })
+
+	return orgs, nil
+}
+
+func (s *memoryOrganizationStore) UpdateOrganization(ctx context.Context, id primitive.ObjectID, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	org, ok := s.orgs[id]
+	if !ok {
+		return ErrOrganizationNotFound
+	}
+
+	org.Name = name
+	s.orgs[id] = org
+
+	return nil
+}
+
+func (s *memoryOrganizationStore) DeleteOrganization(ctx context.Context, id primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.orgs[id]; !ok {
+		return ErrOrganizationNotFound
+	}
+
+	delete(s.orgs, id)
+
+	return nil
+}
+
+type memorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]Session
+}
+
+func NewMemorySessionStore() SessionStore {
+	return &memorySessionStore{sessions: make(map[string]Session)}
+}
+
+func (s *memorySessionStore) CreateSession(ctx context.Context, session Session) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, existing := range s.sessions {
+		if now.After(existing.ExpiresAt) {
+			delete(s.sessions, id)
+		}
+	}
+
+	if _, ok := s.sessions[session.ID]; ok {
+		return errDuplicateID
+	}
+
+	session.CreatedAt = now
+	s.sessions[session.ID] = session
+
+	return nil
+}
+
+func (s *memorySessionStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	session, ok := s.sessions[id]
+	if !ok || time.Now().After(session.ExpiresAt) {
+		return nil, ErrSessionNotFound
+	}
+
+	return &session, nil
+}
+
+func (s *memorySessionStore) ExtendSession(ctx context.Context, id string, expiresAt time.Time) error {
+	return s.update(ctx, func(session *Session) bool { return session.ID == id }, func(session *Session) {
+		session.ExpiresAt = expiresAt
+	})
+}
+
+func (s *memorySessionStore) RevokeSession(ctx context.Context, id string) error {
+	_, err := s.revoke(ctx, func(session *Session) bool { return session.ID == id })
+	return err
+}
+
+func (s *memorySessionStore) RevokeUserSessions(ctx context.Context, userID primitive.ObjectID) (int64, error) {
+	return s.revoke(ctx, func(session *Session) bool { return session.UserID == userID })
+}
+
+func (s *memorySessionStore) RevokeOtherUserSessions(ctx context.Context, userID primitive.ObjectID, keepID string) (int64, error) {
+	return s.revoke(ctx, func(session *Session) bool { return session.UserID == userID && session.ID != keepID })
+}
+
+func (s *memorySessionStore) SetSessionOrg(ctx context.Context, id string, orgID primitive.ObjectID) error {
+	return s.update(ctx, func(session *Session) bool { return session.ID == id }, func(session *Session) {
+		session.OrgID = &orgID
+	})
+}
+
+func (s *memorySessionStore) RevokeUserOrgSessions(ctx context.Context, userID, orgID primitive.ObjectID) (int64, error) {
+	return s.revoke(ctx, func(session *Session) bool {
+		return session.UserID == userID && session.OrgID != nil && *session.OrgID == orgID
+	})
+}
+
+// revoke revokes the matching sessions that are not revoked yet and counts
+// them.
+func (s *memorySessionStore) revoke(ctx context.Context, match func(*Session) bool) (int64, error) {
+	var revoked int64
+	now := time.Now()
+
+	err := s.update(ctx, func(session *Session) bool { return !session.IsRevoked() && match(session) }, func(session *Session) {
+		session.RevokedAt = &now
+		revoked++
+	})
+
+	return revoked, err
+}
+
+func (s *memorySessionStore) update(ctx context.Context, match func(*Session) bool, fn func(*Session)) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, session := range s.sessions {
+		if match(&session) {
+			fn(&session)
+			s.sessions[id] = session
+		}
+	}
+
+	return nil
+}
+
+type memoryRefreshTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]RefreshToken
+}
+
+func NewMemoryRefreshTokenStore() RefreshTokenStore {
+	return &memoryRefreshTokenStore{tokens: make(map[string]RefreshToken)}
+}
+
+func (s *memoryRefreshTokenStore) InsertRefreshToken(ctx context.Context, token RefreshToken) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, existing := range s.tokens {
+		if now.After(existing.ExpiresAt) {
+			delete(s.tokens, id)
+		}
+	}
+
+	if _, ok := s.tokens[token.SessionID]; ok {
+		return errDuplicateID
+	}
+
+	token.CreatedAt = now
+	s.tokens[token.SessionID] = token
+
+	return nil
+}
+
+func (s *memoryRefreshTokenStore) GetRefreshToken(ctx context.Context, sessionID string) (*RefreshToken, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[sessionID]
+	if !ok || time.Now().After(token.ExpiresAt) {
+		return nil, ErrRefreshTokenNotFound
+	}
+
+	return &token, nil
+}
+
+func (s *memoryRefreshTokenStore) RotateRefreshToken(ctx context.Context, sessionID, oldHash, newHash string, expiresAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[sessionID]
+	if !ok || token.TokenHash != oldHash || token.Revoked {
+		return ErrRefreshTokenReused
+	}
+
+	token.TokenHash = newHash
+	token.ExpiresAt = expiresAt
+	token.RotatedAt = time.Now()
+	s.tokens[sessionID] = token
+
+	return nil
+}
+
+func (s *memoryRefreshTokenStore) RevokeRefreshToken(ctx context.Context, sessionID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if token, ok := s.tokens[sessionID]; ok {
+		token.Revoked = true
+		s.tokens[sessionID] = token
+	}
+
+	return nil
+}
+
+type memoryPasswordResetStore struct {
+	mu     sync.Mutex
+	resets map[string]PasswordReset
+}
+
+func NewMemoryPasswordResetStore() PasswordResetStore {
+	return &memoryPasswordResetStore{resets: make(map[string]PasswordReset)}
+}
+
+// InsertPasswordReset drops the earlier tokens of the user, as the Mongo
+// store does.
+func (s *memoryPasswordResetStore) InsertPasswordReset(ctx context.Context, reset PasswordReset) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for hash, existing := range s.resets {
+		if existing.UserID == reset.UserID || now.After(existing.ExpiresAt) {
+			delete(s.resets, hash)
+		}
+	}
+
+	reset.CreatedAt = now
+	s.resets[reset.TokenHash] = reset
+
+	return nil
+}
+
+func (s *memoryPasswordResetStore) GetPasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reset, ok := s.resets[tokenHash]
+	if !ok || reset.UsedAt != nil || !time.Now().Before(reset.ExpiresAt) {
+		return nil, ErrPasswordResetInvalid
+	}
+
+	return &reset, nil
+}
+
+func (s *memoryPasswordResetStore) ConsumePasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	reset, ok := s.resets[tokenHash]
+	if !ok || reset.UsedAt != nil || !now.Before(reset.ExpiresAt) {
+		return nil, ErrPasswordResetInvalid
+	}
+
+	reset.UsedAt = &now
+	s.resets[tokenHash] = reset
+
+	return &reset, nil
+}
+
+type memoryEmailVerificationStore struct {
+	mu            sync.Mutex
+	verifications map[string]EmailVerification
+}
+
+func NewMemoryEmailVerificationStore() EmailVerificationStore {
+	return &memoryEmailVerificationStore{verifications: make(map[string]EmailVerification)}
+}
+
+func (s *memoryEmailVerificationStore) InsertEmailVerification(ctx context.Context, verification EmailVerification) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for hash, existing := range s.verifications {
+		if now.After(existing.ExpiresAt) {
+			delete(s.verifications, hash)
+		}
+	}
+
+	if _, ok := s.verifications[verification.TokenHash]; ok {
+		return errDuplicateID
+	}
+
+	verification.CreatedAt = now
+	s.verifications[verification.TokenHash] = verification
+
+	return nil
+}
+
+func (s *memoryEmailVerificationStore) ConsumeEmailVerification(ctx context.Context, tokenHash string) (*EmailVerification, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	verification, ok := s.verifications[tokenHash]
+	if !ok || verification.UsedAt != nil || !now.Before(verification.ExpiresAt) {
+		return nil, ErrEmailVerificationInvalid
+	}
+
+	verification.UsedAt = &now
+	s.verifications[tokenHash] = verification
+
+	return &verification, nil
+}
+
+func (s *memoryEmailVerificationStore) CountEmailVerificationsSince(ctx context.Context, userID primitive.ObjectID, since time.Time) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var count int64
+	for _, verification := range s.verifications {
+		if verification.UserID == userID && verification.CreatedAt.After(since) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+type memoryLoginAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]LoginAttempt
+}
+
+func NewMemoryLoginAttemptStore() LoginAttemptStore {
+	return &memoryLoginAttemptStore{attempts: make(map[string]LoginAttempt)}
+}
+
+// live returns the attempt of key unless it has expired.
+func (s *memoryLoginAttemptStore) live(key string, now time.Time) (LoginAttempt, bool) {
+	attempt, ok := s.attempts[key]
+	if ok && now.After(attempt.ExpiresAt) {
+		delete(s.attempts, key)
+		return LoginAttempt{}, false
+	}
+
+	return attempt, ok
+}
+
+func (s *memoryLoginAttemptStore) GetLoginAttempt(ctx context.Context, key string) (*LoginAttempt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempt, ok := s.live(key, time.Now())
+	if !ok {
+		return nil, nil
+	}
+
+	return &attempt, nil
+}
+
+func (s *memoryLoginAttemptStore) RecordLoginFailure(ctx context.Context, key string, window time.Duration) (*LoginAttempt, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+
+	attempt, ok := s.live(key, now)
+	if ok && attempt.LastFailureAt.After(now.Add(-window)) {
+		attempt.Failures++
+	} else {
+		attempt.Key = key
+		attempt.Failures = 1
+	}
+
+	attempt.LastFailureAt = now
+	attempt.ExpiresAt = now.Add(window)
+	s.attempts[key] = attempt
+
+	return &attempt, nil
+}
+
+func (s *memoryLoginAttemptStore) LockLoginAttempt(ctx context.Context, key string, until time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if attempt, ok := s.live(key, time.Now()); ok {
+		attempt.LockedUntil = &until
+		attempt.ExpiresAt = until
+		s.attempts[key] = attempt
+	}
+
+	return nil
+}
+
+func (s *memoryLoginAttemptStore) ResetLoginAttempts(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.attempts, key)
+
+	return nil
+}
+
+type memoryOIDCStateStore struct {
+	mu     sync.Mutex
+	states map[string]OIDCState
+}
+
+func NewMemoryOIDCStateStore() OIDCStateStore {
+	return &memoryOIDCStateStore{states: make(map[string]OIDCState)}
+}
+
+func (s *memoryOIDCStateStore) InsertOIDCState(ctx context.Context, state OIDCState) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for hash, existing := range s.states {
+		if now.After(existing.ExpiresAt) {
+			delete(s.states, hash)
+		}
+	}
+
+	if _, ok := s.states[state.StateHash]; ok {
+		return errDuplicateID
+	}
+
+	state.CreatedAt = now
+	s.states[state.StateHash] = state
+
+	return nil
+}
+
+func (s *memoryOIDCStateStore) ConsumeOIDCState(ctx context.Context, stateHash string) (*OIDCState, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	state, ok := s.states[stateHash]
+	delete(s.states, stateHash)
+
+	if !ok || !time.Now().Before(state.ExpiresAt) {
+		return nil, ErrOIDCStateInvalid
+	}
+
+	return &state, nil
+}
+
+type memoryAPIKeyStore struct {
+	mu   sync.RWMutex
+	keys map[primitive.ObjectID]APIKey
+}
+
+func NewMemoryAPIKeyStore() APIKeyStore {
+	return &memoryAPIKeyStore{keys: make(map[primitive.ObjectID]APIKey)}
+}
+
+func cloneAPIKey(key APIKey) *APIKey {
+	key.Scopes = append([]string(nil), key.Scopes...)
+	return &key
+}
+
+func (s *memoryAPIKeyStore) InsertAPIKey(ctx context.Context, key APIKey) (*APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.keys {
+		if existing.KeyHash == key.KeyHash {
+			return nil, errDuplicateID
+		}
+	}
+
+	key.ID = primitive.NewObjectID()
+	key.CreatedAt = time.Now()
+	s.keys[key.ID] = *cloneAPIKey(key)
+
+	return cloneAPIKey(key), nil
+}
+
+func (s *memoryAPIKeyStore) GetAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, key := range s.keys {
+		if key.KeyHash == keyHash {
+			return cloneAPIKey(key), nil
+		}
+	}
+
+	return nil, ErrAPIKeyNotFound
+}
+
+func (s *memoryAPIKeyStore) GetAPIKey(ctx context.Context, id primitive.ObjectID) (*APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, ok := s.keys[id]
+	if !ok {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	return cloneAPIKey(key), nil
+}
+
+func (s *memoryAPIKeyStore) ListAPIKeys(ctx context.Context, userID primitive.ObjectID) ([]*APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := []*APIKey{}
+	for _, key := range s.keys {
+		if key.UserID == userID {
+			keys = append(keys, cloneAPIKey(key))
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.After(keys[j].CreatedAt) })
+
+	return keys, nil
+}
+
+func (s *memoryAPIKeyStore) RevokeAPIKey(ctx context.Context, userID, id primitive.ObjectID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[id]
+	if !ok || key.UserID != userID || key.RevokedAt != nil {
+		return ErrAPIKeyNotFound
+	}
+
+	now := time.Now()
+	key.RevokedAt = &now
+	s.keys[id] = key
+
+	return nil
+}
+
+func (s *memoryAPIKeyStore) TouchAPIKey(ctx context.Context, id primitive.ObjectID, usedAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key, ok := s.keys[id]; ok {
+		key.LastUsedAt = &usedAt
+		s.keys[id] = key
+	}
+
+	return nil
+}
+
+// memoryAuditEventStore keeps the hash chain in a slice, event Seq n is at
+// index n-1.
+type memoryAuditEventStore struct {
+	mu     sync.RWMutex
+	events []AuditEvent
+}
+
+func NewMemoryAuditEventStore() AuditEventStore {
+	return &memoryAuditEventStore{}
+}
+
+func (s *memoryAuditEventStore) AppendAuditEvent(ctx context.Context, event AuditEvent) (*AuditEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// truncated like the Mongo store, so both hash the same
+	event.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	event.Seq = int64(len(s.events)) + 1
+	event.PrevHash = ""
+	if len(s.events) > 0 {
+		event.PrevHash = s.events[len(s.events)-1].Hash
+	}
+	event.Hash = event.ComputeHash()
+
+	s.events = append(s.events, event)
+
+	return &event, nil
+}
+
+func (s *memoryAuditEventStore) ListAuditEvents(ctx context.Context, filter AuditEventFilter) ([]*AuditEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	events := []*AuditEvent{}
+	for i := len(s.events) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && int64(len(events)) == filter.Limit {
+			break
+		}
+
+		event := s.events[i]
+		switch {
+		case !filter.ActorID.IsZero() && event.ActorID != filter.ActorID,
+			!filter.TargetID.IsZero() && event.TargetID != filter.TargetID,
+			filter.Action != "" && event.Action != filter.Action,
+			filter.BeforeSeq > 0 && event.Seq >= filter.BeforeSeq,
+			!filter.From.IsZero() && event.CreatedAt.Before(filter.From),
+			!filter.To.IsZero() && event.CreatedAt.After(filter.To):
+			continue
+		}
+
+		events = append(events, &event)
+	}
+
+	return events, nil
+}
+
+func (s *memoryAuditEventStore) VerifyAuditChain(ctx context.Context) (*AuditChainReport, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	report := &AuditChainReport{Valid: true}
+	var prev AuditEvent
+
+	for _, event := range s.events {
+		switch {
+		case event.Seq != prev.Seq+1:
+			report.Reason = fmt.Sprintf("expected event %d", prev.Seq+1)
+		case event.PrevHash != prev.Hash:
+			report.Reason = "previous hash does not match"
+		case event.Hash != event.ComputeHash():
+			report.Reason = "event hash does not match its content"
+		}
+
+		if report.Reason != "" {
+			report.Valid = false
+			report.BrokenAtSeq = event.Seq
+			return report, nil
+		}
+
+		report.Checked++
+		prev = event
+	}
+
+	return report, nil
+}
+
+type memorySigningKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]SigningKey
+}
+
+func NewMemorySigningKeyStore() SigningKeyStore {
+	return &memorySigningKeyStore{keys: make(map[string]SigningKey)}
+}
+
+func (s *memorySigningKeyStore) InsertSigningKey(ctx context.Context, key SigningKey) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.keys[key.ID]; ok {
+		return errDuplicateID
+	}
+
+	s.keys[key.ID] = key
+
+	return nil
+}
+
+func (s *memorySigningKeyStore) ListSigningKeys(ctx context.Context) ([]*SigningKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := []*SigningKey{}
+	for _, key := range s.keys {
+		key := key
+		keys = append(keys, &key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+
+	return keys, nil
+}
+
+func (s *memorySigningKeyStore) RetireSigningKey(ctx context.Context, id string, retiredAt time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key, ok := s.keys[id]; ok && key.RetiredAt == nil {
+		key.RetiredAt = &retiredAt
+		s.keys[id] = key
+	}
+
+	return nil
+}
+
+func (s *memorySigningKeyStore) DeleteSigningKey(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, id)
+
+	return nil
+}
@@ -0,0 +1,361 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// withEmailUniqueness sets the mode for one test and puts the default back.
+func withEmailUniqueness(t *testing.T, mode string) {
+	t.Helper()
+
+	if err := SetEmailUniqueness(mode); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { emailUniqueness = EmailUniqueGlobal })
+}
+
+func insertUser(t *testing.T, store MongoClient, name, email string, tenantID *primitive.ObjectID) *User {
+	t.Helper()
+
+	user, err := store.Insert(context.Background(), User{Name: name, Email: email, Password: "password123", TenantID: tenantID})
+	if err != nil {
+		t.Fatalf("insert %s: %v", email, err)
+	}
+
+	return user
+}
+
+func userNames(users []*User) []string {
+	names := []string{}
+	for _, user := range users {
+		names = append(names, user.Name)
+	}
+
+	return names
+}
+
+func equalNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestMemoryUserStoreDuplicateEmail(t *testing.T) {
+	tenantA := primitive.NewObjectID()
+	tenantB := primitive.NewObjectID()
+
+	tests := []struct {
+		name    string
+		mode    string
+		first   *primitive.ObjectID
+		second  *primitive.ObjectID
+		wantErr error
+	}{
+		{"global without tenants", EmailUniqueGlobal, nil, nil, ErrEmailTaken},
+		{"global across tenants", EmailUniqueGlobal, &tenantA, &tenantB, ErrEmailTaken},
+		{"global tenant and none", EmailUniqueGlobal, &tenantA, nil, ErrEmailTaken},
+		{"tenant same tenant", EmailUniqueTenant, &tenantA, &tenantA, ErrEmailTaken},
+		{"tenant without tenants", EmailUniqueTenant, nil, nil, ErrEmailTaken},
+		{"tenant across tenants", EmailUniqueTenant, &tenantA, &tenantB, nil},
+		{"tenant tenant and none", EmailUniqueTenant, &tenantA, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withEmailUniqueness(t, tt.mode)
+
+			store := NewMemoryUserStore()
+			insertUser(t, store, "Alice", "alice@example.com", tt.first)
+
+			_, err := store.Insert(context.Background(), User{Name: "Alice", Email: "alice@example.com", Password: "password123", TenantID: tt.second})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("second insert: got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMemoryUserStoreSoftDelete(t *testing.T) {
+	tests := []struct {
+		name         string
+		releaseEmail bool
+		// retake signs up a new account with the email while the user is
+		// in the trash.
+		retake         bool
+		wantRetakeErr  error
+		wantRestoreErr error
+	}{
+		{"kept email", false, false, nil, nil},
+		{"kept email blocks sign up", false, true, ErrEmailTaken, nil},
+		{"released email", true, false, nil, nil},
+		{"released email taken again", true, true, nil, ErrEmailTaken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := NewMemoryUserStore()
+			user := insertUser(t, store, "Alice", "alice@example.com", nil)
+
+			if err := store.DeleteUser(ctx, user.ID, tt.releaseEmail); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := store.FetchUserByID(ctx, user.ID.Hex()); !errors.Is(err, ErrUserNotFound) {
+				t.Fatalf("fetch deleted user: got %v, want %v", err, ErrUserNotFound)
+			}
+
+			if err := store.DeleteUser(ctx, user.ID, tt.releaseEmail); !errors.Is(err, ErrUserNotFound) {
+				t.Fatalf("delete twice: got %v, want %v", err, ErrUserNotFound)
+			}
+
+			deleted, err := store.ListDeletedUsers(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(deleted) != 1 || deleted[0].ID != user.ID {
+				t.Fatalf("deleted users: got %v, want %s", deleted, user.ID.Hex())
+			}
+
+			if tt.retake {
+				_, err := store.Insert(ctx, User{Name: "Bob", Email: "alice@example.com", Password: "password123"})
+				if !errors.Is(err, tt.wantRetakeErr) {
+					t.Fatalf("retake email: got %v, want %v", err, tt.wantRetakeErr)
+				}
+			}
+
+			restored, err := store.RestoreUser(ctx, user.ID.Hex())
+			if !errors.Is(err, tt.wantRestoreErr) {
+				t.Fatalf("restore: got %v, want %v", err, tt.wantRestoreErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if restored.Email != "alice@example.com" || restored.DeletedAt != nil || restored.DeletedEmail != "" {
+				t.Fatalf("restored user: got email %q deleted at %v deleted email %q", restored.Email, restored.DeletedAt, restored.DeletedEmail)
+			}
+
+			if _, err := store.FetchUserByID(ctx, user.ID.Hex()); err != nil {
+				t.Fatalf("fetch restored user: %v", err)
+			}
+
+			if _, err := store.RestoreUser(ctx, user.ID.Hex()); !errors.Is(err, ErrDeletedUserNotFound) {
+				t.Fatalf("restore twice: got %v, want %v", err, ErrDeletedUserNotFound)
+			}
+		})
+	}
+}
+
+func TestMemoryUserStoreListUsersPaging(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryUserStore()
+
+	// inserted out of name order so the two sorts differ
+	for _, name := range []string{"Dave", "Alice", "Erin", "Carol", "Bob"} {
+		insertUser(t, store, name, name+"@example.com", nil)
+	}
+
+	deleted := insertUser(t, store, "Adam", "adam@example.com", nil)
+	if err := store.DeleteUser(ctx, deleted.ID, false); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter UserFilter
+		want   [][]string
+	}{
+		{
+			"name",
+			UserFilter{SortBy: UserSortName, Limit: 2},
+			[][]string{{"Alice", "Bob"}, {"Carol", "Dave"}, {"Erin"}},
+		},
+		{
+			"name descending",
+			UserFilter{SortBy: UserSortName, Descending: true, Limit: 2},
+			[][]string{{"Erin", "Dave"}, {"Carol", "Bob"}, {"Alice"}},
+		},
+		{
+			"created at",
+			UserFilter{SortBy: UserSortCreatedAt, Limit: 3},
+			[][]string{{"Dave", "Alice", "Erin"}, {"Carol", "Bob"}},
+		},
+		{
+			"exact last page",
+			UserFilter{SortBy: UserSortName, Limit: 5},
+			[][]string{{"Alice", "Bob", "Carol", "Dave", "Erin"}},
+		},
+		{
+			"name prefix",
+			UserFilter{SortBy: UserSortName, NamePrefix: "A", Limit: 1},
+			[][]string{{"Alice"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := tt.filter
+
+			var pages [][]string
+			for {
+				page, err := store.ListUsers(ctx, filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				pages = append(pages, userNames(page.Users))
+				if page.NextPageToken == "" {
+					break
+				}
+
+				if len(pages) > len(tt.want) {
+					t.Fatalf("more pages than %d: %v", len(tt.want), pages)
+				}
+				filter.PageToken = page.NextPageToken
+			}
+
+			if len(pages) != len(tt.want) {
+				t.Fatalf("pages: got %v, want %v", pages, tt.want)
+			}
+			for i := range pages {
+				if !equalNames(pages[i], tt.want[i]) {
+					t.Fatalf("pages: got %v, want %v", pages, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryUserStoreListUsersInvalidToken(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryUserStore()
+	for _, name := range []string{"Alice", "Bob"} {
+		insertUser(t, store, name, name+"@example.com", nil)
+	}
+
+	page, err := store.ListUsers(ctx, UserFilter{SortBy: UserSortName, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter UserFilter
+	}{
+		{"not base64", UserFilter{SortBy: UserSortName, PageToken: "%%%"}},
+		{"not json", UserFilter{SortBy: UserSortName, PageToken: "bm90IGpzb24"}},
+		{"other sort", UserFilter{SortBy: UserSortCreatedAt, PageToken: page.NextPageToken}},
+		{"other direction", UserFilter{SortBy: UserSortName, Descending: true, PageToken: page.NextPageToken}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := store.ListUsers(ctx, tt.filter); !errors.Is(err, ErrInvalidPageToken) {
+				t.Fatalf("got %v, want %v", err, ErrInvalidPageToken)
+			}
+		})
+	}
+}
+
+func TestMemoryUserStoreSearchUsers(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryUserStore()
+
+	orgID := primitive.NewObjectID()
+	users := []struct {
+		name  string
+		email string
+		org   bool
+	}{
+		{"Alice Smith", "alice@example.com", true},
+		{"Alicia Keys", "keys@example.com", false},
+		{"Bob Smith", "bob@smith.dev", true},
+		{"Carol Jones", "carol@example.com", false},
+		{"สมชาย ใจดี", "somchai@example.co.th", false},
+	}
+	for _, u := range users {
+		user := User{Name: u.name, Email: u.email, Password: "password123"}
+		if u.org {
+			user.Memberships = []Membership{{OrgID: orgID, Role: OrgRoleMember}}
+		}
+		if _, err := store.Insert(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deleted := insertUser(t, store, "Smith Deleted", "deleted@example.com", nil)
+	if err := store.DeleteUser(ctx, deleted.ID, false); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		query UserSearch
+		want  [][]string
+	}{
+		// the name weighs more than the email
+		{"ranked by term", UserSearch{Query: "smith"}, [][]string{{"Bob Smith", "Alice Smith"}}},
+		{"ranked pages", UserSearch{Query: "smith", Limit: 1}, [][]string{{"Bob Smith"}, {"Alice Smith"}}},
+		{"organization", UserSearch{Query: "example", OrgID: &orgID}, [][]string{{"Alice Smith"}}},
+		{"prefix fallback", UserSearch{Query: "ali"}, [][]string{{"Alice Smith", "Alicia Keys"}}},
+		{"prefix pages", UserSearch{Query: "ALI", Limit: 1}, [][]string{{"Alice Smith"}, {"Alicia Keys"}}},
+		{"thai piece", UserSearch{Query: "ใจดี"}, [][]string{{"สมชาย ใจดี"}}},
+		{"no match", UserSearch{Query: "zed"}, [][]string{{}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := tt.query
+
+			var pages [][]string
+			for {
+				page, err := store.SearchUsers(ctx, query)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for _, user := range page.Users {
+					if user.Password != "" {
+						t.Fatalf("search result %s has a password hash", user.Name)
+					}
+				}
+
+				pages = append(pages, userNames(page.Users))
+				if page.NextPageToken == "" {
+					break
+				}
+
+				if len(pages) > len(tt.want) {
+					t.Fatalf("more pages than %d: %v", len(tt.want), pages)
+				}
+				query.PageToken = page.NextPageToken
+			}
+
+			if len(pages) != len(tt.want) {
+				t.Fatalf("pages: got %v, want %v", pages, tt.want)
+			}
+			for i := range pages {
+				if !equalNames(pages[i], tt.want[i]) {
+					t.Fatalf("pages: got %v, want %v", pages, tt.want)
+				}
+			}
+		})
+	}
+
+	if _, err := store.SearchUsers(ctx, UserSearch{Query: "smith", PageToken: "bm90IGpzb24"}); !errors.Is(err, ErrInvalidPageToken) {
+		t.Fatalf("invalid token: got %v, want %v", err, ErrInvalidPageToken)
+	}
+}
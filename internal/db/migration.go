@@ -0,0 +1,293 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	migrationCollection     = "schema_migrations"
+	migrationLockCollection = "schema_migrations_lock"
+	migrationLockID         = "migrations"
+	// migrationLockTTL frees the lock of a process that died while
+	// migrating. The lock is renewed before every step.
+	migrationLockTTL = 10 * time.Minute
+)
+
+var (
+	ErrSchemaBehind    = errors.New("database schema is behind, run the migrate command")
+	ErrMigrationLocked = errors.New("another process is running migrations")
+)
+
+// Migration is a versioned step of the schema of the users database. Down
+// undoes Up. Both may be run again after failing halfway, so they have to
+// be idempotent.
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(ctx context.Context, database *mongo.Database) error
+	Down    func(ctx context.Context, database *mongo.Database) error
+}
+
+// MigrationStatus is a migration and when it was applied, AppliedAt is nil
+// while it is pending.
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+	// Unknown is set for a version applied by a newer build.
+	Unknown bool
+}
+
+type appliedMigration struct {
+	Version   int       `bson:"_id"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"applied_at"`
+}
+
+type Migrator struct {
+	database   *mongo.Database
+	migrations []Migration
+	// owner tells this process's lock apart from the others.
+	owner string
+}
+
+func NewMigrator(mongo *mongo.Client) *Migrator {
+	hostname, _ := os.Hostname()
+
+	return &Migrator{
+		database:   mongo.Database("users"),
+		migrations: migrations,
+		owner:      fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), primitive.NewObjectID().Hex()),
+	}
+}
+
+// lock takes the migration lock, or extends it when this process already
+// holds it.
+func (m *Migrator) lock(ctx context.Context) error {
+	now := time.Now()
+
+	filter := bson.M{
+		"_id": migrationLockID,
+		"$or": bson.A{
+			bson.M{"owner": m.owner},
+			bson.M{"expires_at": bson.M{"$lt": now}},
+		},
+	}
+	update := bson.M{"$set": bson.M{"owner": m.owner, "expires_at": now.Add(migrationLockTTL)}}
+
+	// a lock held by someone else does not match, the upsert then collides
+	// with it on _id
+	_, err := m.database.Collection(migrationLockCollection).UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrMigrationLocked
+	}
+
+	return err
+}
+
+func (m *Migrator) unlock(ctx context.Context) {
+	_, err := m.database.Collection(migrationLockCollection).DeleteOne(ctx, bson.M{"_id": migrationLockID, "owner": m.owner})
+	if err != nil {
+		log.Println("failed to release the migration lock:", err)
+	}
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int]appliedMigration, error) {
+	cursor, err := m.database.Collection(migrationCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	var records []appliedMigration
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, err
+	}
+
+	applied := make(map[int]appliedMigration, len(records))
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+
+	return applied, nil
+}
+
+// Status lists every migration in order, versions applied by a newer build
+// included.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []MigrationStatus{}
+	for _, migration := range m.migrations {
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if record, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &record.AppliedAt
+			delete(applied, migration.Version)
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	for _, record := range applied {
+		record := record
+		statuses = append(statuses, MigrationStatus{
+			Version:   record.Version,
+			Name:      record.Name,
+			AppliedAt: &record.AppliedAt,
+			Unknown:   true,
+		})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+
+	return statuses, nil
+}
+
+// Up applies the pending migrations in order and returns them. It stops at
+// the first failure, the migrations before it stay applied.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.unlock(context.Background())
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	done := []Migration{}
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+
+		if err := m.lock(ctx); err != nil {
+			return done, err
+		}
+
+		log.Printf("applying migration %d %s\n", migration.Version, migration.Name)
+		if err := migration.Up(ctx, m.database); err != nil {
+			return done, fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+		}
+
+		record := appliedMigration{Version: migration.Version, Name: migration.Name, AppliedAt: time.Now()}
+		if _, err := m.database.Collection(migrationCollection).InsertOne(ctx, record); err != nil {
+			return done, err
+		}
+
+		done = append(done, migration)
+	}
+
+	// the email index follows EMAIL_UNIQUENESS rather than a version
+	if err := createEmailUniqueIndex(ctx, m.database.Collection("users")); err != nil {
+		return done, fmt.Errorf("email index: %w", err)
+	}
+
+	return done, nil
+}
+
+// Down reverts the last steps applied migrations, the latest first, and
+// returns them.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	if err := m.lock(ctx); err != nil {
+		return nil, err
+	}
+	defer m.unlock(context.Background())
+
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]int, 0, len(applied))
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+	known := make(map[int]Migration, len(m.migrations))
+	for _, migration := range m.migrations {
+		known[migration.Version] = migration
+	}
+
+	done := []Migration{}
+	for _, version := range versions {
+		if len(done) == steps {
+			break
+		}
+
+		migration, ok := known[version]
+		if !ok {
+			return done, fmt.Errorf("migration %d was applied by a newer build, revert it with that build", version)
+		}
+
+		if err := m.lock(ctx); err != nil {
+			return done, err
+		}
+
+		log.Printf("reverting migration %d %s\n", migration.Version, migration.Name)
+		if err := migration.Down(ctx, m.database); err != nil {
+			return done, fmt.Errorf("migration %d %s: %w", migration.Version, migration.Name, err)
+		}
+
+		if _, err := m.database.Collection(migrationCollection).DeleteOne(ctx, bson.M{"_id": version}); err != nil {
+			return done, err
+		}
+
+		done = append(done, migration)
+	}
+
+	return done, nil
+}
+
+// CheckSchema fails with ErrSchemaBehind while migrations are pending or
+// the email index does not match EMAIL_UNIQUENESS.
+func (m *Migrator) CheckSchema(ctx context.Context) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	pending := 0
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			pending++
+		}
+	}
+
+	if pending > 0 {
+		return fmt.Errorf("%w: %d pending migrations", ErrSchemaBehind, pending)
+	}
+
+	names, err := m.database.Collection("users").Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return err
+	}
+
+	want := emailIndexName
+	if emailUniqueness == EmailUniqueTenant {
+		want = tenantEmailIndexName
+	}
+
+	for _, index := range names {
+		if index.Name == want {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: the email index does not match email uniqueness %s", ErrSchemaBehind, emailUniqueness)
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// migrations is the schema of the users database, oldest first. Append new
+// steps with the next version and never change one that was released.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		Up:      createBaselineIndexes,
+		Down:    dropBaselineIndexes,
+	},
+	{
+		Version: 2,
+		Name:    "user_list_indexes",
+		Up: func(ctx context.Context, database *mongo.Database) error {
+			return createListIndexes(ctx, database.Collection("users"))
+		},
+		Down: func(ctx context.Context, database *mongo.Database) error {
+			return dropIndexes(ctx, database.Collection("users"), "created_at_1__id_1", "name_1__id_1")
+		},
+	},
+	{
+		Version: 3,
+		Name:    "user_search_index",
+		Up: func(ctx context.Context, database *mongo.Database) error {
+			return createSearchIndex(ctx, database.Collection("users"))
+		},
+		Down: func(ctx context.Context, database *mongo.Database) error {
+			return dropIndexes(ctx, database.Collection("users"), "name_text_email_text_search_terms_text")
+		},
+	},
+	{
+		Version: 4,
+		Name:    "backfill_user_search_terms",
+		Up: func(ctx context.Context, database *mongo.Database) error {
+			return backfillSearchTerms(ctx, database.Collection("users"))
+		},
+		Down: func(ctx context.Context, database *mongo.Database) error {
+			_, err := database.Collection("users").UpdateMany(ctx,
+				bson.M{"search_terms": bson.M{"$exists": true}},
+				bson.M{"$unset": bson.M{"search_terms": ""}},
+			)
+			return err
+		},
+	},
+}
+
+// baselineIndexes are the collections and indexes that existed before
+// migrations did. The unique email index is left to Migrator.Up, it
+// depends on EMAIL_UNIQUENESS.
+var baselineIndexes = []struct {
+	collection string
+	create     func(ctx context.Context, collection *mongo.Collection) error
+}{
+	{"users", createIdentityIndex},
+	{"users", createMembershipIndex},
+	{"users", createDeletedAtIndex},
+	{"api_keys", createAPIKeyIndexes},
+	{"audit_events", createAuditEventIndexes},
+	{"email_verifications", createEmailVerificationIndexes},
+	{"login_attempts", createLoginAttemptIndex},
+	{"oidc_states", createOIDCStateIndex},
+	{"organizations", createOrganizationIndexes},
+	{"password_resets", createPasswordResetIndexes},
+	{"rate_limits", createRateLimitIndex},
+	{"refresh_tokens", createRefreshTokenIndexes},
+	{"sessions", createSessionIndexes},
+}
+
+func createBaselineIndexes(ctx context.Context, database *mongo.Database) error {
+	for _, index := range baselineIndexes {
+		if err := index.create(ctx, database.Collection(index.collection)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dropBaselineIndexes keeps the unique email index, without it nothing
+// stops duplicate accounts.
+func dropBaselineIndexes(ctx context.Context, database *mongo.Database) error {
+	users := database.Collection("users")
+	if err := dropIndexes(ctx, users, "identities.provider_1_identities.subject_1", "memberships.org_id_1", "deleted_at_1"); err != nil {
+		return err
+	}
+
+	for _, index := range baselineIndexes {
+		if index.collection == "users" {
+			continue
+		}
+
+		// 26 means the collection does not exist
+		if _, err := database.Collection(index.collection).Indexes().DropAll(ctx); err != nil {
+			var cmdErr mongo.CommandError
+			if !errors.As(err, &cmdErr) || cmdErr.Code != 26 {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// renameField renames a field in the documents that still have the old
+// name. Renaming the other way undoes it.
+func renameField(ctx context.Context, collection *mongo.Collection, from, to string) error {
+	_, err := collection.UpdateMany(ctx,
+		bson.M{from: bson.M{"$exists": true}},
+		bson.M{"$rename": bson.M{from: to}},
+	)
+	return err
+}
+
+// dropIndexes drops indexes by name, ones that are already gone are
+// skipped.
+func dropIndexes(ctx context.Context, collection *mongo.Collection, names ...string) error {
+	for _, name := range names {
+		// 26 and 27 mean there was nothing to drop
+		if _, err := collection.Indexes().DropOne(ctx, name); err != nil {
+			var cmdErr mongo.CommandError
+			if !errors.As(err, &cmdErr) || (cmdErr.Code != 26 && cmdErr.Code != 27) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"reflect"
 	"time"
 
+	"github.com/sangketkit01/7-coding-test/internal/search"
 	"github.com/sangketkit01/7-coding-test/internal/util"
 	"go.mongodb.org/mongo-driver/bson"
     "go.mongodb.org/mongo-driver/bson/primitive"
@@ -15,99 +16,279 @@ import (
     "go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var client *mongo.Client
+var (
+	ErrInvalidCredentials = errors.New("invalid email or password")
+	ErrUserNotFound       = errors.New("user not found")
+)
+
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+func IsValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleUser
+}
 
 type User struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
-	Name      string             `bson:"name" json:"name"`
-	Email     string             `bson:"email" json:"email"`
-	Password  string             `bson:"password" json:"password"`
-	CreatedAt time.Time              `bson:"created_at" json:"created_at"`
+	ID                primitive.ObjectID `bson:"_id,omitempty" json:"id,omitempty"`
+	Name              string             `bson:"name" json:"name"`
+	Email             string             `bson:"email" json:"email"`
+	Password          string             `bson:"password" json:"-"`
+	PasswordHistory   []string           `bson:"password_history,omitempty" json:"-"`
+	Roles             []string           `bson:"roles" json:"roles"`
+	EmailVerified     bool               `bson:"email_verified" json:"email_verified"`
+	TOTPEnabled       bool               `bson:"totp_enabled" json:"totp_enabled"`
+	TOTPSecret        string             `bson:"totp_secret,omitempty" json:"-"`
+	TOTPPendingSecret string             `bson:"totp_pending_secret,omitempty" json:"-"`
+	TOTPLastStep      int64              `bson:"totp_last_step,omitempty" json:"-"`
+	RecoveryCodes     []string           `bson:"recovery_codes,omitempty" json:"-"`
+	Identities        []Identity         `bson:"identities,omitempty" json:"identities,omitempty"`
+	ServiceAccount    bool               `bson:"service_account,omitempty" json:"service_account,omitempty"`
+	// TenantID is the organization that owns the account, see
+	// EmailUniqueTenant. Accounts that signed up on their own have none.
+	TenantID    *primitive.ObjectID `bson:"tenant_id,omitempty" json:"tenant_id,omitempty"`
+	Memberships []Membership        `bson:"memberships,omitempty" json:"memberships,omitempty"`
+	// DeletedAt is set while the user waits in the trash to be purged.
+	DeletedAt    *time.Time `bson:"deleted_at,omitempty" json:"deleted_at,omitempty"`
+	DeletedEmail string     `bson:"deleted_email,omitempty" json:"-"`
+	// SearchTerms are the words of the name and email, see search.Terms.
+	SearchTerms []string `bson:"search_terms,omitempty" json:"-"`
+	CreatedAt         time.Time          `bson:"created_at" json:"created_at"`
 }
 
+// HasRole reports whether the user has role. Users stored before roles
+// existed have none and are treated as plain users.
+func (u *User) HasRole(role string) bool {
+	if len(u.Roles) == 0 {
+		return role == RoleUser
+	}
+
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// mongoUserStore is the MongoClient backed by the users collection.
+type mongoUserStore struct {
+	collection *mongo.Collection
+}
+
+// New returns the user store. Its indexes come from the migrations, see
+// Migrator.
 func New(mongo *mongo.Client) MongoClient {
-	client = mongo
+	return mongoUserStore{collection: mongo.Database("users").Collection("users")}
+}
+
+// How unique an email has to be.
+const (
+	// EmailUniqueGlobal allows every email once.
+	EmailUniqueGlobal = "global"
+	// EmailUniqueTenant allows an email once per tenant, accounts without a
+	// tenant count as one more tenant.
+	EmailUniqueTenant = "tenant"
+)
+
+const (
+	emailIndexName       = "email_1"
+	tenantEmailIndexName = "tenant_id_1_email_1"
+)
+
+var emailUniqueness = EmailUniqueGlobal
+
+// Upper bounds of a single user store operation. A sooner deadline of the
+// caller's context still wins.
+var (
+	readTimeout  = 5 * time.Second
+	writeTimeout = 10 * time.Second
+)
+
+// SetOperationTimeouts changes the bounds of user store operations, zero
+// keeps the current one.
+func SetOperationTimeouts(read, write time.Duration) {
+	if read > 0 {
+		readTimeout = read
+	}
+	if write > 0 {
+		writeTimeout = write
+	}
+}
+
+func withReadTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, readTimeout)
+}
+
+func withWriteTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, writeTimeout)
+}
+
+// IsTimeout reports whether err comes from a deadline or a cancellation
+// rather than from the database itself.
+func IsTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || mongo.IsTimeout(err)
+}
 
-	collection := client.Database("users").Collection("users")
-	if err := createEmailUniqueIndex(collection); err != nil {
-		log.Println("failed to create unique index on email:", err)
+// SetEmailUniqueness must be called before migrating, Migrator.Up builds
+// the unique index for the mode.
+func SetEmailUniqueness(mode string) error {
+	switch mode {
+	case "", EmailUniqueGlobal:
+		emailUniqueness = EmailUniqueGlobal
+	case EmailUniqueTenant:
+		emailUniqueness = EmailUniqueTenant
+	default:
+		return fmt.Errorf("unknown email uniqueness: %s", mode)
 	}
 
-	return User{}
+	return nil
 }
 
-func createEmailUniqueIndex(collection *mongo.Collection) error {
+// createEmailUniqueIndex builds the unique index of the current mode and
+// drops the one of the other mode. Going back to global fails while two
+// tenants share an email.
+func createEmailUniqueIndex(ctx context.Context, collection *mongo.Collection) error {
+	keys := bson.D{{Key: "email", Value: 1}}
+	stale := tenantEmailIndexName
+	if emailUniqueness == EmailUniqueTenant {
+		keys = bson.D{{Key: "tenant_id", Value: 1}, {Key: "email", Value: 1}}
+		stale = emailIndexName
+	}
+
+	// 26 and 27 mean there was nothing to drop
+	if _, err := collection.Indexes().DropOne(ctx, stale); err != nil {
+		var cmdErr mongo.CommandError
+		if !errors.As(err, &cmdErr) || (cmdErr.Code != 26 && cmdErr.Code != 27) {
+			return err
+		}
+	}
+
 	indexModel := mongo.IndexModel{
-		Keys:    bson.D{{Key: "email", Value: 1}},
+		Keys:    keys,
 		Options: options.Index().SetUnique(true),
 	}
-	_, err := collection.Indexes().CreateOne(context.TODO(), indexModel)
+	_, err := collection.Indexes().CreateOne(ctx, indexModel)
 	return err
 }
 
+// emailFilter matches an email inside one tenant when emails are unique
+// per tenant. A nil tenantID is the tenant of accounts without one.
+func emailFilter(email string, tenantID *primitive.ObjectID) bson.M {
+	filter := bson.M{"email": email, "deleted_at": nil}
+	if emailUniqueness != EmailUniqueTenant {
+		return filter
+	}
+
+	if tenantID == nil {
+		filter["tenant_id"] = nil
+	} else {
+		filter["tenant_id"] = *tenantID
+	}
+
+	return filter
+}
+
 
-func (u User) LoginUser() (*User, error) {
-	collection := client.Database("users").Collection("users")
+func (s mongoUserStore) LoginUser(ctx context.Context, credentials User) (*User, error) {
+	collection := s.collection
 
-	// ctx := context.TODO()
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
 
 	var foundUser User
 	fmt.Println("Decode target type:", reflect.TypeOf(foundUser))
 
-	err := collection.FindOne(context.TODO(), bson.M{"email": u.Email}).Decode(&foundUser)
+	// With a tenant the tenant's own account wins over an account without
+	// one that has the same email.
+	filter := emailFilter(credentials.Email, nil)
+	opts := options.FindOne()
+	if emailUniqueness == EmailUniqueTenant && credentials.TenantID != nil {
+		filter["tenant_id"] = bson.M{"$in": bson.A{*credentials.TenantID, nil}}
+		opts.SetSort(bson.D{{Key: "tenant_id", Value: -1}})
+	}
+
+	err := collection.FindOne(ctx, filter, opts).Decode(&foundUser)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			log.Println("user not found")
-			return nil, errors.New("invalid email or password")
+			return nil, ErrInvalidCredentials
 		}
 
 		log.Println("error finding user:", err)
 		return nil, err
 	}
 
-	if err := util.CheckPassword(foundUser.Password, u.Password); err != nil {
+	if err := util.CheckPassword(foundUser.Password, credentials.Password); err != nil {
 		log.Println("password mismatch")
-		return nil, errors.New("invalid email or password")
+		return nil, ErrInvalidCredentials
 	}
 
-	log.Println("user logged in successfully:", u.Email)
+	// Service accounts authenticate with API keys only.
+	if foundUser.ServiceAccount {
+		log.Println("password login refused for service account:", credentials.Email)
+		return nil, ErrInvalidCredentials
+	}
+
+	if util.PasswordNeedsRehash(foundUser.Password) {
+		rehashPassword(ctx, collection, &foundUser, credentials.Password)
+	}
+
+	log.Println("user logged in successfully:", credentials.Email)
 
 	return &foundUser, nil
 }
 
-func (u User) Insert(user User) error {
-	collection := client.Database("users").Collection("users")
+func (s mongoUserStore) Insert(ctx context.Context, user User) (*User, error) {
+	collection := s.collection
 
 	hashedPassword, err := util.HashPassword(user.Password)
 	if err != nil {
 		log.Println("failed to hashed password:", err)
-		return err
+		return nil, err
 	}
 
-	_, err = collection.InsertOne(context.TODO(), User{
+	// hashing is slow on purpose and does not count against the database
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	newUser := User{
 		Name:      user.Name,
 		Email:     user.Email,
-		Password:  hashedPassword,
-		CreatedAt: time.Now(),
-	})
+		Password:       hashedPassword,
+		Roles:          []string{RoleUser},
+		ServiceAccount: user.ServiceAccount,
+		TenantID:       user.TenantID,
+		Memberships:    user.Memberships,
+		CreatedAt:      time.Now(),
+	}
+	newUser.SearchTerms = userSearchTerms(&newUser)
 
+	result, err := collection.InsertOne(ctx, newUser)
 	if err != nil {
 		if mongo.IsDuplicateKeyError(err) {
 			log.Println("email already exists")
-			return errors.New("email already exists")
+			return nil, ErrEmailTaken
 		}
 
 		log.Println("failed to insert user:", err)
-		return err
+		return nil, err
 	}
 
+	newUser.ID = result.InsertedID.(primitive.ObjectID)
+
 	log.Println("insert user successfully")
 
-	return nil
+	return &newUser, nil
 }
 
-func (u User) FetchUserByID(id string) (*User, error) {
-	collection := client.Database("users").Collection("users")
+func (s mongoUserStore) FetchUserByID(ctx context.Context, id string) (*User, error) {
+	collection := s.collection
+
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
 
 	objectId, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
@@ -116,11 +297,11 @@ func (u User) FetchUserByID(id string) (*User, error) {
 	}
 
 	var user User
-	err = collection.FindOne(context.TODO(), bson.M{"_id": objectId}).Decode(&user)
+	err = collection.FindOne(ctx, bson.M{"_id": objectId, "deleted_at": nil}).Decode(&user)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			log.Println("user not found")
-			return nil, errors.New("user not found")
+			return nil, ErrUserNotFound
 		}
 
 		log.Println("error finding user by id:", err)
@@ -130,75 +311,60 @@ func (u User) FetchUserByID(id string) (*User, error) {
 	return &user, nil
 }
 
-func (u User) ListAllUsers() ([]*User, error) {
-	collection := client.Database("users").Collection("users")
-
-	cursor, err := collection.Find(context.TODO(), bson.M{})
-	if err != nil {
-		log.Println("failed to fetch users:", err)
-		return nil, err
-	}
-
-	defer cursor.Close(context.TODO())
-
-	var users []*User
-	for cursor.Next(context.TODO()) {
-		var user User
-		if err := cursor.Decode(&user); err != nil {
-			log.Println("failed to decode user:", err)
-			return nil, err
-		}
-
-		users = append(users, &user)
-	}
-
-	if err := cursor.Err(); err != nil {
-		log.Println("cursor error:", err)
-		return nil, err
-	}
-
-	return users, nil
-}
+func (s mongoUserStore) UpdateUser(ctx context.Context, user User) error {
+	collection := s.collection
 
-func (u User) UpdateUser() error {
-	collection := client.Database("users").Collection("users")
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
 
-	objectID, err := primitive.ObjectIDFromHex(u.ID.Hex())
+	objectID, err := primitive.ObjectIDFromHex(user.ID.Hex())
 	if err != nil {
 		log.Println("invalid object id:", err)
 		return errors.New("invalid user ID")
 	}
 
 	var current User
-	err = collection.FindOne(context.TODO(), bson.M{"_id": objectID}).Decode(&current)
+	err = collection.FindOne(ctx, bson.M{"_id": objectID}).Decode(&current)
 	if err != nil {
 		log.Println("failed to fetch current user:", err)
 		return err
 	}
 
 	name := current.Name
-	if u.Name != "" {
-		name = u.Name
+	if user.Name != "" {
+		name = user.Name
 	}
 	email := current.Email
-	if u.Email != "" {
-		email = u.Email
+	if user.Email != "" {
+		email = user.Email
+	}
+
+	set := bson.M{
+		"name":         name,
+		"email":        email,
+		"search_terms": search.Terms(name, email),
+	}
+
+	// a new address has to be verified again
+	if email != current.Email {
+		set["email_verified"] = false
 	}
 
 	update := bson.M{
-		"$set": bson.M{
-			"name":  name,
-			"email": email,
-		},
+		"$set": set,
 	}
 
 	_, err = collection.UpdateOne(
-		context.TODO(),
+		ctx,
 		bson.M{"_id": objectID},
 		update,
 	)
 
 	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrEmailTaken
+		}
+
 		log.Println("failed to update user:", err)
 		return err
 	}
@@ -207,34 +373,59 @@ func (u User) UpdateUser() error {
 	return nil
 }
 
-func (u User) DeleteUser() error {
-	collection := client.Database("users").Collection("users")
+// DeleteUser moves the user to the trash, PurgeDeletedUsers removes it for
+// good later. With releaseEmail the address is swapped for a placeholder so
+// a new account can take it, otherwise it stays reserved.
+func (s mongoUserStore) DeleteUser(ctx context.Context, id primitive.ObjectID, releaseEmail bool) error {
+	collection := s.collection
 
-	objectID, err := primitive.ObjectIDFromHex(u.ID.Hex())
-	if err != nil {
-		log.Println("invalid object id:", err)
-		return errors.New("invalid user ID")
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	set := bson.M{"deleted_at": time.Now()}
+	if releaseEmail {
+		set["deleted_email"] = "$email"
+		set["email"] = bson.M{"$concat": bson.A{bson.M{"$toString": "$_id"}, deletedEmailDomain}}
 	}
 
-	_, err = collection.DeleteOne(context.TODO(), bson.M{"_id": objectID})
+	result, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "deleted_at": nil},
+		mongo.Pipeline{{{Key: "$set", Value: set}}},
+	)
 	if err != nil {
 		log.Println("failed to delete user:", err)
 		return err
 	}
 
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+
 	log.Println("user deleted successfully")
 	return nil
 }
 
-func (u User) GetUserByEmail(email string) (*User, error) {
-	collection := client.Database("users").Collection("users")
+// GetUserByEmail finds an account without a tenant when emails are unique
+// per tenant.
+func (s mongoUserStore) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	return s.GetUserByEmailInTenant(ctx, email, nil)
+}
+
+// GetUserByEmailInTenant finds the account of tenantID with the email. The
+// tenant is ignored while emails are unique globally.
+func (s mongoUserStore) GetUserByEmailInTenant(ctx context.Context, email string, tenantID *primitive.ObjectID) (*User, error) {
+	collection := s.collection
+
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
 
 	var user User
-	err := collection.FindOne(context.TODO(), bson.M{"email": email}).Decode(&user)
+	err := collection.FindOne(ctx, emailFilter(email, tenantID)).Decode(&user)
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			log.Println("user not found by email")
-			return nil, errors.New("user not found")
+			return nil, ErrUserNotFound
 		}
 
 		log.Println("error finding user by email:", err)
@@ -243,3 +434,301 @@ func (u User) GetUserByEmail(email string) (*User, error) {
 
 	return &user, nil
 }
+
+func (s mongoUserStore) GrantRole(ctx context.Context, id string, role string) error {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		log.Println("invalid object id:", err)
+		return errors.New("invalid user ID")
+	}
+
+	result, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": objectID},
+		bson.M{"$addToSet": bson.M{"roles": role}},
+	)
+
+	if err != nil {
+		log.Println("failed to grant role:", err)
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+
+	log.Printf("granted role %s to user %s\n", role, id)
+	return nil
+}
+
+func (s mongoUserStore) RevokeRole(ctx context.Context, id string, role string) error {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		log.Println("invalid object id:", err)
+		return errors.New("invalid user ID")
+	}
+
+	result, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": objectID},
+		bson.M{"$pull": bson.M{"roles": role}},
+	)
+
+	if err != nil {
+		log.Println("failed to revoke role:", err)
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+
+	log.Printf("revoked role %s from user %s\n", role, id)
+	return nil
+}
+
+// UpdatePassword replaces the password hash and moves the old one into the
+// password history, which keeps the last historySize hashes.
+func (s mongoUserStore) UpdatePassword(ctx context.Context, id string, hashedPassword string, historySize int) error {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	objectID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		log.Println("invalid object id:", err)
+		return errors.New("invalid user ID")
+	}
+
+	history := interface{}(bson.A{})
+	if historySize > 0 {
+		history = bson.M{"$slice": bson.A{
+			bson.M{"$concatArrays": bson.A{bson.M{"$ifNull": bson.A{"$password_history", bson.A{}}}, bson.A{"$password"}}},
+			-historySize,
+		}}
+	}
+
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"password":         hashedPassword,
+			"password_history": history,
+		}}},
+	}
+
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": objectID}, update)
+	if err != nil {
+		log.Println("failed to update password:", err)
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrUserNotFound
+	}
+
+	log.Println("password updated successfully")
+	return nil
+}
+
+// rehashPassword replaces a hash made with outdated parameters after a
+// successful login. A failure is only logged, the old hash still works.
+func rehashPassword(ctx context.Context, collection *mongo.Collection, user *User, password string) {
+	hashedPassword, err := util.HashPassword(password)
+	if err != nil {
+		log.Println("failed to rehash password:", err)
+		return
+	}
+
+	_, err = collection.UpdateOne(
+		ctx,
+		bson.M{"_id": user.ID, "password": user.Password},
+		bson.M{"$set": bson.M{"password": hashedPassword}},
+	)
+	if err != nil {
+		log.Println("failed to store rehashed password:", err)
+		return
+	}
+
+	user.Password = hashedPassword
+	log.Println("password rehashed for user:", user.ID.Hex())
+}
+
+// MarkEmailVerified flags the user's email as verified, as long as it is
+// still the address the verification was sent to.
+func (s mongoUserStore) MarkEmailVerified(ctx context.Context, id primitive.ObjectID, email string) error {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	result, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "email": email},
+		bson.M{"$set": bson.M{"email_verified": true}},
+	)
+
+	if err != nil {
+		log.Println("failed to mark email verified:", err)
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return errors.New("email has changed since the verification was sent")
+	}
+
+	log.Println("email verified successfully:", email)
+	return nil
+}
+
+var ErrTOTPCodeReused = errors.New("code has already been used")
+
+func (s mongoUserStore) SetPendingTOTPSecret(ctx context.Context, id primitive.ObjectID, secret string) error {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	_, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"totp_pending_secret": secret}},
+	)
+
+	if err != nil {
+		log.Println("failed to set pending totp secret:", err)
+		return err
+	}
+
+	return nil
+}
+
+// EnableTOTP promotes the pending secret and stores the hashed recovery
+// codes. step is the time step of the code that confirmed the enrolment.
+func (s mongoUserStore) EnableTOTP(ctx context.Context, id primitive.ObjectID, secret string, step int64, recoveryCodeHashes []string) error {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	result, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "totp_pending_secret": secret},
+		bson.M{
+			"$set": bson.M{
+				"totp_enabled":   true,
+				"totp_secret":    secret,
+				"totp_last_step": step,
+				"recovery_codes": recoveryCodeHashes,
+			},
+			"$unset": bson.M{"totp_pending_secret": ""},
+		},
+	)
+
+	if err != nil {
+		log.Println("failed to enable totp:", err)
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return errors.New("two-factor enrolment has changed, start again")
+	}
+
+	log.Println("totp enabled for user:", id.Hex())
+	return nil
+}
+
+func (s mongoUserStore) DisableTOTP(ctx context.Context, id primitive.ObjectID) error {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	_, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id},
+		bson.M{
+			"$set": bson.M{"totp_enabled": false},
+			"$unset": bson.M{
+				"totp_secret":         "",
+				"totp_pending_secret": "",
+				"totp_last_step":      "",
+				"recovery_codes":      "",
+			},
+		},
+	)
+
+	if err != nil {
+		log.Println("failed to disable totp:", err)
+		return err
+	}
+
+	log.Println("totp disabled for user:", id.Hex())
+	return nil
+}
+
+// UseTOTPStep records step as the last accepted code. It fails with
+// ErrTOTPCodeReused when that step or a later one was already used, which
+// makes every code single-use even under concurrent requests.
+func (s mongoUserStore) UseTOTPStep(ctx context.Context, id primitive.ObjectID, step int64) error {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	filter := bson.M{
+		"_id": id,
+		"$or": bson.A{
+			bson.M{"totp_last_step": bson.M{"$exists": false}},
+			bson.M{"totp_last_step": bson.M{"$lt": step}},
+		},
+	}
+
+	result, err := collection.UpdateOne(
+		ctx,
+		filter,
+		bson.M{"$set": bson.M{"totp_last_step": step}},
+	)
+
+	if err != nil {
+		log.Println("failed to record totp step:", err)
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrTOTPCodeReused
+	}
+
+	return nil
+}
+
+// ConsumeRecoveryCode removes the hashed recovery code from the user and
+// reports whether it was there.
+func (s mongoUserStore) ConsumeRecoveryCode(ctx context.Context, id primitive.ObjectID, codeHash string) (bool, error) {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	result, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "recovery_codes": codeHash},
+		bson.M{"$pull": bson.M{"recovery_codes": codeHash}},
+	)
+
+	if err != nil {
+		log.Println("failed to consume recovery code:", err)
+		return false, err
+	}
+
+	return result.ModifiedCount == 1, nil
+}
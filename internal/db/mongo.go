@@ -1,11 +1,117 @@
 package db
 
+import (
+	"context"
+	"time"
+
+	"github.com/sangketkit01/7-coding-test/internal/ratelimit"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
 type MongoClient interface{
-	Insert(user User) error
-	FetchUserByID(id string) (*User, error)
-	ListAllUsers() ([]*User, error)
-	UpdateUser() error
-	DeleteUser() error
-	LoginUser() (*User, error)
-	GetUserByEmail(email string) (*User, error)
-}
\ No newline at end of file
+	Insert(ctx context.Context, user User) (*User, error)
+	FetchUserByID(ctx context.Context, id string) (*User, error)
+	ListUsers(ctx context.Context, filter UserFilter) (*UserPage, error)
+	CountUsers(ctx context.Context) (int64, error)
+	SearchUsers(ctx context.Context, query UserSearch) (*UserPage, error)
+	UpdateUser(ctx context.Context, user User) error
+	DeleteUser(ctx context.Context, id primitive.ObjectID, releaseEmail bool) error
+	RestoreUser(ctx context.Context, id string) (*User, error)
+	ListDeletedUsers(ctx context.Context) ([]*User, error)
+	PurgeDeletedUsers(ctx context.Context, before time.Time) ([]*User, error)
+	LoginUser(ctx context.Context, credentials User) (*User, error)
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	GetUserByEmailInTenant(ctx context.Context, email string, tenantID *primitive.ObjectID) (*User, error)
+	GrantRole(ctx context.Context, id string, role string) error
+	RevokeRole(ctx context.Context, id string, role string) error
+	UpdatePassword(ctx context.Context, id string, hashedPassword string, historySize int) error
+	MarkEmailVerified(ctx context.Context, id primitive.ObjectID, email string) error
+	SetPendingTOTPSecret(ctx context.Context, id primitive.ObjectID, secret string) error
+	EnableTOTP(ctx context.Context, id primitive.ObjectID, secret string, step int64, recoveryCodeHashes []string) error
+	DisableTOTP(ctx context.Context, id primitive.ObjectID) error
+	UseTOTPStep(ctx context.Context, id primitive.ObjectID, step int64) error
+	ConsumeRecoveryCode(ctx context.Context, id primitive.ObjectID, codeHash string) (bool, error)
+	GetUserByIdentity(ctx context.Context, provider, subject string) (*User, error)
+	LinkIdentity(ctx context.Context, id primitive.ObjectID, identity Identity) error
+	AddMembership(ctx context.Context, userID primitive.ObjectID, membership Membership) error
+	UpdateMembershipRole(ctx context.Context, userID, orgID primitive.ObjectID, role string) error
+	RemoveMembership(ctx context.Context, userID, orgID primitive.ObjectID) error
+	ListOrgMembers(ctx context.Context, orgID primitive.ObjectID) ([]*User, error)
+}
+
+type OrganizationStore interface {
+	InsertOrganization(ctx context.Context, org Organization) (*Organization, error)
+	GetOrganization(ctx context.Context, id primitive.ObjectID) (*Organization, error)
+	GetOrganizationBySlug(ctx context.Context, slug string) (*Organization, error)
+	ListOrganizations(ctx context.Context, ids []primitive.ObjectID) ([]*Organization, error)
+	UpdateOrganization(ctx context.Context, id primitive.ObjectID, name string) error
+	DeleteOrganization(ctx context.Context, id primitive.ObjectID) error
+}
+
+type RefreshTokenStore interface {
+	InsertRefreshToken(ctx context.Context, token RefreshToken) error
+	GetRefreshToken(ctx context.Context, sessionID string) (*RefreshToken, error)
+	RotateRefreshToken(ctx context.Context, sessionID, oldHash, newHash string, expiresAt time.Time) error
+	RevokeRefreshToken(ctx context.Context, sessionID string) error
+}
+
+type SessionStore interface {
+	CreateSession(ctx context.Context, session Session) error
+	GetSession(ctx context.Context, id string) (*Session, error)
+	ExtendSession(ctx context.Context, id string, expiresAt time.Time) error
+	RevokeSession(ctx context.Context, id string) error
+	RevokeUserSessions(ctx context.Context, userID primitive.ObjectID) (int64, error)
+	RevokeOtherUserSessions(ctx context.Context, userID primitive.ObjectID, keepID string) (int64, error)
+	SetSessionOrg(ctx context.Context, id string, orgID primitive.ObjectID) error
+	RevokeUserOrgSessions(ctx context.Context, userID, orgID primitive.ObjectID) (int64, error)
+}
+
+type SigningKeyStore interface {
+	InsertSigningKey(ctx context.Context, key SigningKey) error
+	ListSigningKeys(ctx context.Context) ([]*SigningKey, error)
+	RetireSigningKey(ctx context.Context, id string, retiredAt time.Time) error
+	DeleteSigningKey(ctx context.Context, id string) error
+}
+
+type PasswordResetStore interface {
+	InsertPasswordReset(ctx context.Context, reset PasswordReset) error
+	GetPasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error)
+	ConsumePasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error)
+}
+
+type EmailVerificationStore interface {
+	InsertEmailVerification(ctx context.Context, verification EmailVerification) error
+	ConsumeEmailVerification(ctx context.Context, tokenHash string) (*EmailVerification, error)
+	CountEmailVerificationsSince(ctx context.Context, userID primitive.ObjectID, since time.Time) (int64, error)
+}
+
+type LoginAttemptStore interface {
+	GetLoginAttempt(ctx context.Context, key string) (*LoginAttempt, error)
+	RecordLoginFailure(ctx context.Context, key string, window time.Duration) (*LoginAttempt, error)
+	LockLoginAttempt(ctx context.Context, key string, until time.Time) error
+	ResetLoginAttempts(ctx context.Context, key string) error
+}
+
+type OIDCStateStore interface {
+	InsertOIDCState(ctx context.Context, state OIDCState) error
+	ConsumeOIDCState(ctx context.Context, stateHash string) (*OIDCState, error)
+}
+
+type APIKeyStore interface {
+	InsertAPIKey(ctx context.Context, key APIKey) (*APIKey, error)
+	GetAPIKeyByHash(ctx context.Context, keyHash string) (*APIKey, error)
+	GetAPIKey(ctx context.Context, id primitive.ObjectID) (*APIKey, error)
+	ListAPIKeys(ctx context.Context, userID primitive.ObjectID) ([]*APIKey, error)
+	RevokeAPIKey(ctx context.Context, userID, id primitive.ObjectID) error
+	TouchAPIKey(ctx context.Context, id primitive.ObjectID, usedAt time.Time) error
+}
+
+type AuditEventStore interface {
+	AppendAuditEvent(ctx context.Context, event AuditEvent) (*AuditEvent, error)
+	ListAuditEvents(ctx context.Context, filter AuditEventFilter) ([]*AuditEvent, error)
+	VerifyAuditChain(ctx context.Context) (*AuditChainReport, error)
+}
+
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit ratelimit.Limit, now time.Time) (ratelimit.Result, error)
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrOIDCStateInvalid = errors.New("invalid or expired login state")
+
+// OIDCState is what we remember between redirecting a user to an external
+// provider and the provider redirecting back. It is keyed by the hash of the
+// state parameter and can be consumed once.
+type OIDCState struct {
+	StateHash    string    `bson:"_id" json:"-"`
+	Provider     string    `bson:"provider" json:"provider"`
+	Nonce        string    `bson:"nonce" json:"-"`
+	CodeVerifier string    `bson:"code_verifier" json:"-"`
+	ExpiresAt    time.Time `bson:"expires_at" json:"expires_at"`
+	CreatedAt    time.Time `bson:"created_at" json:"created_at"`
+}
+
+// mongoOIDCStateStore is the OIDCStateStore backed by the oidc_states collection.
+type mongoOIDCStateStore struct {
+	collection *mongo.Collection
+}
+
+func NewOIDCStateStore(mongo *mongo.Client) OIDCStateStore {
+	return mongoOIDCStateStore{collection: mongo.Database("users").Collection("oidc_states")}
+}
+
+func createOIDCStateIndex(ctx context.Context, collection *mongo.Collection) error {
+	indexModel := mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+	_, err := collection.Indexes().CreateOne(ctx, indexModel)
+	return err
+}
+
+func (s mongoOIDCStateStore) InsertOIDCState(ctx context.Context, state OIDCState) error {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	state.CreatedAt = time.Now()
+
+	_, err := collection.InsertOne(ctx, state)
+	if err != nil {
+		log.Println("failed to insert oidc state:", err)
+		return err
+	}
+
+	return nil
+}
+
+// ConsumeOIDCState deletes an unexpired state and returns it.
+func (s mongoOIDCStateStore) ConsumeOIDCState(ctx context.Context, stateHash string) (*OIDCState, error) {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	filter := bson.M{
+		"_id":        stateHash,
+		"expires_at": bson.M{"$gt": time.Now()},
+	}
+
+	var state OIDCState
+	err := collection.FindOneAndDelete(ctx, filter).Decode(&state)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrOIDCStateInvalid
+		}
+
+		log.Println("failed to consume oidc state:", err)
+		return nil, err
+	}
+
+	return &state, nil
+}
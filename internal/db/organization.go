@@ -0,0 +1,323 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrOrganizationNotFound  = errors.New("organization not found")
+	ErrOrganizationSlugTaken = errors.New("organization slug is already taken")
+	ErrAlreadyMember         = errors.New("user is already a member of the organization")
+	ErrNotMember             = errors.New("user is not a member of the organization")
+)
+
+// Roles of a user inside an organization, from least to most powerful.
+const (
+	OrgRoleMember = "member"
+	OrgRoleAdmin  = "admin"
+	OrgRoleOwner  = "owner"
+)
+
+func IsValidOrgRole(role string) bool {
+	return OrgRoleRank(role) > 0
+}
+
+// OrgRoleRank orders organization roles, unknown roles rank 0.
+func OrgRoleRank(role string) int {
+	switch role {
+	case OrgRoleMember:
+		return 1
+	case OrgRoleAdmin:
+		return 2
+	case OrgRoleOwner:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// IsOrgAdminRole reports whether role may manage the organization's members.
+func IsOrgAdminRole(role string) bool {
+	return OrgRoleRank(role) >= OrgRoleRank(OrgRoleAdmin)
+}
+
+// Organization is a tenant. Users join it through a Membership.
+type Organization struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	Name      string             `bson:"name" json:"name"`
+	Slug      string             `bson:"slug" json:"slug"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// Membership is stored on the user, so users of an organization are found
+// with a single query on the users collection.
+type Membership struct {
+	OrgID    primitive.ObjectID `bson:"org_id" json:"org_id"`
+	Role     string             `bson:"role" json:"role"`
+	JoinedAt time.Time          `bson:"joined_at" json:"joined_at"`
+}
+
+// Membership returns the user's membership of orgID, nil when the user is
+// not a member.
+func (u *User) Membership(orgID primitive.ObjectID) *Membership {
+	for i := range u.Memberships {
+		if u.Memberships[i].OrgID == orgID {
+			return &u.Memberships[i]
+		}
+	}
+
+	return nil
+}
+
+// mongoOrganizationStore is the OrganizationStore backed by the organizations collection.
+type mongoOrganizationStore struct {
+	collection *mongo.Collection
+}
+
+func NewOrganizationStore(mongo *mongo.Client) OrganizationStore {
+	return mongoOrganizationStore{collection: mongo.Database("users").Collection("organizations")}
+}
+
+func createOrganizationIndexes(ctx context.Context, collection *mongo.Collection) error {
+	indexModel := mongo.IndexModel{
+		Keys:    bson.D{{Key: "slug", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	_, err := collection.Indexes().CreateOne(ctx, indexModel)
+	return err
+}
+
+func createMembershipIndex(ctx context.Context, collection *mongo.Collection) error {
+	indexModel := mongo.IndexModel{
+		Keys: bson.D{{Key: "memberships.org_id", Value: 1}},
+	}
+	_, err := collection.Indexes().CreateOne(ctx, indexModel)
+	return err
+}
+
+func (o mongoOrganizationStore) InsertOrganization(ctx context.Context, org Organization) (*Organization, error) {
+	collection := o.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	org.ID = primitive.NilObjectID
+	org.CreatedAt = time.Now()
+
+	result, err := collection.InsertOne(ctx, org)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, ErrOrganizationSlugTaken
+		}
+
+		log.Println("failed to insert organization:", err)
+		return nil, err
+	}
+
+	org.ID = result.InsertedID.(primitive.ObjectID)
+
+	return &org, nil
+}
+
+func (o mongoOrganizationStore) GetOrganization(ctx context.Context, id primitive.ObjectID) (*Organization, error) {
+	return o.findOrganization(ctx, bson.M{"_id": id})
+}
+
+func (o mongoOrganizationStore) GetOrganizationBySlug(ctx context.Context, slug string) (*Organization, error) {
+	return o.findOrganization(ctx, bson.M{"slug": slug})
+}
+
+func (o mongoOrganizationStore) findOrganization(ctx context.Context, filter bson.M) (*Organization, error) {
+	collection := o.collection
+
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+
+	var org Organization
+	err := collection.FindOne(ctx, filter).Decode(&org)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrOrganizationNotFound
+		}
+
+		log.Println("error finding organization:", err)
+		return nil, err
+	}
+
+	return &org, nil
+}
+
+func (o mongoOrganizationStore) ListOrganizations(ctx context.Context, ids []primitive.ObjectID) ([]*Organization, error) {
+	collection := o.collection
+
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+
+	orgs := []*Organization{}
+	if len(ids) == 0 {
+		return orgs, nil
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+
+	cursor, err := collection.Find(ctx, bson.M{"_id": bson.M{"$in": ids}}, opts)
+	if err != nil {
+		log.Println("failed to list organizations:", err)
+		return nil, err
+	}
+
+	if err := cursor.All(ctx, &orgs); err != nil {
+		log.Println("failed to decode organizations:", err)
+		return nil, err
+	}
+
+	return orgs, nil
+}
+
+func (o mongoOrganizationStore) UpdateOrganization(ctx context.Context, id primitive.ObjectID, name string) error {
+	collection := o.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	result, err := collection.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"name": name}})
+	if err != nil {
+		log.Println("failed to update organization:", err)
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrOrganizationNotFound
+	}
+
+	return nil
+}
+
+func (o mongoOrganizationStore) DeleteOrganization(ctx context.Context, id primitive.ObjectID) error {
+	collection := o.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	result, err := collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		log.Println("failed to delete organization:", err)
+		return err
+	}
+
+	if result.DeletedCount == 0 {
+		return ErrOrganizationNotFound
+	}
+
+	log.Println("organization deleted:", id.Hex())
+	return nil
+}
+
+// AddMembership adds the user to an organization. A user has at most one
+// membership per organization.
+func (s mongoUserStore) AddMembership(ctx context.Context, userID primitive.ObjectID, membership Membership) error {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	membership.JoinedAt = time.Now()
+
+	result, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": userID, "memberships.org_id": bson.M{"$ne": membership.OrgID}},
+		bson.M{"$push": bson.M{"memberships": membership}},
+	)
+	if err != nil {
+		log.Println("failed to add membership:", err)
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		if _, err := s.FetchUserByID(ctx, userID.Hex()); err != nil {
+			return err
+		}
+
+		return ErrAlreadyMember
+	}
+
+	log.Printf("added user %s to organization %s as %s\n", userID.Hex(), membership.OrgID.Hex(), membership.Role)
+	return nil
+}
+
+func (s mongoUserStore) UpdateMembershipRole(ctx context.Context, userID, orgID primitive.ObjectID, role string) error {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	result, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": userID, "memberships.org_id": orgID},
+		bson.M{"$set": bson.M{"memberships.$.role": role}},
+	)
+	if err != nil {
+		log.Println("failed to update membership:", err)
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrNotMember
+	}
+
+	return nil
+}
+
+func (s mongoUserStore) RemoveMembership(ctx context.Context, userID, orgID primitive.ObjectID) error {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	result, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": userID, "memberships.org_id": orgID},
+		bson.M{"$pull": bson.M{"memberships": bson.M{"org_id": orgID}}},
+	)
+	if err != nil {
+		log.Println("failed to remove membership:", err)
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrNotMember
+	}
+
+	log.Printf("removed user %s from organization %s\n", userID.Hex(), orgID.Hex())
+	return nil
+}
+
+// ListOrgMembers returns the users with a membership of orgID.
+func (s mongoUserStore) ListOrgMembers(ctx context.Context, orgID primitive.ObjectID) ([]*User, error) {
+	collection := s.collection
+
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"memberships.org_id": orgID, "deleted_at": nil})
+	if err != nil {
+		log.Println("failed to fetch organization members:", err)
+		return nil, err
+	}
+
+	users := []*User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		log.Println("failed to decode organization members:", err)
+		return nil, err
+	}
+
+	return users, nil
+}
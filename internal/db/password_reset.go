@@ -0,0 +1,135 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrPasswordResetInvalid = errors.New("invalid or expired password reset token")
+
+// PasswordReset is a single-use reset token. Only the hash of the token is
+// stored, the token itself is only ever sent to the user.
+type PasswordReset struct {
+	TokenHash string             `bson:"_id" json:"-"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"`
+	UsedAt    *time.Time         `bson:"used_at,omitempty" json:"used_at,omitempty"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// mongoPasswordResetStore is the PasswordResetStore backed by the password_resets collection.
+type mongoPasswordResetStore struct {
+	collection *mongo.Collection
+}
+
+func NewPasswordResetStore(mongo *mongo.Client) PasswordResetStore {
+	return mongoPasswordResetStore{collection: mongo.Database("users").Collection("password_resets")}
+}
+
+func createPasswordResetIndexes(ctx context.Context, collection *mongo.Collection) error {
+	indexModels := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}},
+		},
+	}
+	_, err := collection.Indexes().CreateMany(ctx, indexModels)
+	return err
+}
+
+// InsertPasswordReset stores a new reset token and drops any token issued
+// before it, so only the latest link sent to the user works.
+func (r mongoPasswordResetStore) InsertPasswordReset(ctx context.Context, reset PasswordReset) error {
+	collection := r.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	_, err := collection.DeleteMany(ctx, bson.M{"user_id": reset.UserID})
+	if err != nil {
+		log.Println("failed to delete previous password resets:", err)
+		return err
+	}
+
+	reset.CreatedAt = time.Now()
+
+	_, err = collection.InsertOne(ctx, reset)
+	if err != nil {
+		log.Println("failed to insert password reset:", err)
+		return err
+	}
+
+	return nil
+}
+
+// GetPasswordReset returns an unused, unexpired token without consuming it.
+func (r mongoPasswordResetStore) GetPasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error) {
+	collection := r.collection
+
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+
+	filter := bson.M{
+		"_id":        tokenHash,
+		"used_at":    bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": time.Now()},
+	}
+
+	var reset PasswordReset
+	err := collection.FindOne(ctx, filter).Decode(&reset)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrPasswordResetInvalid
+		}
+
+		log.Println("error finding password reset:", err)
+		return nil, err
+	}
+
+	return &reset, nil
+}
+
+// ConsumePasswordReset marks an unused, unexpired token as used and returns
+// it. The check and the update are one operation so a token works only once.
+func (r mongoPasswordResetStore) ConsumePasswordReset(ctx context.Context, tokenHash string) (*PasswordReset, error) {
+	collection := r.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	now := time.Now()
+	filter := bson.M{
+		"_id":        tokenHash,
+		"used_at":    bson.M{"$exists": false},
+		"expires_at": bson.M{"$gt": now},
+	}
+
+	var reset PasswordReset
+	err := collection.FindOneAndUpdate(
+		ctx,
+		filter,
+		bson.M{"$set": bson.M{"used_at": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&reset)
+
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrPasswordResetInvalid
+		}
+
+		log.Println("failed to consume password reset:", err)
+		return nil, err
+	}
+
+	return &reset, nil
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/sangketkit01/7-coding-test/internal/ratelimit"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RateLimitBucket is the token bucket of one rate limit key, shared by every
+// replica of the service.
+type RateLimitBucket struct {
+	Key       string    `bson:"_id" json:"key"`
+	Tokens    float64   `bson:"tokens" json:"tokens"`
+	Allowed   bool      `bson:"allowed" json:"allowed"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+	ExpiresAt time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+// mongoRateLimitStore is the RateLimitStore backed by the rate_limits collection.
+type mongoRateLimitStore struct {
+	collection *mongo.Collection
+}
+
+func NewRateLimitStore(mongo *mongo.Client) RateLimitStore {
+	return mongoRateLimitStore{collection: mongo.Database("users").Collection("rate_limits")}
+}
+
+// A bucket is full again one period after its last request, so it can be
+// dropped then.
+func createRateLimitIndex(ctx context.Context, collection *mongo.Collection) error {
+	indexModel := mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+	_, err := collection.Indexes().CreateOne(ctx, indexModel)
+	return err
+}
+
+// Take refills the bucket of key and takes a token from it with a single
+// pipeline update, so concurrent requests from several replicas never
+// spend the same token.
+func (b mongoRateLimitStore) Take(ctx context.Context, key string, limit ratelimit.Limit, now time.Time) (ratelimit.Result, error) {
+	collection := b.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	capacity := float64(limit.Requests)
+	tokensPerMilli := capacity / float64(limit.Period.Milliseconds())
+
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"tokens": bson.M{"$min": bson.A{
+				capacity,
+				bson.M{"$add": bson.A{
+					bson.M{"$ifNull": bson.A{"$tokens", capacity}},
+					bson.M{"$multiply": bson.A{
+						bson.M{"$max": bson.A{0, bson.M{"$subtract": bson.A{now, bson.M{"$ifNull": bson.A{"$updated_at", now}}}}}},
+						tokensPerMilli,
+					}},
+				}},
+			}},
+		}}},
+		{{Key: "$set", Value: bson.M{
+			"allowed": bson.M{"$gte": bson.A{"$tokens", 1}},
+			"tokens": bson.M{"$cond": bson.A{
+				bson.M{"$gte": bson.A{"$tokens", 1}},
+				bson.M{"$subtract": bson.A{"$tokens", 1}},
+				"$tokens",
+			}},
+			"updated_at": now,
+			"expires_at": now.Add(limit.Period),
+		}}},
+	}
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var bucket RateLimitBucket
+	err := collection.FindOneAndUpdate(ctx, bson.M{"_id": key}, update, opts).Decode(&bucket)
+	if mongo.IsDuplicateKeyError(err) {
+		// another replica created the bucket first, update that one
+		err = collection.FindOneAndUpdate(ctx, bson.M{"_id": key}, update, opts).Decode(&bucket)
+	}
+	if err != nil {
+		log.Println("error taking rate limit token:", err)
+		return ratelimit.Result{}, err
+	}
+
+	return ratelimit.NewResult(limit, bucket.Tokens, bucket.Allowed), nil
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	ErrRefreshTokenReused   = errors.New("refresh token reuse detected")
+)
+
+// RefreshToken is the rotation state of one login session. The document is
+// keyed by the session ID carried in the token payload and only remembers the
+// hash of the latest refresh token issued for that session.
+type RefreshToken struct {
+	SessionID string             `bson:"_id" json:"session_id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	TokenHash string             `bson:"token_hash" json:"-"`
+	Revoked   bool               `bson:"revoked" json:"revoked"`
+	ExpiresAt time.Time          `bson:"expires_at" json:"expires_at"`
+	CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+	RotatedAt time.Time          `bson:"rotated_at,omitempty" json:"rotated_at,omitempty"`
+}
+
+// mongoRefreshTokenStore is the RefreshTokenStore backed by the refresh_tokens collection.
+type mongoRefreshTokenStore struct {
+	collection *mongo.Collection
+}
+
+func NewRefreshTokenStore(mongo *mongo.Client) RefreshTokenStore {
+	return mongoRefreshTokenStore{collection: mongo.Database("users").Collection("refresh_tokens")}
+}
+
+func createRefreshTokenIndexes(ctx context.Context, collection *mongo.Collection) error {
+	indexModels := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}},
+		},
+	}
+	_, err := collection.Indexes().CreateMany(ctx, indexModels)
+	return err
+}
+
+func (r mongoRefreshTokenStore) InsertRefreshToken(ctx context.Context, token RefreshToken) error {
+	collection := r.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	token.CreatedAt = time.Now()
+
+	_, err := collection.InsertOne(ctx, token)
+	if err != nil {
+		log.Println("failed to insert refresh token:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (r mongoRefreshTokenStore) GetRefreshToken(ctx context.Context, sessionID string) (*RefreshToken, error) {
+	collection := r.collection
+
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+
+	var token RefreshToken
+	err := collection.FindOne(ctx, bson.M{"_id": sessionID}).Decode(&token)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrRefreshTokenNotFound
+		}
+
+		log.Println("error finding refresh token:", err)
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+// RotateRefreshToken swaps the stored hash only if oldHash is still the
+// current one, so two concurrent refreshes with the same token cannot both win.
+func (r mongoRefreshTokenStore) RotateRefreshToken(ctx context.Context, sessionID, oldHash, newHash string, expiresAt time.Time) error {
+	collection := r.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	filter := bson.M{
+		"_id":        sessionID,
+		"token_hash": oldHash,
+		"revoked":    false,
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"token_hash": newHash,
+			"expires_at": expiresAt,
+			"rotated_at": time.Now(),
+		},
+	}
+
+	result, err := collection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		log.Println("failed to rotate refresh token:", err)
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return ErrRefreshTokenReused
+	}
+
+	return nil
+}
+
+func (r mongoRefreshTokenStore) RevokeRefreshToken(ctx context.Context, sessionID string) error {
+	collection := r.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	_, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": sessionID},
+		bson.M{"$set": bson.M{"revoked": true}},
+	)
+
+	if err != nil {
+		log.Println("failed to revoke refresh token:", err)
+		return err
+	}
+
+	return nil
+}
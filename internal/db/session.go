@@ -0,0 +1,226 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is one login of a user. Every token minted for the login carries
+// the session ID, so revoking the session kills all of them at once.
+type Session struct {
+	ID        string             `bson:"_id" json:"id"`
+	UserID    primitive.ObjectID `bson:"user_id" json:"user_id"`
+	UserAgent string             `bson:"user_agent" json:"user_agent"`
+	ClientIP  string             `bson:"client_ip" json:"client_ip"`
+	// ImpersonatorID is set on sessions an admin started as this user.
+	ImpersonatorID *primitive.ObjectID `bson:"impersonator_id,omitempty" json:"impersonator_id,omitempty"`
+	// OrgID is the active organization, it carries over to refreshed tokens.
+	OrgID     *primitive.ObjectID `bson:"org_id,omitempty" json:"org_id,omitempty"`
+	ExpiresAt time.Time           `bson:"expires_at" json:"expires_at"`
+	RevokedAt *time.Time          `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+	CreatedAt time.Time           `bson:"created_at" json:"created_at"`
+}
+
+func (s *Session) IsRevoked() bool {
+	return s.RevokedAt != nil
+}
+
+// mongoSessionStore is the SessionStore backed by the sessions collection.
+type mongoSessionStore struct {
+	collection *mongo.Collection
+}
+
+func NewSessionStore(mongo *mongo.Client) SessionStore {
+	return mongoSessionStore{collection: mongo.Database("users").Collection("sessions")}
+}
+
+func createSessionIndexes(ctx context.Context, collection *mongo.Collection) error {
+	indexModels := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "expires_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+		{
+			Keys: bson.D{{Key: "user_id", Value: 1}},
+		},
+	}
+	_, err := collection.Indexes().CreateMany(ctx, indexModels)
+	return err
+}
+
+func (s mongoSessionStore) CreateSession(ctx context.Context, session Session) error {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	session.CreatedAt = time.Now()
+
+	_, err := collection.InsertOne(ctx, session)
+	if err != nil {
+		log.Println("failed to insert session:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s mongoSessionStore) GetSession(ctx context.Context, id string) (*Session, error) {
+	collection := s.collection
+
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+
+	var session Session
+	err := collection.FindOne(ctx, bson.M{"_id": id}).Decode(&session)
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrSessionNotFound
+		}
+
+		log.Println("error finding session:", err)
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+func (s mongoSessionStore) ExtendSession(ctx context.Context, id string, expiresAt time.Time) error {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	_, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"expires_at": expiresAt}},
+	)
+
+	if err != nil {
+		log.Println("failed to extend session:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s mongoSessionStore) RevokeSession(ctx context.Context, id string) error {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	_, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+
+	if err != nil {
+		log.Println("failed to revoke session:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (s mongoSessionStore) RevokeUserSessions(ctx context.Context, userID primitive.ObjectID) (int64, error) {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	result, err := collection.UpdateMany(
+		ctx,
+		bson.M{"user_id": userID, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+
+	if err != nil {
+		log.Println("failed to revoke user sessions:", err)
+		return 0, err
+	}
+
+	log.Printf("revoked %d sessions of user %s\n", result.ModifiedCount, userID.Hex())
+
+	return result.ModifiedCount, nil
+}
+
+// RevokeOtherUserSessions revokes every session of the user except keepID,
+// the session the request came from.
+func (s mongoSessionStore) RevokeOtherUserSessions(ctx context.Context, userID primitive.ObjectID, keepID string) (int64, error) {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	result, err := collection.UpdateMany(
+		ctx,
+		bson.M{"user_id": userID, "_id": bson.M{"$ne": keepID}, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+
+	if err != nil {
+		log.Println("failed to revoke other user sessions:", err)
+		return 0, err
+	}
+
+	log.Printf("revoked %d other sessions of user %s\n", result.ModifiedCount, userID.Hex())
+
+	return result.ModifiedCount, nil
+}
+
+// SetSessionOrg makes orgID the active organization of the session.
+func (s mongoSessionStore) SetSessionOrg(ctx context.Context, id string, orgID primitive.ObjectID) error {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	_, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id},
+		bson.M{"$set": bson.M{"org_id": orgID}},
+	)
+
+	if err != nil {
+		log.Println("failed to set session organization:", err)
+		return err
+	}
+
+	return nil
+}
+
+// RevokeUserOrgSessions revokes the sessions of the user that have orgID as
+// their active organization.
+func (s mongoSessionStore) RevokeUserOrgSessions(ctx context.Context, userID, orgID primitive.ObjectID) (int64, error) {
+	collection := s.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	result, err := collection.UpdateMany(
+		ctx,
+		bson.M{"user_id": userID, "org_id": orgID, "revoked_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revoked_at": time.Now()}},
+	)
+
+	if err != nil {
+		log.Println("failed to revoke organization sessions:", err)
+		return 0, err
+	}
+
+	log.Printf("revoked %d sessions of user %s in organization %s\n", result.ModifiedCount, userID.Hex(), orgID.Hex())
+
+	return result.ModifiedCount, nil
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// SigningKey persists the token signing keys so that every replica signs and
+// verifies with the same key ring and keys survive restarts.
+type SigningKey struct {
+	ID         string     `bson:"_id" json:"kid"`
+	Algorithm  string     `bson:"algorithm" json:"algorithm"`
+	PrivateKey string     `bson:"private_key" json:"-"`
+	CreatedAt  time.Time  `bson:"created_at" json:"created_at"`
+	RetiredAt  *time.Time `bson:"retired_at,omitempty" json:"retired_at,omitempty"`
+}
+
+// mongoSigningKeyStore is the SigningKeyStore backed by the signing_keys collection.
+type mongoSigningKeyStore struct {
+	collection *mongo.Collection
+}
+
+func NewSigningKeyStore(mongo *mongo.Client) SigningKeyStore {
+	return mongoSigningKeyStore{collection: mongo.Database("users").Collection("signing_keys")}
+}
+
+func (k mongoSigningKeyStore) InsertSigningKey(ctx context.Context, key SigningKey) error {
+	collection := k.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	_, err := collection.InsertOne(ctx, key)
+	if err != nil {
+		log.Println("failed to insert signing key:", err)
+		return err
+	}
+
+	log.Println("inserted signing key:", key.ID)
+
+	return nil
+}
+
+func (k mongoSigningKeyStore) ListSigningKeys(ctx context.Context) ([]*SigningKey, error) {
+	collection := k.collection
+
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		log.Println("failed to fetch signing keys:", err)
+		return nil, err
+	}
+
+	defer cursor.Close(ctx)
+
+	var keys []*SigningKey
+	if err := cursor.All(ctx, &keys); err != nil {
+		log.Println("failed to decode signing keys:", err)
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (k mongoSigningKeyStore) RetireSigningKey(ctx context.Context, id string, retiredAt time.Time) error {
+	collection := k.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	_, err := collection.UpdateOne(
+		ctx,
+		bson.M{"_id": id, "retired_at": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"retired_at": retiredAt}},
+	)
+
+	if err != nil {
+		log.Println("failed to retire signing key:", err)
+		return err
+	}
+
+	return nil
+}
+
+func (k mongoSigningKeyStore) DeleteSigningKey(ctx context.Context, id string) error {
+	collection := k.collection
+
+	ctx, cancel := withWriteTimeout(ctx)
+	defer cancel()
+
+	_, err := collection.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		log.Println("failed to delete signing key:", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,216 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Orders ListUsers can return users in. Ties are broken by id, so every
+// order is total and pages never overlap.
+const (
+	UserSortCreatedAt = "created_at"
+	UserSortName      = "name"
+)
+
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+func IsValidUserSort(sortBy string) bool {
+	return sortBy == UserSortCreatedAt || sortBy == UserSortName
+}
+
+// UserFilter selects a page of users. Prefixes are case-sensitive so they
+// can use the indexes, From and To are inclusive.
+type UserFilter struct {
+	NamePrefix  string
+	EmailPrefix string
+	From        time.Time
+	To          time.Time
+	// OrgID limits the page to the members of an organization.
+	OrgID      *primitive.ObjectID
+	SortBy     string
+	Descending bool
+	Limit      int64
+	// PageToken is the NextPageToken of the previous page.
+	PageToken string
+}
+
+type UserPage struct {
+	Users []*User
+	// NextPageToken is empty on the last page.
+	NextPageToken string
+}
+
+// userCursor is the position after the last user of a page. It remembers
+// the order it was made for, a token is only good for the same order.
+type userCursor struct {
+	SortBy     string             `json:"s"`
+	Descending bool               `json:"d,omitempty"`
+	Value      string             `json:"v"`
+	ID         primitive.ObjectID `json:"id"`
+}
+
+func userSortValue(user *User, sortBy string) string {
+	if sortBy == UserSortName {
+		return user.Name
+	}
+
+	return user.CreatedAt.UTC().Format(time.RFC3339Nano)
+}
+
+func encodePageToken(filter UserFilter, last *User) string {
+	data, _ := json.Marshal(userCursor{
+		SortBy:     filter.SortBy,
+		Descending: filter.Descending,
+		Value:      userSortValue(last, filter.SortBy),
+		ID:         last.ID,
+	})
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodePageToken returns nil for the first page.
+func decodePageToken(filter UserFilter) (*userCursor, error) {
+	if filter.PageToken == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(filter.PageToken)
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+
+	var cursor userCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, ErrInvalidPageToken
+	}
+
+	if cursor.SortBy != filter.SortBy || cursor.Descending != filter.Descending || cursor.ID.IsZero() {
+		return nil, ErrInvalidPageToken
+	}
+
+	if cursor.SortBy == UserSortCreatedAt {
+		if _, err := time.Parse(time.RFC3339Nano, cursor.Value); err != nil {
+			return nil, ErrInvalidPageToken
+		}
+	}
+
+	return &cursor, nil
+}
+
+// createListIndexes backs the orders of ListUsers. The email prefix uses
+// the unique email index.
+func createListIndexes(ctx context.Context, collection *mongo.Collection) error {
+	indexModels := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "created_at", Value: 1}, {Key: "_id", Value: 1}}},
+		{Keys: bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}}},
+	}
+	_, err := collection.Indexes().CreateMany(ctx, indexModels)
+	return err
+}
+
+func (s mongoUserStore) ListUsers(ctx context.Context, filter UserFilter) (*UserPage, error) {
+	collection := s.collection
+
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+
+	cursor, err := decodePageToken(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	query := bson.M{"deleted_at": nil}
+	if filter.NamePrefix != "" {
+		query["name"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(filter.NamePrefix)}
+	}
+	if filter.EmailPrefix != "" {
+		query["email"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(filter.EmailPrefix)}
+	}
+	if filter.OrgID != nil {
+		query["memberships.org_id"] = *filter.OrgID
+	}
+
+	createdAt := bson.M{}
+	if !filter.From.IsZero() {
+		createdAt["$gte"] = filter.From
+	}
+	if !filter.To.IsZero() {
+		createdAt["$lte"] = filter.To
+	}
+	if len(createdAt) > 0 {
+		query["created_at"] = createdAt
+	}
+
+	direction, after := 1, "$gt"
+	if filter.Descending {
+		direction, after = -1, "$lt"
+	}
+
+	if cursor != nil {
+		var value interface{} = cursor.Value
+		if cursor.SortBy == UserSortCreatedAt {
+			value, _ = time.Parse(time.RFC3339Nano, cursor.Value)
+		}
+
+		query["$or"] = bson.A{
+			bson.M{filter.SortBy: bson.M{after: value}},
+			bson.M{filter.SortBy: value, "_id": bson.M{after: cursor.ID}},
+		}
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: filter.SortBy, Value: direction}, {Key: "_id", Value: direction}}).
+		SetLimit(filter.Limit + 1)
+
+	found, err := collection.Find(ctx, query, opts)
+	if err != nil {
+		log.Println("failed to list users:", err)
+		return nil, err
+	}
+	defer found.Close(ctx)
+
+	users := []*User{}
+	if err := found.All(ctx, &users); err != nil {
+		log.Println("failed to decode users:", err)
+		return nil, err
+	}
+
+	return newUserPage(filter, users), nil
+}
+
+// newUserPage takes one user more than the page holds, which tells
+// whether there is a next page.
+func newUserPage(filter UserFilter, users []*User) *UserPage {
+	page := &UserPage{Users: users}
+	if filter.Limit > 0 && int64(len(users)) > filter.Limit {
+		page.Users = users[:filter.Limit]
+		page.NextPageToken = encodePageToken(filter, page.Users[len(page.Users)-1])
+	}
+
+	return page
+}
+
+func (s mongoUserStore) CountUsers(ctx context.Context) (int64, error) {
+	collection := s.collection
+
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+
+	count, err := collection.CountDocuments(ctx, bson.M{"deleted_at": nil})
+	if err != nil {
+		log.Println("failed to count users:", err)
+		return 0, err
+	}
+
+	return count, nil
+}
@@ -0,0 +1,265 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sangketkit01/7-coding-test/internal/search"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How a search page was found. A search that finds nothing with the text
+// index falls back to matching the start of names and emails.
+const (
+	searchByText   = "text"
+	searchByPrefix = "prefix"
+)
+
+// UserSearch is a page of a user search. Pages are ranked by relevance,
+// prefix matches by name.
+type UserSearch struct {
+	Query string
+	// OrgID limits the search to the members of an organization.
+	OrgID     *primitive.ObjectID
+	Limit     int64
+	PageToken string
+}
+
+// searchProjection keeps hashes and secrets out of search results.
+var searchProjection = bson.M{
+	"password":            0,
+	"password_history":    0,
+	"totp_secret":         0,
+	"totp_pending_secret": 0,
+	"recovery_codes":      0,
+}
+
+// userSearchTerms is what the text index matches a user on besides the
+// name and the email themselves.
+func userSearchTerms(user *User) []string {
+	return search.Terms(user.Name, user.Email)
+}
+
+func createSearchIndex(ctx context.Context, collection *mongo.Collection) error {
+	indexModel := mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "name", Value: "text"},
+			{Key: "email", Value: "text"},
+			{Key: "search_terms", Value: "text"},
+		},
+		// no stemming or stop words, they only make sense for prose
+		Options: options.Index().
+			SetDefaultLanguage("none").
+			SetWeights(bson.M{"name": 3, "email": 2, "search_terms": 1}),
+	}
+	_, err := collection.Indexes().CreateOne(ctx, indexModel)
+	return err
+}
+
+// backfillSearchTerms fills in the search terms of users stored before
+// search existed.
+func backfillSearchTerms(ctx context.Context, collection *mongo.Collection) error {
+	opts := options.Find().SetProjection(bson.M{"name": 1, "email": 1})
+
+	cursor, err := collection.Find(ctx, bson.M{"search_terms": bson.M{"$exists": false}}, opts)
+	if err != nil {
+		return err
+	}
+
+	users := []*User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		update := bson.M{"$set": bson.M{"search_terms": userSearchTerms(user)}}
+		if _, err := collection.UpdateOne(ctx, bson.M{"_id": user.ID}, update); err != nil {
+			return err
+		}
+	}
+
+	if len(users) > 0 {
+		log.Printf("filled in search terms of %d users\n", len(users))
+	}
+
+	return nil
+}
+
+func encodeSearchToken(by string, value string, last *User) string {
+	data, _ := json.Marshal(userCursor{SortBy: by, Value: value, ID: last.ID})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeSearchToken returns nil for the first page.
+func decodeSearchToken(token string) (*userCursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidPageToken
+	}
+
+	var cursor userCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.ID.IsZero() {
+		return nil, ErrInvalidPageToken
+	}
+
+	switch cursor.SortBy {
+	case searchByText:
+		if _, err := strconv.ParseFloat(cursor.Value, 64); err != nil {
+			return nil, ErrInvalidPageToken
+		}
+	case searchByPrefix:
+	default:
+		return nil, ErrInvalidPageToken
+	}
+
+	return &cursor, nil
+}
+
+func (s mongoUserStore) SearchUsers(ctx context.Context, query UserSearch) (*UserPage, error) {
+	ctx, cancel := withReadTimeout(ctx)
+	defer cancel()
+
+	cursor, err := decodeSearchToken(query.PageToken)
+	if err != nil {
+		return nil, err
+	}
+
+	terms := search.Terms(query.Query)
+	if len(terms) > 0 && (cursor == nil || cursor.SortBy == searchByText) {
+		page, err := s.searchText(ctx, query, terms, cursor)
+		if err != nil || cursor != nil || len(page.Users) > 0 {
+			return page, err
+		}
+	}
+
+	if cursor != nil && cursor.SortBy != searchByPrefix {
+		return nil, ErrInvalidPageToken
+	}
+
+	return s.searchPrefix(ctx, query, cursor)
+}
+
+// scoredUser is a user with its text search relevance.
+type scoredUser struct {
+	User  `bson:",inline"`
+	Score float64 `bson:"score"`
+}
+
+func (s mongoUserStore) searchText(ctx context.Context, query UserSearch, terms []string, cursor *userCursor) (*UserPage, error) {
+	match := bson.M{"$text": bson.M{"$search": strings.Join(terms, " ")}, "deleted_at": nil}
+	if query.OrgID != nil {
+		match["memberships.org_id"] = *query.OrgID
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$addFields", Value: bson.M{"score": bson.M{"$meta": "textScore"}}}},
+	}
+
+	if cursor != nil {
+		score, _ := strconv.ParseFloat(cursor.Value, 64)
+		pipeline = append(pipeline, bson.D{{Key: "$match", Value: bson.M{"$or": bson.A{
+			bson.M{"score": bson.M{"$lt": score}},
+			bson.M{"score": score, "_id": bson.M{"$gt": cursor.ID}},
+		}}}})
+	}
+
+	pipeline = append(pipeline,
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "score", Value: -1}, {Key: "_id", Value: 1}}}},
+		bson.D{{Key: "$limit", Value: query.Limit + 1}},
+		bson.D{{Key: "$project", Value: searchProjection}},
+	)
+
+	found, err := s.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Println("failed to search users:", err)
+		return nil, err
+	}
+	defer found.Close(ctx)
+
+	results := []*scoredUser{}
+	if err := found.All(ctx, &results); err != nil {
+		log.Println("failed to decode user search:", err)
+		return nil, err
+	}
+
+	return newSearchPage(query, results), nil
+}
+
+// newSearchPage takes one result more than the page holds, which tells
+// whether there is a next page.
+func newSearchPage(query UserSearch, results []*scoredUser) *UserPage {
+	page := &UserPage{Users: []*User{}}
+	for i, result := range results {
+		if query.Limit > 0 && int64(i) == query.Limit {
+			last := results[i-1]
+			page.NextPageToken = encodeSearchToken(searchByText, strconv.FormatFloat(last.Score, 'g', -1, 64), &last.User)
+			break
+		}
+
+		user := result.User
+		page.Users = append(page.Users, &user)
+	}
+
+	return page
+}
+
+func (s mongoUserStore) searchPrefix(ctx context.Context, query UserSearch, cursor *userCursor) (*UserPage, error) {
+	prefix := primitive.Regex{Pattern: "^" + regexp.QuoteMeta(query.Query), Options: "i"}
+
+	and := bson.A{bson.M{"$or": bson.A{bson.M{"name": prefix}, bson.M{"email": prefix}}}}
+	if cursor != nil {
+		and = append(and, bson.M{"$or": bson.A{
+			bson.M{"name": bson.M{"$gt": cursor.Value}},
+			bson.M{"name": cursor.Value, "_id": bson.M{"$gt": cursor.ID}},
+		}})
+	}
+
+	filter := bson.M{"deleted_at": nil, "$and": and}
+	if query.OrgID != nil {
+		filter["memberships.org_id"] = *query.OrgID
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "name", Value: 1}, {Key: "_id", Value: 1}}).
+		SetLimit(query.Limit + 1).
+		SetProjection(searchProjection)
+
+	found, err := s.collection.Find(ctx, filter, opts)
+	if err != nil {
+		log.Println("failed to search users by prefix:", err)
+		return nil, err
+	}
+	defer found.Close(ctx)
+
+	users := []*User{}
+	if err := found.All(ctx, &users); err != nil {
+		log.Println("failed to decode user search:", err)
+		return nil, err
+	}
+
+	return newPrefixPage(query, users), nil
+}
+
+func newPrefixPage(query UserSearch, users []*User) *UserPage {
+	page := &UserPage{Users: users}
+	if query.Limit > 0 && int64(len(users)) > query.Limit {
+		page.Users = users[:query.Limit]
+		last := page.Users[len(page.Users)-1]
+		page.NextPageToken = encodeSearchToken(searchByPrefix, last.Name, last)
+	}
+
+	return page
+}
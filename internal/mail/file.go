@@ -0,0 +1,45 @@
+package mail
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileMailer appends every message to a file, or prints it to stdout when
+// no path is set. It is meant for local development.
+type FileMailer struct {
+	mu   sync.Mutex
+	path string
+	from string
+}
+
+func NewFileMailer(path, from string) Mailer {
+	return &FileMailer{
+		path: path,
+		from: from,
+	}
+}
+
+func (m *FileMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var w io.Writer = os.Stdout
+	if m.path != "" {
+		file, err := os.OpenFile(m.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		w = file
+	}
+
+	_, err := fmt.Fprintf(w, "Date: %s\nFrom: %s\nTo: %s\nSubject: %s\n\n%s\n\n",
+		time.Now().Format(time.RFC1123Z), m.from, msg.To, msg.Subject, msg.Body)
+
+	return err
+}
@@ -0,0 +1,386 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	testClientID     = "client"
+	testClientSecret = "secret"
+	testRedirectUrl  = "https://app.example.com/callback"
+)
+
+// testIdP is an identity provider serving discovery, a key set, an
+// authorization endpoint that approves every request and a token endpoint
+// that checks the PKCE verifier.
+type testIdP struct {
+	server *httptest.Server
+	issuer string
+
+	mu     sync.Mutex
+	keys   map[string]*rsa.PrivateKey
+	kid    string
+	grants map[string]grant
+	// claims changes the claims of the next ID tokens.
+	claims func(*Claims)
+}
+
+// grant is an authorization code waiting to be exchanged.
+type grant struct {
+	challenge string
+	nonce     string
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+
+	idp := &testIdP{keys: map[string]*rsa.PrivateKey{}, grants: map[string]grant{}}
+	idp.rotateKey(t, "key-1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+
+	idp.server = httptest.NewServer(mux)
+	idp.issuer = idp.server.URL
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+// rotateKey adds a signing key and signs the next ID tokens with it.
+func (idp *testIdP) rotateKey(t *testing.T, kid string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp.mu.Lock()
+	idp.keys[kid] = key
+	idp.kid = kid
+	idp.mu.Unlock()
+}
+
+func (idp *testIdP) provider() *Provider {
+	return NewProvider(Config{
+		Name:         "test",
+		Issuer:       idp.issuer,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectUrl:  testRedirectUrl,
+	})
+}
+
+func (idp *testIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(Metadata{
+		Issuer:                idp.issuer,
+		AuthorizationEndpoint: idp.issuer + "/authorize",
+		TokenEndpoint:         idp.issuer + "/token",
+		JwksUri:               idp.issuer + "/jwks",
+	})
+}
+
+func (idp *testIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	set := jsonWebKeySet{}
+	for kid, key := range idp.keys {
+		set.Keys = append(set.Keys, jsonWebKey{
+			KeyType: "RSA",
+			KeyID:   kid,
+			Use:     "sig",
+			N:       base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		})
+	}
+
+	json.NewEncoder(w).Encode(set)
+}
+
+// authorize approves the request and sends the user back with a code.
+func (idp *testIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != testClientID || query.Get("redirect_uri") != testRedirectUrl || query.Get("code_challenge_method") != "S256" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	code := "code-" + query.Get("state")
+
+	idp.mu.Lock()
+	idp.grants[code] = grant{challenge: query.Get("code_challenge"), nonce: query.Get("nonce")}
+	idp.mu.Unlock()
+
+	redirect := url.Values{}
+	redirect.Set("code", code)
+	redirect.Set("state", query.Get("state"))
+	http.Redirect(w, r, testRedirectUrl+"?"+redirect.Encode(), http.StatusFound)
+}
+
+func (idp *testIdP) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok || clientID != testClientID || clientSecret != testClientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	if r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("redirect_uri") != testRedirectUrl {
+		http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+		return
+	}
+
+	idp.mu.Lock()
+	code := r.PostFormValue("code")
+	g, ok := idp.grants[code]
+	delete(idp.grants, code)
+	idp.mu.Unlock()
+
+	if !ok || CodeChallenge(r.PostFormValue("code_verifier")) != g.challenge {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(TokenResponse{
+		AccessToken: "access",
+		TokenType:   "Bearer",
+		IDToken:     idp.idToken(g.nonce),
+		ExpiresIn:   3600,
+	})
+}
+
+func (idp *testIdP) idToken(nonce string) string {
+	now := time.Now()
+	claims := &Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    idp.issuer,
+			Subject:   "subject-1",
+			Audience:  jwt.ClaimStrings{testClientID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+		},
+		Nonce:         nonce,
+		Email:         "alice@example.com",
+		EmailVerified: true,
+		Name:          "Alice",
+	}
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	if idp.claims != nil {
+		idp.claims(claims)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = idp.kid
+	signed, _ := token.SignedString(idp.keys[idp.kid])
+
+	return signed
+}
+
+// signIn runs the browser's part of the flow: it opens the authorization
+// URL and returns the code and state of the redirect back to the app.
+func signIn(t *testing.T, authURL string) (string, string) {
+	t.Helper()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: got %s, want a redirect", resp.Status)
+	}
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func TestAuthCodeFlow(t *testing.T) {
+	ctx := context.Background()
+	idp := newTestIdP(t)
+	provider := idp.provider()
+
+	verifier, err := NewCodeVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, err := provider.AuthCodeURL(ctx, "state-1", "nonce-1", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(authURL, idp.issuer+"/authorize?") {
+		t.Fatalf("authorization url %s does not use the discovered endpoint", authURL)
+	}
+
+	parsed, _ := url.Parse(authURL)
+	if got := parsed.Query().Get("code_challenge"); got != CodeChallenge(verifier) || got == verifier {
+		t.Fatalf("code_challenge: got %q, want the S256 challenge of the verifier", got)
+	}
+
+	code, state := signIn(t, authURL)
+	if state != "state-1" {
+		t.Fatalf("state: got %q, want %q", state, "state-1")
+	}
+
+	tokens, err := provider.Exchange(ctx, code, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := provider.VerifyIDToken(ctx, tokens.IDToken, "nonce-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Subject != "subject-1" || claims.Email != "alice@example.com" || !claims.EmailVerified || claims.Name != "Alice" {
+		t.Fatalf("claims: got %+v", claims)
+	}
+
+	// a code is only good once
+	if _, err := provider.Exchange(ctx, code, verifier); err == nil {
+		t.Fatal("exchanging a code twice succeeded")
+	}
+}
+
+func TestExchangeChecksCodeVerifier(t *testing.T) {
+	ctx := context.Background()
+	idp := newTestIdP(t)
+	provider := idp.provider()
+
+	verifier, _ := NewCodeVerifier()
+	other, _ := NewCodeVerifier()
+
+	authURL, err := provider.AuthCodeURL(ctx, "state-1", "nonce-1", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, _ := signIn(t, authURL)
+	if _, err := provider.Exchange(ctx, code, other); err == nil {
+		t.Fatal("exchange with another code verifier succeeded")
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		nonce  string
+		claims func(*Claims)
+		// rotate signs the token with a key the provider has not fetched.
+		rotate  bool
+		wantErr bool
+	}{
+		{name: "valid", nonce: "nonce-1"},
+		{name: "other nonce", nonce: "nonce-2", wantErr: true},
+		{name: "no nonce", nonce: "", wantErr: true},
+		{name: "other issuer", nonce: "nonce-1", claims: func(c *Claims) { c.Issuer = "https://evil.example.com" }, wantErr: true},
+		{name: "other audience", nonce: "nonce-1", claims: func(c *Claims) { c.Audience = jwt.ClaimStrings{"other"} }, wantErr: true},
+		{name: "expired", nonce: "nonce-1", claims: func(c *Claims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Minute)) }, wantErr: true},
+		{name: "no subject", nonce: "nonce-1", claims: func(c *Claims) { c.Subject = "" }, wantErr: true},
+		{name: "rotated key", nonce: "nonce-1", rotate: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			idp := newTestIdP(t)
+			provider := idp.provider()
+
+			// fetch the first key set
+			if _, err := provider.VerifyIDToken(ctx, idp.idToken("nonce-1"), "nonce-1"); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.rotate {
+				idp.rotateKey(t, "key-2")
+				provider.mu.Lock()
+				provider.keysFetchedAt = time.Now().Add(-keyRefreshInterval)
+				provider.mu.Unlock()
+			}
+			idp.claims = tt.claims
+
+			_, err := provider.VerifyIDToken(ctx, idp.idToken("nonce-1"), tt.nonce)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("got %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidIDToken) {
+				t.Fatalf("got %v, want %v", err, ErrInvalidIDToken)
+			}
+		})
+	}
+}
+
+func TestVerifyIDTokenRejectsUnknownKey(t *testing.T) {
+	ctx := context.Background()
+	idp := newTestIdP(t)
+	provider := idp.provider()
+
+	if _, err := provider.VerifyIDToken(ctx, idp.idToken("nonce-1"), "nonce-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	signed := idp.idToken("nonce-1")
+
+	// signed by another key under the same kid
+	idp.mu.Lock()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	idp.keys["key-1"] = key
+	idp.mu.Unlock()
+
+	if _, err := provider.VerifyIDToken(ctx, idp.idToken("nonce-1"), "nonce-1"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("forged signature: got %v, want %v", err, ErrInvalidIDToken)
+	}
+
+	// the key set was fetched a moment ago, an unknown kid is not looked up
+	idp.rotateKey(t, "key-2")
+	if _, err := provider.VerifyIDToken(ctx, idp.idToken("nonce-1"), "nonce-1"); !errors.Is(err, ErrInvalidIDToken) {
+		t.Fatalf("unknown kid: got %v, want %v", err, ErrInvalidIDToken)
+	}
+
+	if _, err := provider.VerifyIDToken(ctx, signed, "nonce-1"); err != nil {
+		t.Fatalf("token of the cached key: %v", err)
+	}
+}
+
+func TestDiscoveryChecksIssuer(t *testing.T) {
+	idp := newTestIdP(t)
+
+	// the same discovery url, but the document names the issuer without the
+	// trailing slash
+	provider := NewProvider(Config{Name: "test", Issuer: idp.issuer + "/", ClientID: testClientID})
+	if _, err := provider.AuthCodeURL(context.Background(), "state", "nonce", "verifier"); err == nil {
+		t.Fatal("discovery accepted a document for another issuer")
+	}
+}
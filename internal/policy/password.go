@@ -0,0 +1,181 @@
+// Package policy holds the rules passwords have to follow before they are
+// hashed and stored.
+package policy
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/sangketkit01/7-coding-test/internal/util"
+)
+
+//go:embed common-passwords.txt
+var commonPasswords []byte
+
+var ErrPasswordReused = errors.New("password was used recently, choose another one")
+
+// PasswordError lists every rule a password breaks.
+type PasswordError struct {
+	Violations []string
+}
+
+func (e *PasswordError) Error() string {
+	return "password does not meet the policy: " + strings.Join(e.Violations, ", ")
+}
+
+type PasswordConfig struct {
+	MinLength     int
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// HistorySize is how many previous passwords cannot be reused.
+	HistorySize int
+	// BlocklistFile adds breached or common passwords, one per line, to
+	// the built-in list.
+	BlocklistFile string
+}
+
+type PasswordPolicy struct {
+	config    PasswordConfig
+	blocklist map[string]struct{}
+}
+
+func NewPasswordPolicy(config PasswordConfig) (*PasswordPolicy, error) {
+	if config.MinLength < 1 {
+		return nil, errors.New("minimum password length must be at least 1")
+	}
+
+	if config.MaxLength < config.MinLength {
+		return nil, errors.New("maximum password length is below the minimum")
+	}
+
+	policy := &PasswordPolicy{
+		config:    config,
+		blocklist: make(map[string]struct{}),
+	}
+
+	if err := policy.loadBlocklist(bytes.NewReader(commonPasswords)); err != nil {
+		return nil, err
+	}
+
+	if config.BlocklistFile != "" {
+		file, err := os.Open(config.BlocklistFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open password blocklist: %w", err)
+		}
+		defer file.Close()
+
+		if err := policy.loadBlocklist(file); err != nil {
+			return nil, fmt.Errorf("cannot read password blocklist: %w", err)
+		}
+	}
+
+	return policy, nil
+}
+
+func (p *PasswordPolicy) loadBlocklist(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p.blocklist[strings.ToLower(line)] = struct{}{}
+	}
+
+	return scanner.Err()
+}
+
+func (p *PasswordPolicy) HistorySize() int {
+	return p.config.HistorySize
+}
+
+// Validate checks password against every rule and returns a *PasswordError
+// naming all the rules it breaks.
+func (p *PasswordPolicy) Validate(password string) error {
+	var violations []string
+
+	length := utf8.RuneCountInString(password)
+	if length < p.config.MinLength {
+		violations = append(violations, fmt.Sprintf("at least %d characters", p.config.MinLength))
+	}
+
+	if length > p.config.MaxLength {
+		violations = append(violations, fmt.Sprintf("at most %d characters", p.config.MaxLength))
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+
+	if p.config.RequireUpper && !hasUpper {
+		violations = append(violations, "an uppercase letter")
+	}
+
+	if p.config.RequireLower && !hasLower {
+		violations = append(violations, "a lowercase letter")
+	}
+
+	if p.config.RequireDigit && !hasDigit {
+		violations = append(violations, "a digit")
+	}
+
+	if p.config.RequireSymbol && !hasSymbol {
+		violations = append(violations, "a symbol")
+	}
+
+	if _, ok := p.blocklist[strings.ToLower(password)]; ok {
+		violations = append(violations, "not a commonly used or breached password")
+	}
+
+	if len(violations) > 0 {
+		return &PasswordError{Violations: violations}
+	}
+
+	return nil
+}
+
+// CheckReuse returns ErrPasswordReused when password matches the current
+// hash or one of the last HistorySize previous hashes.
+func (p *PasswordPolicy) CheckReuse(password, currentHash string, previousHashes []string) error {
+	hashes := []string{currentHash}
+	if n := p.config.HistorySize; n > 0 {
+		if len(previousHashes) > n {
+			previousHashes = previousHashes[len(previousHashes)-n:]
+		}
+		hashes = append(hashes, previousHashes...)
+	}
+
+	for _, hash := range hashes {
+		if hash == "" {
+			continue
+		}
+
+		if util.CheckPassword(hash, password) == nil {
+			return ErrPasswordReused
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+// Package ratelimit limits how often a key, a client IP, a user or an API
+// key, may make requests using token buckets.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit allows Requests requests per Period. Up to Requests can be made in
+// a burst, after that tokens come back evenly over the period.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// ParseLimit reads a limit written as "<requests>/<period>", for example
+// "20/1m". An empty string is the zero Limit, which means no limit.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Limit{}, nil
+	}
+
+	requests, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("rate limit %q must look like <requests>/<period>", s)
+	}
+
+	var limit Limit
+	var err error
+
+	if limit.Requests, err = strconv.Atoi(strings.TrimSpace(requests)); err != nil || limit.Requests < 1 {
+		return Limit{}, fmt.Errorf("rate limit %q needs a positive number of requests", s)
+	}
+
+	if limit.Period, err = time.ParseDuration(strings.TrimSpace(period)); err != nil || limit.Period <= 0 {
+		return Limit{}, fmt.Errorf("rate limit %q needs a positive period", s)
+	}
+
+	return limit, nil
+}
+
+func (l Limit) IsZero() bool {
+	return l.Requests == 0
+}
+
+// TokenInterval is how long it takes to get one token back.
+func (l Limit) TokenInterval() time.Duration {
+	return l.Period / time.Duration(l.Requests)
+}
+
+// Refill returns the tokens of a bucket that had tokens at updatedAt.
+func (l Limit) Refill(tokens float64, updatedAt, now time.Time) float64 {
+	elapsed := now.Sub(updatedAt)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	tokens += float64(elapsed) / float64(l.TokenInterval())
+	return math.Min(tokens, float64(l.Requests))
+}
+
+// Result describes the bucket of a key after a request took a token from
+// it, or failed to.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// RetryAfter is how long to wait for the next token, it is zero when
+	// the request was allowed.
+	RetryAfter time.Duration
+	// ResetAfter is how long until the bucket is full again.
+	ResetAfter time.Duration
+}
+
+// NewResult builds the result for a bucket left with tokens.
+func NewResult(limit Limit, tokens float64, allowed bool) Result {
+	result := Result{
+		Allowed:    allowed,
+		Limit:      limit.Requests,
+		Remaining:  int(math.Floor(tokens)),
+		ResetAfter: time.Duration((float64(limit.Requests) - tokens) * float64(limit.TokenInterval())),
+	}
+
+	if !allowed {
+		result.RetryAfter = time.Duration((1 - tokens) * float64(limit.TokenInterval()))
+	}
+
+	return result
+}
+
+// Store keeps the buckets. Take must refill the bucket of key and take one
+// token from it as a single atomic step.
+type Store interface {
+	Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error)
+}
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+	period    time.Duration
+}
+
+// sweepInterval is how often MemoryStore drops buckets that are full again.
+const sweepInterval = time.Minute
+
+// MemoryStore keeps buckets in the process. Every replica counts on its
+// own, use a shared store when running several.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*bucket)}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit, now time.Time) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) > sweepInterval {
+		s.sweep(now)
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(limit.Requests), updatedAt: now, period: limit.Period}
+		s.buckets[key] = b
+	}
+
+	b.tokens = limit.Refill(b.tokens, b.updatedAt, now)
+	b.updatedAt = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+
+	return NewResult(limit, b.tokens, allowed), nil
+}
+
+// sweep drops buckets that have not been used for longer than their
+// period. They would be full by now, the same as a new bucket.
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if now.Sub(b.updatedAt) > b.period {
+			delete(s.buckets, key)
+		}
+	}
+
+	s.lastSweep = now
+}
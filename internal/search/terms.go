@@ -0,0 +1,83 @@
+// Package search breaks names and emails into the terms user search
+// matches on.
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+// thaiGram is the length in runes of the pieces a Thai run is cut into.
+const thaiGram = 3
+
+// Terms returns the lowercased words of values without duplicates. Any
+// character that is not a letter, a digit or a mark separates words, so an
+// email yields its local part and domain pieces.
+//
+// Thai is written without spaces between words, a full name is a single
+// run. Instead of guessing word boundaries without a dictionary, a Thai run
+// yields itself and its overlapping three rune pieces. A query tokenised
+// the same way then matches any part of a Thai name, and names sharing more
+// pieces with the query rank higher.
+func Terms(values ...string) []string {
+	seen := make(map[string]bool)
+	terms := []string{}
+
+	add := func(term string) {
+		if term != "" && !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+
+	for _, value := range values {
+		for _, word := range words(strings.ToLower(value)) {
+			add(word)
+
+			runes := []rune(word)
+			if !isThai(runes[0]) || len(runes) <= thaiGram {
+				continue
+			}
+
+			for i := 0; i+thaiGram <= len(runes); i++ {
+				add(string(runes[i : i+thaiGram]))
+			}
+		}
+	}
+
+	return terms
+}
+
+// words splits s into runs of letters, digits and marks. A change between
+// Thai and other scripts also ends a word.
+func words(s string) []string {
+	var result []string
+	var current []rune
+
+	flush := func() {
+		if len(current) > 0 {
+			result = append(result, string(current))
+			current = current[:0]
+		}
+	}
+
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsMark(r) {
+			flush()
+			continue
+		}
+
+		if len(current) > 0 && isThai(current[0]) != isThai(r) {
+			flush()
+		}
+
+		current = append(current, r)
+	}
+
+	flush()
+	return result
+}
+
+func isThai(r rune) bool {
+	return unicode.Is(unicode.Thai, r)
+}
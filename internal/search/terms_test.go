@@ -0,0 +1,76 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTerms(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{
+			name:   "mixed thai and latin name",
+			values: []string{"Somchai สมชายJaidee"},
+			want:   []string{"somchai", "สมชาย", "สมช", "มชา", "ชาย", "jaidee"},
+		},
+		{
+			name:   "email",
+			values: []string{"Somchai.J@Example.co.th"},
+			want:   []string{"somchai", "j", "example", "co", "th"},
+		},
+		{
+			name:   "thai run of three runes",
+			values: []string{"ชาย"},
+			want:   []string{"ชาย"},
+		},
+		{
+			name:   "thai run longer than three runes",
+			values: []string{"ใจดี"},
+			want:   []string{"ใจดี", "ใจด", "จดี"},
+		},
+		{
+			name:   "duplicates",
+			values: []string{"Anan ANAN", "anan@anan.com", "ชาย ชายชาย"},
+			want:   []string{"anan", "com", "ชาย", "ชายชาย", "ายช", "ยชา"},
+		},
+		{
+			name:   "no words",
+			values: []string{"", " .@ "},
+			want:   []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Terms(tt.values...)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Terms(%q) = %q, want %q", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWords(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  []string
+	}{
+		{name: "separators", value: "anan.dee@example.com", want: []string{"anan", "dee", "example", "com"}},
+		{name: "script change", value: "abcสมชาย123", want: []string{"abc", "สมชาย", "123"}},
+		{name: "thai marks stay in the word", value: "น้ำใจ", want: []string{"น้ำใจ"}},
+		{name: "empty", value: "", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := words(tt.value)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("words(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
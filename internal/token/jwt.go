@@ -5,12 +5,12 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/golang-jwt/jwt/v4"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type Maker interface {
-	CreateToken(objectId primitive.ObjectID, duration time.Duration) (string, *Payload, error)
+	CreateToken(objectId primitive.ObjectID, duration time.Duration, opts ...PayloadOption) (string, *Payload, error)
 	VerifyToken(token string) (*Payload, error)
 }
 
@@ -28,8 +28,8 @@ func NewMaker(secretKey string) (Maker, error) {
 	}, nil
 }
 
-func (m *JWTMaker) CreateToken(objectId primitive.ObjectID, duration time.Duration) (string, *Payload, error) {
-	payload, err := NewPayload(objectId, duration)
+func (m *JWTMaker) CreateToken(objectId primitive.ObjectID, duration time.Duration, opts ...PayloadOption) (string, *Payload, error) {
+	payload, err := NewPayload(objectId, duration, opts...)
 	if err != nil {
 		return "", nil,err
 	}
@@ -0,0 +1,77 @@
+package token
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// KeyRingJWTMaker signs JWTs with the current asymmetric key of a KeyRing and
+// sets the "kid" header, so verifiers only need the published public keys.
+type KeyRingJWTMaker struct {
+	ring *KeyRing
+}
+
+func NewKeyRingMaker(ring *KeyRing) Maker {
+	return &KeyRingJWTMaker{
+		ring: ring,
+	}
+}
+
+func (m *KeyRingJWTMaker) CreateToken(objectId primitive.ObjectID, duration time.Duration, opts ...PayloadOption) (string, *Payload, error) {
+	payload, err := NewPayload(objectId, duration, opts...)
+	if err != nil {
+		return "", nil, err
+	}
+
+	key, err := m.ring.Current()
+	if err != nil {
+		return "", nil, err
+	}
+
+	jwtToken := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), payload)
+	jwtToken.Header["kid"] = key.ID
+
+	token, err := jwtToken.SignedString(key.PrivateKey)
+
+	return token, payload, err
+}
+
+func (m *KeyRingJWTMaker) VerifyToken(token string) (*Payload, error) {
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		kid, ok := token.Header["kid"].(string)
+		if !ok {
+			return nil, fmt.Errorf("token is invalid")
+		}
+
+		key, err := m.ring.Key(kid)
+		if err != nil {
+			return nil, err
+		}
+
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("token is invalid")
+		}
+
+		return key.PrivateKey.Public(), nil
+	}
+
+	jwtToken, err := jwt.ParseWithClaims(token, &Payload{}, keyFunc)
+	if err != nil {
+		return nil, fmt.Errorf("token is invalid")
+	}
+
+	payload, ok := jwtToken.Claims.(*Payload)
+	if !ok {
+		return nil, fmt.Errorf("token is invalid")
+	}
+
+	err = payload.Valid()
+	if err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
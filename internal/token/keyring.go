@@ -0,0 +1,261 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+var ErrSigningKeyNotFound = errors.New("signing key not found")
+
+// SigningKey is one asymmetric key of a KeyRing. A key signs new tokens
+// until it is retired, after that it only verifies tokens until the ring's
+// grace period runs out.
+type SigningKey struct {
+	ID         string
+	Algorithm  string
+	PrivateKey crypto.Signer
+	CreatedAt  time.Time
+	RetiredAt  *time.Time
+}
+
+func GenerateSigningKey(algorithm string) (*SigningKey, error) {
+	var privateKey crypto.Signer
+	switch algorithm {
+	case AlgorithmRS256:
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		privateKey = key
+	case AlgorithmEdDSA:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		privateKey = key
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", algorithm)
+	}
+
+	return &SigningKey{
+		ID:         uuid.NewString(),
+		Algorithm:  algorithm,
+		PrivateKey: privateKey,
+		CreatedAt:  time.Now(),
+	}, nil
+}
+
+// ParseSigningKey restores a key from its PKCS#8 PEM encoding.
+func ParseSigningKey(id, algorithm string, privateKeyPEM []byte, createdAt time.Time, retiredAt *time.Time) (*SigningKey, error) {
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil {
+		return nil, errors.New("invalid signing key PEM")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	var privateKey crypto.Signer
+	switch algorithm {
+	case AlgorithmRS256:
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("signing key is not an RSA key")
+		}
+		privateKey = rsaKey
+	case AlgorithmEdDSA:
+		edKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("signing key is not an Ed25519 key")
+		}
+		privateKey = edKey
+	default:
+		return nil, fmt.Errorf("unsupported signing algorithm: %s", algorithm)
+	}
+
+	return &SigningKey{
+		ID:         id,
+		Algorithm:  algorithm,
+		PrivateKey: privateKey,
+		CreatedAt:  createdAt,
+		RetiredAt:  retiredAt,
+	}, nil
+}
+
+// MarshalPrivateKey encodes the private key as PKCS#8 PEM.
+func (k *SigningKey) MarshalPrivateKey() ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(k.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+func (k *SigningKey) IsRetired() bool {
+	return k.RetiredAt != nil
+}
+
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func (k *SigningKey) JWK() JWK {
+	jwk := JWK{
+		KeyID:     k.ID,
+		Algorithm: k.Algorithm,
+		Use:       "sig",
+	}
+
+	switch public := k.PrivateKey.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	}
+
+	return jwk
+}
+
+// KeyRing holds every signing key that may still verify a token. A freshly
+// created key only starts signing after activationDelay, which gives other
+// replicas time to load it before they see tokens that use it.
+type KeyRing struct {
+	mu              sync.RWMutex
+	keys            map[string]*SigningKey
+	gracePeriod     time.Duration
+	activationDelay time.Duration
+}
+
+func NewKeyRing(gracePeriod, activationDelay time.Duration) *KeyRing {
+	return &KeyRing{
+		keys:            make(map[string]*SigningKey),
+		gracePeriod:     gracePeriod,
+		activationDelay: activationDelay,
+	}
+}
+
+// SetKeys replaces the content of the ring, keys that are past their grace
+// period are dropped.
+func (r *KeyRing) SetKeys(keys []*SigningKey) {
+	ring := make(map[string]*SigningKey, len(keys))
+	for _, key := range keys {
+		if r.expired(key) {
+			continue
+		}
+		ring[key.ID] = key
+	}
+
+	r.mu.Lock()
+	r.keys = ring
+	r.mu.Unlock()
+}
+
+// Current returns the key new tokens are signed with: the newest active key
+// that is past its activation delay, or the oldest active key if none is.
+func (r *KeyRing) Current() (*SigningKey, error) {
+	active := r.activeKeys()
+	if len(active) == 0 {
+		return nil, ErrSigningKeyNotFound
+	}
+
+	activeSince := time.Now().Add(-r.activationDelay)
+	for _, key := range active {
+		if !key.CreatedAt.After(activeSince) {
+			return key, nil
+		}
+	}
+
+	return active[len(active)-1], nil
+}
+
+// Key looks up a key by its kid for verification.
+func (r *KeyRing) Key(id string) (*SigningKey, error) {
+	r.mu.RLock()
+	key, ok := r.keys[id]
+	r.mu.RUnlock()
+
+	if !ok || r.expired(key) {
+		return nil, ErrSigningKeyNotFound
+	}
+
+	return key, nil
+}
+
+// JWKS publishes the public half of every key that can still verify tokens.
+func (r *KeyRing) JWKS() JWKS {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range r.keys {
+		if r.expired(key) {
+			continue
+		}
+		jwks.Keys = append(jwks.Keys, key.JWK())
+	}
+
+	sort.Slice(jwks.Keys, func(i, j int) bool {
+		return jwks.Keys[i].KeyID < jwks.Keys[j].KeyID
+	})
+
+	return jwks
+}
+
+// activeKeys returns the keys that are not retired, newest first.
+func (r *KeyRing) activeKeys() []*SigningKey {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var active []*SigningKey
+	for _, key := range r.keys {
+		if !key.IsRetired() {
+			active = append(active, key)
+		}
+	}
+
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].CreatedAt.After(active[j].CreatedAt)
+	})
+
+	return active
+}
+
+func (r *KeyRing) expired(key *SigningKey) bool {
+	return key.IsRetired() && time.Now().After(key.RetiredAt.Add(r.gracePeriod))
+}
@@ -8,11 +8,106 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+type TokenType string
+
+const (
+	TokenTypeAccess  TokenType = "access"
+	TokenTypeRefresh TokenType = "refresh"
+	// TokenTypeMFAPending proves the password was checked and can only be
+	// exchanged for an access token together with a second factor.
+	TokenTypeMFAPending TokenType = "mfa_pending"
+	// TokenTypeAPIKey marks a payload built from an API key. It is never
+	// signed, the key itself is checked against the database on every call.
+	TokenTypeAPIKey TokenType = "api_key"
+)
+
 type Payload struct {
-	SessionID uuid.UUID `json:"session_id"`
-	ID  primitive.ObjectID    `json:"id"`
-	ExpiredAt time.Time `json:"expired_at"`
-	IssuedAt  time.Time `json:"issued_at"`
+	SessionID uuid.UUID          `json:"session_id"`
+	ID        primitive.ObjectID `json:"id"`
+	TokenType TokenType          `json:"token_type"`
+	Roles     []string           `json:"roles,omitempty"`
+	Scopes    []string           `json:"scopes,omitempty"`
+	APIKeyID  string             `json:"api_key_id,omitempty"`
+	// ActorID is the admin behind an impersonation token, ID is then the
+	// impersonated user.
+	ActorID *primitive.ObjectID `json:"actor_id,omitempty"`
+	// OrgID is the active organization of the token, OrgRole the user's
+	// role in it when the token was issued.
+	OrgID     *primitive.ObjectID `json:"org_id,omitempty"`
+	OrgRole   string              `json:"org_role,omitempty"`
+	ExpiredAt time.Time           `json:"expired_at"`
+	IssuedAt  time.Time           `json:"issued_at"`
+}
+
+// PayloadOption customizes a payload before it is validated and signed.
+type PayloadOption func(p *Payload)
+
+// WithSessionID binds the token to an existing session instead of starting a new one.
+func WithSessionID(sessionID uuid.UUID) PayloadOption {
+	return func(p *Payload) {
+		p.SessionID = sessionID
+	}
+}
+
+// WithTokenType sets the token type, tokens are access tokens by default.
+func WithTokenType(tokenType TokenType) PayloadOption {
+	return func(p *Payload) {
+		p.TokenType = tokenType
+	}
+}
+
+// WithRoles embeds the roles of the user at the time the token is issued.
+func WithRoles(roles []string) PayloadOption {
+	return func(p *Payload) {
+		p.Roles = roles
+	}
+}
+
+// WithActor marks the token as an impersonation of the token's user by
+// actorID.
+func WithActor(actorID primitive.ObjectID) PayloadOption {
+	return func(p *Payload) {
+		p.ActorID = &actorID
+	}
+}
+
+// WithOrg makes orgID the active organization of the token.
+func WithOrg(orgID primitive.ObjectID, role string) PayloadOption {
+	return func(p *Payload) {
+		p.OrgID = &orgID
+		p.OrgRole = role
+	}
+}
+
+func (p *Payload) IsImpersonation() bool {
+	return p.ActorID != nil
+}
+
+func (p *Payload) HasRole(role string) bool {
+	for _, r := range p.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasScope reports whether the caller may use scope. Only API keys are
+// limited by scopes, tokens issued at login may do whatever their roles
+// allow.
+func (p *Payload) HasScope(scope string) bool {
+	if p.TokenType != TokenTypeAPIKey {
+		return true
+	}
+
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
 }
 
 func (p *Payload) Valid() error {
@@ -28,9 +123,16 @@ func (p *Payload) Valid() error {
 		return errors.New("email cannot be empty")
 	}
 
+	switch p.TokenType {
+	case TokenTypeAccess, TokenTypeRefresh, TokenTypeMFAPending:
+	default:
+		return errors.New("invalid token type")
+	}
+
 	return nil
 }
-func NewPayload(objectId primitive.ObjectID, duration time.Duration) (*Payload, error) {
+
+func NewPayload(objectId primitive.ObjectID, duration time.Duration, opts ...PayloadOption) (*Payload, error) {
 	sessionID, err := uuid.NewRandom()
 	if err != nil {
 		return nil, err
@@ -38,11 +140,16 @@ func NewPayload(objectId primitive.ObjectID, duration time.Duration) (*Payload,
 
 	payload := &Payload{
 		SessionID: sessionID,
-		ID:  objectId,
+		ID:        objectId,
+		TokenType: TokenTypeAccess,
 		IssuedAt:  time.Now(),
 		ExpiredAt: time.Now().Add(duration),
 	}
 
+	for _, opt := range opts {
+		opt(payload)
+	}
+
 	if err := payload.Valid(); err != nil {
 		return nil, err
 	}
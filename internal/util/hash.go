@@ -0,0 +1,14 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// HashToken returns the hex encoded SHA-256 digest of a bearer secret so it can
+// be stored and compared without keeping the secret itself.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
@@ -1,13 +1,183 @@
 package util
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	PasswordAlgorithmArgon2id = "argon2id"
+	PasswordAlgorithmBcrypt   = "bcrypt"
+)
+
+var (
+	ErrPasswordMismatch    = errors.New("password does not match")
+	ErrUnknownPasswordHash = errors.New("unknown password hash format")
+)
+
+// PasswordHashParams decides how new passwords are hashed. Stored hashes made
+// with other parameters still verify and are reported by PasswordNeedsRehash.
+type PasswordHashParams struct {
+	Algorithm         string
+	BcryptCost        int
+	Argon2Memory      uint32
+	Argon2Iterations  uint32
+	Argon2Parallelism uint8
+}
+
+var DefaultPasswordHashParams = PasswordHashParams{
+	Algorithm:         PasswordAlgorithmArgon2id,
+	BcryptCost:        12,
+	Argon2Memory:      64 * 1024,
+	Argon2Iterations:  3,
+	Argon2Parallelism: 2,
+}
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+var passwordHashParams = DefaultPasswordHashParams
+
+// SetPasswordHashParams changes the parameters used by HashPassword. It is
+// meant to be called once at startup.
+func SetPasswordHashParams(params PasswordHashParams) error {
+	switch params.Algorithm {
+	case PasswordAlgorithmArgon2id:
+		if params.Argon2Memory == 0 || params.Argon2Iterations == 0 || params.Argon2Parallelism == 0 {
+			return errors.New("argon2id memory, iterations and parallelism must be positive")
+		}
+	case PasswordAlgorithmBcrypt:
+		if params.BcryptCost < bcrypt.MinCost || params.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return fmt.Errorf("unknown password hash algorithm: %s", params.Algorithm)
+	}
+
+	passwordHashParams = params
+	return nil
+}
 
 func HashPassword(password string) (string, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	
-	return string(hashedPassword), err
+	params := passwordHashParams
+
+	if params.Algorithm == PasswordAlgorithmBcrypt {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), params.BcryptCost)
+		return string(hashedPassword), err
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Argon2Iterations, params.Argon2Memory, params.Argon2Parallelism, argon2KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, params.Argon2Memory, params.Argon2Iterations, params.Argon2Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword verifies password against a bcrypt or argon2id hash.
+func CheckPassword(hashedPassword, password string) error {
+	if strings.HasPrefix(hashedPassword, "$argon2id$") {
+		hash, err := parseArgon2idHash(hashedPassword)
+		if err != nil {
+			return err
+		}
+
+		key := argon2.IDKey([]byte(password), hash.salt, hash.iterations, hash.memory, hash.parallelism, uint32(len(hash.key)))
+		if subtle.ConstantTimeCompare(key, hash.key) != 1 {
+			return ErrPasswordMismatch
+		}
+
+		return nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrPasswordMismatch
+	}
+
+	return err
 }
 
-func CheckPassword(hashedPassword, password string) error{
-	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
-}
\ No newline at end of file
+// PasswordNeedsRehash reports whether a stored hash was made with another
+// algorithm or weaker parameters than the current ones, so it should be
+// replaced the next time the plain password is known.
+func PasswordNeedsRehash(hashedPassword string) bool {
+	params := passwordHashParams
+
+	if strings.HasPrefix(hashedPassword, "$argon2id$") {
+		if params.Algorithm != PasswordAlgorithmArgon2id {
+			return true
+		}
+
+		hash, err := parseArgon2idHash(hashedPassword)
+		if err != nil {
+			return true
+		}
+
+		return hash.memory < params.Argon2Memory ||
+			hash.iterations < params.Argon2Iterations ||
+			hash.parallelism < params.Argon2Parallelism
+	}
+
+	if params.Algorithm != PasswordAlgorithmBcrypt {
+		return true
+	}
+
+	cost, err := bcrypt.Cost([]byte(hashedPassword))
+	if err != nil {
+		return true
+	}
+
+	return cost < params.BcryptCost
+}
+
+type argon2idHash struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+// parseArgon2idHash reads the PHC string format
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>.
+func parseArgon2idHash(encoded string) (*argon2idHash, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return nil, ErrUnknownPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, ErrUnknownPasswordHash
+	}
+
+	var hash argon2idHash
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &hash.memory, &hash.iterations, &hash.parallelism); err != nil {
+		return nil, ErrUnknownPasswordHash
+	}
+
+	var err error
+	if hash.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, ErrUnknownPasswordHash
+	}
+
+	if hash.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(hash.key) == 0 {
+		return nil, ErrUnknownPasswordHash
+	}
+
+	return &hash, nil
+}
@@ -0,0 +1,16 @@
+package util
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+)
+
+// RandomToken returns a URL safe random string built from n random bytes.
+func RandomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}